@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"git.sr.ht/~sirodoht/lakehouse/internal"
+)
+
+// highlightcss prints the stylesheet of highlighted code blocks:
+//
+//	go run ./cmd/highlightcss > static/highlight.css
+func main() {
+	err := internal.WriteHighlightCSS(os.Stdout)
+	if err != nil {
+		fmt.Printf("error writing css: %v\n", err)
+		os.Exit(1)
+	}
+}
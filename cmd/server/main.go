@@ -2,59 +2,213 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"git.sr.ht/~sirodoht/lakehouse/internal"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"go.uber.org/zap"
 )
 
 func main() {
-	// debug mode
-	debugMode := os.Getenv("DEBUG")
+	// "lakehouse config show" prints the configuration instead of serving
+	args := os.Args[1:]
+	showConfig := len(args) >= 2 && args[0] == "config" && args[1] == "show"
+	if showConfig {
+		args = args[2:]
+	}
+	cfg, err := internal.LoadConfig(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	invalid := cfg.Validate()
+	if showConfig {
+		err = cfg.Redacted().WriteTOML(os.Stdout)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if invalid != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", invalid)
+		os.Exit(1)
+	}
+	if showConfig {
+		return
+	}
 
-	// database connection
-	databaseURL := os.Getenv("DATABASE_URL")
-	db, err := sqlx.Connect("postgres", databaseURL)
+	// logs are JSON lines in production and readable in development
+	logger, err := internal.NewLogger(cfg.Log)
 	if err != nil {
 		panic(err)
 	}
+	defer func() {
+		_ = logger.Sync()
+	}()
+
+	// stop on SIGINT and SIGTERM, which systemd sends on restart
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+
+	// tracing, exported over OTLP or to stdout when enabled
+	tracerProvider, err := internal.NewTracerProvider(ctx, cfg.Tracing)
+	if err != nil {
+		logger.With(zap.Error(err)).Fatal("failed to set up tracing")
+	}
+
+	// database connection
+	db, err := sqlx.Connect("postgres", cfg.DatabaseURL)
+	if err != nil {
+		logger.With(zap.Error(err)).Fatal("failed to connect to database")
+	}
+
+	// templates are built in, or read from disk on every use in development
+	templateFS := internal.TemplateFS()
+	if cfg.ReloadTemplates {
+		templateFS = os.DirFS("internal/templates")
+	}
+	integrity, err := internal.LoadAssetIntegrity(cfg.StaticDir)
+	if err != nil {
+		logger.With(zap.Error(err)).Warn(
+			"vendored scripts are linked without integrity, " +
+				"run make vendor-js",
+		)
+	}
+	templates, err := internal.NewTemplates(
+		templateFS,
+		cfg.ReloadTemplates,
+		integrity,
+	)
+	if err != nil {
+		logger.With(zap.Error(err)).Fatal("failed to parse templates")
+	}
 
 	// instantiate
-	store := internal.NewSQLStore(db)
-	handlerAPI := internal.NewHandlerAPI(store)
-	handlerPage := internal.NewHandlerPage(store)
+	store := internal.NewSQLStore(db, logger)
+	handlerAPI := internal.NewHandlerAPI(store, logger)
+	handlerPage := internal.NewHandlerPage(
+		store,
+		templates,
+		cfg.Cookie,
+		internal.NewLoginLimiter(store, cfg.Login),
+		logger,
+	)
+	handlerGraphQL := internal.NewHandlerGraphQL(store, logger)
+	handlerHealth := internal.NewHandlerHealth(store, logger)
+	metrics := internal.NewMetrics(
+		db.DB,
+		store,
+		cfg.Metrics.CollabStatsURL,
+		logger,
+	)
+
+	// email digests, written to files unless an smtp server is configured
+	if cfg.Features.Digests {
+		var mailer internal.Mailer
+		if cfg.Mail.Mailer == internal.MailerSMTP {
+			mailer = internal.NewSMTPMailer(
+				cfg.Mail.SMTPAddr,
+				cfg.Mail.SMTPUsername,
+				cfg.Mail.SMTPPassword,
+				cfg.Mail.From,
+			)
+		} else {
+			mailer = internal.NewFileMailer(cfg.Mail.Dir, cfg.Mail.From)
+		}
+		digester := internal.NewDigester(
+			store,
+			mailer,
+			templates,
+			cfg.BaseURL,
+			logger,
+		)
+		go digester.Run(ctx, 15*time.Minute)
+	}
+
+	// purge documents from trash after the retention period
+	if cfg.Features.TrashPurge {
+		go internal.RunTrashPurge(
+			ctx,
+			store,
+			cfg.TrashRetention,
+			time.Hour,
+			logger,
+		)
+	}
 
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
 
-	// midd to check if user is authenticated
+	// midd to check if user is authenticated, by cookie or bearer token
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var username string
+			var userID int64
+			var unreadCount int
 			isAuthenticated := false
-			c, err := r.Cookie("session")
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				username = store.GetUsernameSession(r.Context(), c.Value)
+			isAdmin := false
+			passwordReset := false
+			token := internal.SessionToken(r, cfg.Cookie.Name)
+			if token != "" {
+				user, err := store.GetUserSession(r.Context(), token)
 				if err == nil {
+					username = user.Username
+					userID = user.ID
 					isAuthenticated = true
+					isAdmin = user.IsAdmin
+					passwordReset = user.PasswordResetRequired
+					unreadCount, err = store.CountUnreadNotification(
+						r.Context(),
+						user.ID,
+					)
+					if err != nil {
+						internal.RequestLogger(r.Context(), logger).With(
+							zap.Error(err),
+						).Error("failed to count unread notifications")
+					}
 				}
 			}
 			ctx := context.WithValue(r.Context(), internal.KeyUsername, username)
 			ctx = context.WithValue(ctx, internal.KeyIsAuthenticated, isAuthenticated)
+			ctx = context.WithValue(ctx, internal.KeyUserID, userID)
+			ctx = context.WithValue(ctx, internal.KeyUnreadCount, unreadCount)
+			ctx = context.WithValue(ctx, internal.KeyIsAdmin, isAdmin)
+			ctx = context.WithValue(ctx, internal.KeyPasswordReset, passwordReset)
 
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	})
 
+	// log requests, with the user known from the middleware above
+	r.Use(internal.AccessLog(logger))
+
+	// a panic is logged and answered with a 500, pages get error pages
+	r.Use(handlerPage.Recoverer)
+	r.NotFound(handlerPage.NotFound)
+	r.MethodNotAllowed(handlerPage.MethodNotAllowed)
+
+	// forms posted with the session cookie must carry its csrf token
+	r.Use(handlerPage.CSRF)
+
+	// users whose password an admin reset must choose a new one first
+	r.Use(handlerPage.RequirePasswordReset)
+
 	// Page Index
 	r.Get("/", handlerPage.RenderIndex)
 
@@ -65,17 +219,30 @@ func main() {
 	r.Get("/docs/{id}", handlerPage.RenderOneDocument)
 	r.Get("/docs/{id}/edit", handlerPage.RenderEditDocument)
 	r.Post("/docs/{id}/edit", handlerPage.SaveEditDocument)
+	r.Post("/docs/{id}/follow", handlerPage.FollowDocument)
+	r.Post("/docs/{id}/unfollow", handlerPage.UnfollowDocument)
+	r.Post("/docs/{id}/delete", handlerPage.DeleteDocument)
+	r.Post("/docs/{id}/template", handlerPage.SetDocumentTemplate)
 
-	// API Documents
-	r.Post("/api/docs", handlerAPI.InsertDocumentHandler)
-	r.Get("/api/docs", handlerAPI.GetAllDocumentHandler)
-	r.Patch("/api/docs/{id}", handlerAPI.UpdateDocumentHandler)
-	r.Get("/api/docs/{id}", handlerAPI.GetOneDocumentHandler)
+	// Page Trash
+	r.Get("/trash", handlerPage.RenderTrash)
+	r.Post("/trash/{id}/restore", handlerPage.RestoreDocument)
+	r.Post("/trash/{id}/purge", handlerPage.PurgeDocument)
 
-	// API Users
-	r.Post("/api/users", handlerAPI.InsertUserHandler)
-	r.Get("/api/users/{id}", handlerAPI.GetOneUserHandler)
-	r.Patch("/api/users/{id}", handlerAPI.UpdateUserHandler)
+	// API, under /api/v1/ with the unversioned routes as deprecated aliases
+	r.Route("/api/v1", handlerAPI.Routes)
+	if cfg.Features.DeprecatedAPI {
+		r.Route("/api", func(r chi.Router) {
+			r.Use(handlerAPI.DeprecatedAPI)
+			handlerAPI.Routes(r)
+		})
+	}
+
+	// GraphQL
+	if cfg.Features.GraphQL {
+		r.Get("/graphql", handlerGraphQL.QueryHandler)
+		r.Post("/graphql", handlerGraphQL.QueryHandler)
+	}
 
 	// Page Users
 	r.Get("/signup", handlerPage.RenderNewUser)
@@ -84,25 +251,141 @@ func main() {
 	r.Post("/login", handlerPage.CreateSession)
 	r.Post("/logout", handlerPage.DeleteSession)
 
+	// Page Notifications
+	r.Get("/notifications", handlerPage.RenderNotifications)
+	r.Post("/notifications/read", handlerPage.MarkNotificationsRead)
+
+	// Page Settings
+	r.Get("/settings", handlerPage.RenderSettings)
+	r.Post("/settings", handlerPage.SaveSettings)
+	r.Get("/settings/password", handlerPage.RenderPassword)
+	r.Post("/settings/password", handlerPage.SavePassword)
+
 	// dashboard
 	r.Get("/dashboard", handlerPage.RenderDashboard)
 
+	// Page Admin
+	r.Group(func(r chi.Router) {
+		r.Use(handlerPage.RequireAdmin)
+		r.Get("/admin", handlerPage.RenderAdmin)
+		r.Get("/admin/users", handlerPage.RenderAdminUsers)
+		r.Get("/admin/users/{id}", handlerPage.RenderAdminUser)
+		r.Post("/admin/users/{id}/disable", handlerPage.DisableUser)
+		r.Post("/admin/users/{id}/enable", handlerPage.EnableUser)
+		r.Post("/admin/users/{id}/reset-password", handlerPage.ResetUserPassword)
+		r.Post("/admin/users/{id}/revoke-sessions", handlerPage.RevokeUserSessions)
+		r.Post("/admin/users/{id}/role", handlerPage.SetUserRole)
+		r.Post("/admin/transfer", handlerPage.TransferDocument)
+		r.Get("/admin/audit", handlerPage.RenderAudit)
+		r.Get("/admin/audit.csv", handlerPage.ExportAudit)
+	})
+
 	// static files
-	if debugMode == "1" {
-		fileServer := http.FileServer(http.Dir("./static/"))
+	if cfg.StaticDir != "" {
+		fileServer := http.FileServer(http.Dir(cfg.StaticDir))
 		r.Handle("/static/*", http.StripPrefix("/static", fileServer))
 	}
 
+	// health checks, outside of the middlewares above so probes stay cheap
+	root := chi.NewRouter()
+	root.Use(internal.Tracing)
+	root.Use(internal.RequestID(logger))
+	root.Use(internal.ClientInfo(cfg.TrustProxy))
+	if cfg.Metrics.Enabled {
+		root.Use(metrics.Middleware)
+	}
+	root.Get("/healthz", handlerHealth.LivenessHandler)
+	root.Get("/readyz", handlerHealth.ReadinessHandler)
+	root.Mount("/", r)
+
+	// metrics, on their own address if set so they need not be public
+	var metricsSrv *http.Server
+	if cfg.Metrics.Enabled {
+		metricsHandler := metrics.Handler(cfg.Metrics.Token)
+		if cfg.Metrics.ListenAddr == "" {
+			root.Get("/metrics", metricsHandler.ServeHTTP)
+		} else {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metricsHandler)
+			metricsSrv = &http.Server{
+				Addr:         cfg.Metrics.ListenAddr,
+				Handler:      mux,
+				ReadTimeout:  cfg.Timeouts.Read,
+				WriteTimeout: cfg.Timeouts.Write,
+				IdleTimeout:  cfg.Timeouts.Idle,
+			}
+		}
+	}
+
 	// serve
-	fmt.Println("Listening on http://127.0.0.1:8000/")
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		logger.With(zap.Error(err)).Fatal("failed to listen")
+	}
+	logger.With(zap.String("addr", ln.Addr().String())).Info("listening")
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         ":8000",
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Handler:      root,
+		ReadTimeout:  cfg.Timeouts.Read,
+		WriteTimeout: cfg.Timeouts.Write,
+		IdleTimeout:  cfg.Timeouts.Idle,
 	}
-	err = srv.ListenAndServe()
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+	if metricsSrv != nil {
+		logger.With(
+			zap.String("addr", metricsSrv.Addr),
+		).Info("serving metrics")
+		go func() {
+			serveErr <- metricsSrv.ListenAndServe()
+		}()
+	}
+
+	// tell systemd we are up, and keep telling its watchdog
+	err = internal.SdNotify(internal.SdReady)
 	if err != nil {
-		panic(err)
+		logger.With(zap.Error(err)).Warn("failed to notify systemd")
+	}
+	if interval := internal.SdWatchdogInterval(); interval > 0 {
+		go internal.RunSdWatchdog(ctx, interval, logger)
+	}
+
+	select {
+	case err = <-serveErr:
+		logger.With(zap.Error(err)).Fatal("failed to serve")
+	case <-ctx.Done():
+	}
+
+	// stop accepting connections and let in-flight requests finish, a second
+	// signal stops right away
+	stop()
+	logger.Info("shutting down")
+	err = internal.SdNotify(internal.SdStopping)
+	if err != nil {
+		logger.With(zap.Error(err)).Warn("failed to notify systemd")
+	}
+	shutdownCtx, cancel := context.WithTimeout(
+		context.Background(),
+		cfg.Timeouts.Shutdown,
+	)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.With(zap.Error(err)).Error("failed to finish requests")
+		_ = srv.Close()
+	}
+	if metricsSrv != nil {
+		_ = metricsSrv.Close()
+	}
+	err = db.Close()
+	if err != nil {
+		logger.With(zap.Error(err)).Error("failed to close database")
+	}
+	if tracerProvider != nil {
+		err = tracerProvider.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.With(zap.Error(err)).Error("failed to flush traces")
+		}
 	}
 }
@@ -0,0 +1,597 @@
+package internal
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// auditPageSize is the number of events on a page of the audit log.
+const auditPageSize = 100
+
+// RequireAdmin is a middleware that lets only admins through. Anonymous
+// users are sent to log in first.
+func (page *Page) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userIDFromContext(r.Context()) == 0 {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if !isAdminFromContext(r.Context()) {
+			page.renderError(w, r, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RenderAdmin shows the numbers of users and documents and the storage they
+// take.
+func (page *Page) RenderAdmin(w http.ResponseWriter, r *http.Request) {
+	counts, err := page.store.GetCounts(r.Context())
+	if err != nil {
+		page.internalError(w, r, err, "failed to count rows")
+		return
+	}
+	stats, err := page.store.GetAdminStats(r.Context())
+	if err != nil {
+		page.internalError(w, r, err, "failed to get admin stats")
+		return
+	}
+	type tableSize struct {
+		Name string
+		Size string
+	}
+	var tables []tableSize
+	for _, t := range stats.Tables {
+		tables = append(tables, tableSize{t.Name, formatBytes(t.Bytes)})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("admin.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile admin template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"Counts":          counts,
+		"Stats":           stats,
+		"DocumentSize":    formatBytes(stats.DocumentBytes),
+		"DatabaseSize":    formatBytes(stats.DatabaseBytes),
+		"Tables":          tables,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RenderAdminUsers lists users by username, searched by username or email.
+func (page *Page) RenderAdminUsers(w http.ResponseWriter, r *http.Request) {
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	users, err := page.store.GetAllAdminUser(r.Context(), UserQuery{
+		Search: search,
+		After:  r.URL.Query().Get("after"),
+		Limit:  DefaultPageLimit,
+	})
+	if err != nil {
+		page.internalError(w, r, err, "failed to get users")
+		return
+	}
+	var nextURL string
+	if len(users) == DefaultPageLimit {
+		next := url.Values{}
+		next.Set("q", search)
+		next.Set("after", users[len(users)-1].Username)
+		nextURL = "/admin/users?" + next.Encode()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("admin_users.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile admin users template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"Search":          search,
+		"UserList":        users,
+		"NextURL":         nextURL,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (page *Page) RenderAdminUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := page.parseUserID(w, r)
+	if !ok {
+		return
+	}
+	user, err := page.store.GetOneAdminUser(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to get user")
+		return
+	}
+	docs, err := page.store.GetAllDocumentByOwner(r.Context(), id)
+	if err != nil {
+		page.internalError(w, r, err, "failed to get documents")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("admin_user.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile admin user template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"User":            user,
+		"IsSelf":          id == userIDFromContext(r.Context()),
+		"DocumentList":    docs,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// parseUserID returns the user id of the url, or responds with a 404.
+func (page *Page) parseUserID(
+	w http.ResponseWriter,
+	r *http.Request,
+) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("invalid id")
+		page.renderError(w, r, http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+// getAdminTarget returns the user of the url an admin acts on, or responds
+// with a 404. Admins cannot lock themselves out, so acting on themselves is
+// refused when allowSelf is false.
+func (page *Page) getAdminTarget(
+	w http.ResponseWriter,
+	r *http.Request,
+	allowSelf bool,
+) (*User, bool) {
+	id, ok := page.parseUserID(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !allowSelf && id == userIDFromContext(r.Context()) {
+		page.renderErrorMessage(
+			w,
+			r,
+			http.StatusBadRequest,
+			"Ask another admin to do that to your own account.",
+		)
+		return nil, false
+	}
+	user, err := page.store.GetOneUser(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return nil, false
+		}
+		page.internalError(w, r, err, "failed to get user")
+		return nil, false
+	}
+	return user, true
+}
+
+// adminUserURL is the admin page of a user.
+func adminUserURL(id int64) string {
+	return "/admin/users/" + strconv.FormatInt(id, 10)
+}
+
+func (page *Page) DisableUser(w http.ResponseWriter, r *http.Request) {
+	page.setUserDisabled(w, r, true)
+}
+
+func (page *Page) EnableUser(w http.ResponseWriter, r *http.Request) {
+	page.setUserDisabled(w, r, false)
+}
+
+// setUserDisabled disables or enables a user. Disabling logs them out
+// everywhere too.
+func (page *Page) setUserDisabled(
+	w http.ResponseWriter,
+	r *http.Request,
+	disabled bool,
+) {
+	before, ok := page.getAdminTarget(w, r, !disabled)
+	if !ok {
+		return
+	}
+	after := *before
+	after.DisabledAt = nil
+	if disabled {
+		now := time.Now()
+		after.DisabledAt = &now
+	}
+	err := page.store.SetUserDisabled(r.Context(), before.ID, after.DisabledAt)
+	if err != nil {
+		page.internalError(w, r, err, "failed to disable user")
+		return
+	}
+	if disabled {
+		_, err = page.store.DeleteAllUserSession(r.Context(), before.ID, "")
+		if err != nil {
+			page.internalError(w, r, err, "failed to revoke sessions")
+			return
+		}
+	}
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditUser(AuditUserUpdated, before.ID, before, &after),
+	)
+
+	http.Redirect(w, r, adminUserURL(before.ID), http.StatusFound)
+}
+
+// ResetUserPassword replaces the password of a user with a temporary one,
+// logs them out everywhere, and shows the temporary password to the admin
+// once. The user logs in with it and has to choose a new password.
+func (page *Page) ResetUserPassword(w http.ResponseWriter, r *http.Request) {
+	before, ok := page.getAdminTarget(w, r, false)
+	if !ok {
+		return
+	}
+	password, err := generateTemporaryPassword()
+	if err != nil {
+		page.internalError(w, r, err, "failed to generate password")
+		return
+	}
+	hashedBytes, err := bcrypt.GenerateFromPassword(
+		[]byte(password),
+		bcrypt.DefaultCost,
+	)
+	if err != nil {
+		page.internalError(w, r, err, "failed to hash password")
+		return
+	}
+	err = page.store.RequireUserPasswordReset(
+		r.Context(),
+		before.ID,
+		string(hashedBytes),
+	)
+	if err != nil {
+		page.internalError(w, r, err, "failed to reset password")
+		return
+	}
+	_, err = page.store.DeleteAllUserSession(r.Context(), before.ID, "")
+	if err != nil {
+		page.internalError(w, r, err, "failed to revoke sessions")
+		return
+	}
+	after := *before
+	after.PasswordResetRequired = true
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditUser(AuditUserUpdated, before.ID, before, &after),
+	)
+
+	// the password is only ever shown here
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("admin_password_reset.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile password reset template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated":   r.Context().Value(KeyIsAuthenticated),
+		"Username":          r.Context().Value(KeyUsername),
+		"UnreadCount":       r.Context().Value(KeyUnreadCount),
+		"CSRFToken":         csrfTokenFromContext(r.Context()),
+		"User":              &after,
+		"TemporaryPassword": password,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// generateTemporaryPassword returns a random password for a user whose
+// password an admin reset.
+func generateTemporaryPassword() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// RevokeUserSessions logs a user out everywhere.
+func (page *Page) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := page.getAdminTarget(w, r, true)
+	if !ok {
+		return
+	}
+	revoked, err := page.store.DeleteAllUserSession(r.Context(), user.ID, "")
+	if err != nil {
+		page.internalError(w, r, err, "failed to revoke sessions")
+		return
+	}
+	e := auditUser(AuditTokensRevoked, user.ID, nil, nil)
+	e.After = auditSummary(map[string]interface{}{"sessions": revoked})
+	recordAudit(r.Context(), page.store, page.logger, e)
+
+	http.Redirect(w, r, adminUserURL(user.ID), http.StatusFound)
+}
+
+// SetUserRole makes a user an admin, or a regular user again.
+func (page *Page) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	before, ok := page.getAdminTarget(w, r, false)
+	if !ok {
+		return
+	}
+	after := *before
+	after.IsAdmin = r.FormValue("is_admin") == "true"
+	err := page.store.SetUserAdmin(r.Context(), before.ID, after.IsAdmin)
+	if err != nil {
+		page.internalError(w, r, err, "failed to change role")
+		return
+	}
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditUser(AuditUserRoleChanged, before.ID, before, &after),
+	)
+
+	http.Redirect(w, r, adminUserURL(before.ID), http.StatusFound)
+}
+
+// TransferDocument gives a document to the user with the username of the
+// form, then goes back to the admin page of its previous owner.
+func (page *Page) TransferDocument(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.FormValue("document_id"), 10, 64)
+	if err != nil {
+		page.renderErrorMessage(
+			w,
+			r,
+			http.StatusBadRequest,
+			"That is not a document id.",
+		)
+		return
+	}
+	owner, err := page.store.GetOneUserByUsername(
+		r.Context(),
+		strings.TrimSpace(r.FormValue("username")),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		page.renderErrorMessage(
+			w,
+			r,
+			http.StatusBadRequest,
+			"There is no user with that username.",
+		)
+		return
+	}
+	if err != nil {
+		page.internalError(w, r, err, "failed to get user")
+		return
+	}
+	before, err := page.store.GetOneDocument(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to get document")
+		return
+	}
+	err = page.store.SetDocumentOwner(r.Context(), id, owner.ID)
+	if err != nil {
+		page.internalError(w, r, err, "failed to transfer document")
+		return
+	}
+	after := *before
+	after.OwnerID = &owner.ID
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditDocument(AuditDocumentOwnerChanged, id, before, &after),
+	)
+
+	if before.OwnerID != nil {
+		http.Redirect(w, r, adminUserURL(*before.OwnerID), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, adminUserURL(owner.ID), http.StatusFound)
+}
+
+// formatBytes formats a size in bytes for people, in powers of 1024.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size := float64(n)
+	unit := -1
+	for size >= 1024 && unit < len("KMGTPE")-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, "KMGTPE"[unit])
+}
+
+// parseAuditQuery reads the filters of the audit log from the query string.
+// Dates are days, and to includes the whole of its day.
+func parseAuditQuery(values url.Values) AuditQuery {
+	q := AuditQuery{
+		Kind:          values.Get("kind"),
+		ActorUsername: strings.TrimSpace(values.Get("actor")),
+		TargetType:    values.Get("target_type"),
+		IP:            strings.TrimSpace(values.Get("ip")),
+	}
+	q.TargetID, _ = strconv.ParseInt(values.Get("target_id"), 10, 64)
+	q.BeforeID, _ = strconv.ParseInt(values.Get("before"), 10, 64)
+	if from, err := time.Parse("2006-01-02", values.Get("from")); err == nil {
+		q.From = from
+	}
+	if to, err := time.Parse("2006-01-02", values.Get("to")); err == nil {
+		q.To = to.AddDate(0, 0, 1)
+	}
+	return q
+}
+
+func (page *Page) RenderAudit(w http.ResponseWriter, r *http.Request) {
+	q := parseAuditQuery(r.URL.Query())
+	q.Limit = auditPageSize
+	events, err := page.store.GetAllAuditEvent(r.Context(), q)
+	if err != nil {
+		page.internalError(w, r, err, "failed to get audit events")
+		return
+	}
+
+	// the filters without the page, for the next page and the export
+	filters := r.URL.Query()
+	filters.Del("before")
+	var nextURL string
+	if len(events) == auditPageSize {
+		next := r.URL.Query()
+		next.Set("before", strconv.FormatInt(events[len(events)-1].ID, 10))
+		nextURL = "/admin/audit?" + next.Encode()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("admin_audit.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile audit template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"EventList":       events,
+		"Kinds":           AuditKinds,
+		"TargetTypes": []string{
+			AuditTargetUser,
+			AuditTargetDocument,
+			AuditTargetSession,
+		},
+		"Filters":   filters,
+		"NextURL":   nextURL,
+		"ExportURL": "/admin/audit.csv?" + filters.Encode(),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ExportAudit streams the audit events matching the filters as CSV, all of
+// them rather than a page.
+func (page *Page) ExportAudit(w http.ResponseWriter, r *http.Request) {
+	q := parseAuditQuery(r.URL.Query())
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set(
+		"Content-Disposition",
+		`attachment; filename="lakehouse-audit.csv"`,
+	)
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{
+		"id",
+		"created_at",
+		"kind",
+		"actor_id",
+		"actor_username",
+		"target_type",
+		"target_id",
+		"ip",
+		"user_agent",
+		"before",
+		"after",
+	})
+	if err != nil {
+		page.internalError(w, r, err, "failed to write audit export")
+		return
+	}
+	err = page.store.EachAuditEvent(r.Context(), q, func(e *AuditEvent) error {
+		return cw.Write([]string{
+			strconv.FormatInt(e.ID, 10),
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			e.Kind,
+			csvInt(e.ActorID),
+			csvText(e.ActorUsername),
+			e.TargetType,
+			csvInt(e.TargetID),
+			e.IP,
+			csvText(e.UserAgent),
+			csvText(derefString(e.Before)),
+			csvText(derefString(e.After)),
+		})
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	// the response has started, so the export can only be cut short
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("failed to export audit events")
+	}
+}
+
+func csvInt(n *int64) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.FormatInt(*n, 10)
+}
+
+// csvText keeps text users control from being run as a formula by
+// spreadsheets that open the export.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
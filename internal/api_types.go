@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DocumentResponse is how the API shows a document.
+type DocumentResponse struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	IsTemplate bool `json:"is_template"`
+}
+
+// UserResponse is how the API shows a user. It never includes secrets.
+type UserResponse struct {
+	ID              int64     `json:"id"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email"`
+	DigestFrequency string    `json:"digest_frequency"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// NotificationResponse is how the API shows a notification.
+type NotificationResponse struct {
+	ID            int64      `json:"id"`
+	Kind          string     `json:"kind"`
+	DocumentID    int64      `json:"document_id"`
+	DocumentTitle string     `json:"document_title"`
+	ActorID       int64      `json:"actor_id"`
+	ActorUsername string     `json:"actor_username"`
+	ReadAt        *time.Time `json:"read_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func newDocumentResponse(d *Document) *DocumentResponse {
+	return &DocumentResponse{
+		ID:        d.ID,
+		Title:     d.Title,
+		Body:      d.Body,
+		Version:   d.Version,
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.UpdatedAt,
+
+		IsTemplate: d.IsTemplate,
+	}
+}
+
+func newUserResponse(u *User) *UserResponse {
+	return &UserResponse{
+		ID:              u.ID,
+		Username:        u.Username,
+		Email:           u.Email,
+		DigestFrequency: u.DigestFrequency,
+		CreatedAt:       u.CreatedAt,
+		UpdatedAt:       u.UpdatedAt,
+	}
+}
+
+func newNotificationResponse(n *Notification) *NotificationResponse {
+	return &NotificationResponse{
+		ID:            n.ID,
+		Kind:          n.Kind,
+		DocumentID:    n.DocumentID,
+		DocumentTitle: n.DocumentTitle,
+		ActorID:       n.ActorID,
+		ActorUsername: n.ActorUsername,
+		ReadAt:        n.ReadAt,
+		CreatedAt:     n.CreatedAt,
+	}
+}
+
+// apiResponse converts store models into their API response types. Every
+// handler response goes through it, so models are never serialized as is.
+func apiResponse(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *Document:
+		return newDocumentResponse(v)
+	case []*Document:
+		list := make([]*DocumentResponse, len(v))
+		for i, d := range v {
+			list[i] = newDocumentResponse(d)
+		}
+		return list
+	case *User:
+		return newUserResponse(v)
+	case *Notification:
+		return newNotificationResponse(v)
+	case []*Notification:
+		list := make([]*NotificationResponse, len(v))
+		for i, n := range v {
+			list[i] = newNotificationResponse(n)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// writeResource responds with the API response type of a model.
+func writeResource(w http.ResponseWriter, status int, v interface{}) {
+	writeJSON(w, status, apiResponse(v))
+}
+
+// selectDocumentFields returns the requested fields of a document, keyed the
+// same as in DocumentResponse.
+func selectDocumentFields(
+	doc *Document,
+	fields []string,
+) map[string]interface{} {
+	res := newDocumentResponse(doc)
+	m := map[string]interface{}{}
+	for _, f := range fields {
+		switch f {
+		case "id":
+			m[f] = res.ID
+		case "title":
+			m[f] = res.Title
+		case "body":
+			m[f] = res.Body
+		case "version":
+			m[f] = res.Version
+		case "created_at":
+			m[f] = res.CreatedAt
+		case "updated_at":
+			m[f] = res.UpdatedAt
+		case "is_template":
+			m[f] = res.IsTemplate
+		}
+	}
+	return m
+}
+
+// DeprecatedAPI marks responses of the unversioned /api/ routes as
+// deprecated and points to their /api/v1/ successor.
+func (api *API) DeprecatedAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := "/api/v1/" + strings.TrimPrefix(r.URL.Path, "/api/")
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		next.ServeHTTP(w, r)
+	})
+}
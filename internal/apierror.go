@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	CodeBadRequest           = "bad_request"
+	CodeInvalidJSON          = "invalid_json"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeInternal             = "internal_error"
+	CodeNotApplied           = "not_applied"
+)
+
+// APIError is the body of every error response of the API.
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// writeJSON responds with v encoded as indented JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	res, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(res)
+}
+
+// writeAPIError responds with an error in the shape
+// {"error": {"code": ..., "message": ..., "details": [...]}}.
+func writeAPIError(
+	w http.ResponseWriter,
+	status int,
+	code string,
+	message string,
+	details ...FieldError,
+) {
+	writeJSON(w, status, map[string]APIError{
+		"error": {
+			Code:    code,
+			Message: message,
+			Details: details,
+		},
+	})
+}
+
+// writeValidationError responds with 422 and one detail per invalid field.
+func writeValidationError(w http.ResponseWriter, v ValidationErrors) {
+	writeAPIError(
+		w,
+		http.StatusUnprocessableEntity,
+		CodeValidationFailed,
+		"request has invalid fields",
+		v...,
+	)
+}
+
+// writeJSONDecodeError responds to a request body that is not valid JSON
+// for the expected type.
+func writeJSONDecodeError(w http.ResponseWriter, err error) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		writeAPIError(
+			w,
+			http.StatusBadRequest,
+			CodeInvalidJSON,
+			"request body has a field of the wrong type",
+			FieldError{
+				Field:   typeErr.Field,
+				Message: "must be " + typeErr.Type.String(),
+			},
+		)
+		return
+	}
+	writeAPIError(
+		w,
+		http.StatusBadRequest,
+		CodeInvalidJSON,
+		"request body is not valid JSON",
+	)
+}
+
+// writeQueryError responds to invalid listing query parameters.
+func writeQueryError(w http.ResponseWriter, err error) {
+	field := strings.TrimPrefix(err.Error(), "invalid ")
+	writeAPIError(
+		w,
+		http.StatusBadRequest,
+		CodeBadRequest,
+		"invalid query parameter",
+		FieldError{Field: field, Message: err.Error()},
+	)
+}
+
+// internalError logs err and responds with a 500 that does not leak it.
+func (api *API) internalError(
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+	message string,
+) {
+	RequestLogger(r.Context(), api.logger).With(
+		zap.Error(err),
+	).Error(message)
+	writeAPIError(
+		w,
+		http.StatusInternalServerError,
+		CodeInternal,
+		"something went wrong",
+	)
+}
+
+// NotFoundHandler responds to unknown /api/ routes.
+func (api *API) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, CodeNotFound, "route not found")
+}
+
+// MethodNotAllowedHandler responds to known /api/ routes with the wrong
+// method.
+func (api *API) MethodNotAllowedHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeAPIError(
+		w,
+		http.StatusMethodNotAllowed,
+		CodeMethodNotAllowed,
+		"method not allowed",
+	)
+}
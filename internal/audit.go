@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	AuditLogin                = "login"
+	AuditLoginFailed          = "login.failed"
+	AuditLogout               = "logout"
+	AuditUserCreated          = "user.created"
+	AuditUserUpdated          = "user.updated"
+	AuditUserRoleChanged      = "user.role_changed"
+	AuditTokenCreated         = "token.created"
+	AuditTokensRevoked        = "token.revoked"
+	AuditDocumentCreated      = "document.created"
+	AuditDocumentUpdated      = "document.updated"
+	AuditDocumentDeleted      = "document.deleted"
+	AuditDocumentRestored     = "document.restored"
+	AuditDocumentPurged       = "document.purged"
+	AuditDocumentOwnerChanged = "document.owner_changed"
+)
+
+// AuditKinds are the kinds of audit events, in the order they are offered
+// as filters.
+var AuditKinds = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditLogout,
+	AuditTokenCreated,
+	AuditTokensRevoked,
+	AuditUserCreated,
+	AuditUserUpdated,
+	AuditUserRoleChanged,
+	AuditDocumentCreated,
+	AuditDocumentUpdated,
+	AuditDocumentDeleted,
+	AuditDocumentRestored,
+	AuditDocumentPurged,
+	AuditDocumentOwnerChanged,
+}
+
+const (
+	AuditTargetUser     = "user"
+	AuditTargetDocument = "document"
+	AuditTargetSession  = "session"
+)
+
+// ClientInfo is a middleware that puts the ip and user agent of the client
+// in the request context, for the audit log and login limits.
+func ClientInfo(trustProxy bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(
+				r.Context(),
+				KeyClientIP,
+				ClientIP(r, trustProxy),
+			)
+			ctx = context.WithValue(ctx, KeyUserAgent, r.UserAgent())
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// clientIPFromContext returns the ip of the client, or "" outside of a
+// request.
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(KeyClientIP).(string)
+	return ip
+}
+
+// recordAudit appends e to the audit log, with the user, ip and user agent
+// of the request in ctx unless e has an actor already. The change it
+// records is done, so a failure is logged rather than returned.
+func recordAudit(
+	ctx context.Context,
+	store Store,
+	logger *zap.Logger,
+	e *AuditEvent,
+) {
+	if e.ActorID == nil {
+		if userID := userIDFromContext(ctx); userID != 0 {
+			e.ActorID = &userID
+			e.ActorUsername = usernameFromContext(ctx)
+		}
+	}
+	e.IP = clientIPFromContext(ctx)
+	e.UserAgent, _ = ctx.Value(KeyUserAgent).(string)
+	e.CreatedAt = time.Now()
+	_, err := store.InsertAuditEvent(ctx, e)
+	if err != nil {
+		RequestLogger(ctx, logger).With(
+			zap.Error(err),
+			zap.String("kind", e.Kind),
+		).Error("failed to record audit event")
+	}
+}
+
+// auditSummary encodes the summary of a target as JSON, nil for none.
+func auditSummary(summary map[string]interface{}) *string {
+	if summary == nil {
+		return nil
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		panic(err)
+	}
+	s := string(b)
+	return &s
+}
+
+// userSummary is what the audit log keeps of a user, never the password.
+func userSummary(u *User) map[string]interface{} {
+	return map[string]interface{}{
+		"username":         u.Username,
+		"email":            u.Email,
+		"digest_frequency": u.DigestFrequency,
+		"is_admin":         u.IsAdmin,
+		"disabled":         u.DisabledAt != nil,
+		"password_reset":   u.PasswordResetRequired,
+	}
+}
+
+// documentSummary is what the audit log keeps of a document, the size of
+// its body rather than the body.
+func documentSummary(d *Document) map[string]interface{} {
+	return map[string]interface{}{
+		"title":       d.Title,
+		"version":     d.Version,
+		"body_length": len(d.Body),
+		"is_template": d.IsTemplate,
+		"deleted":     d.DeletedAt != nil,
+		"owner_id":    d.OwnerID,
+	}
+}
+
+// auditUser returns an audit event about the user with id, with its
+// summary before and after the change.
+func auditUser(kind string, id int64, before, after *User) *AuditEvent {
+	e := &AuditEvent{Kind: kind, TargetType: AuditTargetUser, TargetID: &id}
+	if before != nil {
+		e.Before = auditSummary(userSummary(before))
+	}
+	if after != nil {
+		e.After = auditSummary(userSummary(after))
+	}
+	return e
+}
+
+// auditDocument returns an audit event about the document with id, with
+// its summary before and after the change.
+func auditDocument(
+	kind string,
+	id int64,
+	before *Document,
+	after *Document,
+) *AuditEvent {
+	e := &AuditEvent{
+		Kind:       kind,
+		TargetType: AuditTargetDocument,
+		TargetID:   &id,
+	}
+	if before != nil {
+		e.Before = auditSummary(documentSummary(before))
+	}
+	if after != nil {
+		e.After = auditSummary(documentSummary(after))
+	}
+	return e
+}
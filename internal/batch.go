@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	MaxBatchOperations = 100
+
+	BatchAllOrNothing = "all_or_nothing"
+	BatchBestEffort   = "best_effort"
+
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// batchOperation is one create, update or delete of a document batch.
+type batchOperation struct {
+	Op      string  `json:"op"`
+	ID      int64   `json:"id"`
+	Title   *string `json:"title"`
+	Body    *string `json:"body"`
+	Version int64   `json:"version"`
+}
+
+// batchResult is the outcome of one operation, in the same shape as the
+// response of the single document endpoints.
+type batchResult struct {
+	Status   int               `json:"status"`
+	Document *DocumentResponse `json:"document,omitempty"`
+	Error    *APIError         `json:"error,omitempty"`
+
+	// saved is what recordDocumentSaved needs once the batch commits
+	saved   *Document
+	oldBody string
+	// audit is recorded once the batch commits
+	audit *AuditEvent
+}
+
+// batchError is an operation that failed, with the status and error its
+// result reports.
+type batchError struct {
+	status int
+	err    APIError
+}
+
+func (e *batchError) Error() string {
+	return e.err.Message
+}
+
+func newBatchError(status int, code string, message string) *batchError {
+	return &batchError{
+		status: status,
+		err:    APIError{Code: code, Message: message},
+	}
+}
+
+// BatchDocumentHandler runs a list of document operations in a single
+// transaction. In all_or_nothing mode, the default, the first failing
+// operation rolls back the whole batch. In best_effort mode failing
+// operations are skipped and the others are committed.
+func (api *API) BatchDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	type ReqBody struct {
+		Mode       string            `json:"mode"`
+		Operations []*batchOperation `json:"operations"`
+	}
+	var rb ReqBody
+	err := json.NewDecoder(r.Body).Decode(&rb)
+	if err != nil {
+		writeJSONDecodeError(w, err)
+		return
+	}
+	if rb.Mode == "" {
+		rb.Mode = BatchAllOrNothing
+	}
+
+	var v ValidationErrors
+	if rb.Mode != BatchAllOrNothing && rb.Mode != BatchBestEffort {
+		v.add("mode", "mode must be all_or_nothing or best_effort")
+	}
+	if len(rb.Operations) == 0 {
+		v.add("operations", "operations are required")
+	} else if len(rb.Operations) > MaxBatchOperations {
+		v.add("operations", fmt.Sprintf(
+			"batch can have at most %d operations",
+			MaxBatchOperations,
+		))
+	}
+	if len(v) > 0 {
+		writeValidationError(w, v)
+		return
+	}
+
+	tx, err := api.store.BeginDocumentTx(r.Context())
+	if err != nil {
+		api.internalError(w, r, err, "failed to begin batch")
+		return
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	results := make([]*batchResult, len(rb.Operations))
+	for i, op := range rb.Operations {
+		var res *batchResult
+		if rb.Mode == BatchBestEffort {
+			err = tx.InSavepoint(r.Context(), func() error {
+				var err error
+				res, err = api.runBatchOperation(r.Context(), tx, op)
+				return err
+			})
+		} else {
+			res, err = api.runBatchOperation(r.Context(), tx, op)
+		}
+
+		var opErr *batchError
+		if errors.As(err, &opErr) {
+			results[i] = &batchResult{Status: opErr.status, Error: &opErr.err}
+			if rb.Mode == BatchAllOrNothing {
+				api.abortBatch(w, results, i)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			api.internalError(w, r, err, "failed to run batch operation")
+			return
+		}
+		results[i] = res
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		api.internalError(w, r, err, "failed to commit batch")
+		return
+	}
+
+	// follows, events and notifications only for what was committed. The
+	// batch is applied by now, so failures are logged rather than returned.
+	logger := RequestLogger(r.Context(), api.logger)
+	userID := userIDFromContext(r.Context())
+	for i, res := range results {
+		if res.audit != nil {
+			recordAudit(r.Context(), api.store, api.logger, res.audit)
+		}
+		if res.saved == nil {
+			continue
+		}
+		created := rb.Operations[i].Op == BatchCreate
+		if created && userID != 0 {
+			err = api.store.InsertDocumentFollow(
+				r.Context(),
+				userID,
+				res.saved.ID,
+			)
+			if err != nil {
+				logger.With(
+					zap.Error(err),
+					zap.Int64("document_id", res.saved.ID),
+				).Error("failed to follow document")
+			}
+		}
+		err = recordDocumentSaved(
+			r.Context(),
+			api.store,
+			userID,
+			res.saved.ID,
+			created,
+			res.oldBody,
+			res.saved.Body,
+		)
+		if err != nil {
+			logger.With(
+				zap.Error(err),
+				zap.Int64("document_id", res.saved.ID),
+			).Error("failed to record document")
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results": results,
+	})
+}
+
+// abortBatch responds to an all_or_nothing batch whose operation at index
+// failed. Its status is that of the failed operation and every other
+// operation is reported as not applied.
+func (api *API) abortBatch(
+	w http.ResponseWriter,
+	results []*batchResult,
+	index int,
+) {
+	failed := results[index]
+	for i := range results {
+		if i == index {
+			continue
+		}
+		results[i] = &batchResult{
+			Status: http.StatusFailedDependency,
+			Error: &APIError{
+				Code:    CodeNotApplied,
+				Message: "batch was rolled back",
+			},
+		}
+	}
+	writeJSON(w, failed.Status, map[string]interface{}{
+		"error": APIError{
+			Code: failed.Error.Code,
+			Message: fmt.Sprintf(
+				"operation %d failed, no operations were applied",
+				index,
+			),
+		},
+		"results": results,
+	})
+}
+
+// runBatchOperation applies one operation in tx. Failures of the operation
+// itself are returned as a *batchError, anything else is an internal error.
+func (api *API) runBatchOperation(
+	ctx context.Context,
+	tx DocumentTx,
+	op *batchOperation,
+) (*batchResult, error) {
+	switch op.Op {
+	case BatchCreate:
+		return api.runBatchCreate(ctx, tx, op)
+	case BatchUpdate:
+		return api.runBatchUpdate(ctx, tx, op)
+	case BatchDelete:
+		if userIDFromContext(ctx) == 0 {
+			return nil, newBatchError(
+				http.StatusUnauthorized,
+				CodeUnauthorized,
+				"log in to delete documents",
+			)
+		}
+		err := tx.TrashDocument(ctx, op.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, newBatchError(
+				http.StatusNotFound,
+				CodeNotFound,
+				"document not found",
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &batchResult{
+			Status: http.StatusNoContent,
+			audit:  auditDocument(AuditDocumentDeleted, op.ID, nil, nil),
+		}, nil
+	default:
+		return nil, newBatchError(
+			http.StatusUnprocessableEntity,
+			CodeValidationFailed,
+			"op must be create, update or delete",
+		)
+	}
+}
+
+func (api *API) runBatchCreate(
+	ctx context.Context,
+	tx DocumentTx,
+	op *batchOperation,
+) (*batchResult, error) {
+	var title, body string
+	if op.Title != nil {
+		title = *op.Title
+	}
+	if op.Body != nil {
+		body = *op.Body
+	}
+	v := ValidateDocument(title, body)
+	if len(v) > 0 {
+		return nil, newBatchValidationError(v)
+	}
+
+	now := time.Now()
+	id, err := tx.InsertDocument(ctx, &Document{
+		Title:     title,
+		Body:      body,
+		CreatedAt: now,
+		UpdatedAt: now,
+		OwnerID:   ownerFromContext(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := tx.GetOneDocument(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &batchResult{
+		Status:   http.StatusCreated,
+		Document: newDocumentResponse(doc),
+		saved:    doc,
+		audit:    auditDocument(AuditDocumentCreated, id, nil, doc),
+	}, nil
+}
+
+func (api *API) runBatchUpdate(
+	ctx context.Context,
+	tx DocumentTx,
+	op *batchOperation,
+) (*batchResult, error) {
+	var v ValidationErrors
+	if op.Title != nil {
+		validateTitle(&v, *op.Title)
+	}
+	if op.Body != nil {
+		validateBody(&v, *op.Body)
+	}
+	if len(v) > 0 {
+		return nil, newBatchValidationError(v)
+	}
+	if op.Version == 0 {
+		return nil, newBatchError(
+			http.StatusPreconditionRequired,
+			CodePreconditionRequired,
+			"send the version to update",
+		)
+	}
+
+	doc, err := tx.GetOneDocument(ctx, op.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, newBatchError(
+			http.StatusNotFound,
+			CodeNotFound,
+			"document not found",
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	updated, err := tx.UpdateDocumentContent(
+		ctx,
+		op.ID,
+		op.Title,
+		op.Body,
+		nil,
+		op.Version,
+	)
+	if errors.Is(err, ErrVersionConflict) {
+		return nil, newBatchError(
+			http.StatusConflict,
+			CodeConflict,
+			"document has been changed since version "+
+				strconv.FormatInt(op.Version, 10),
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &batchResult{
+		Status:   http.StatusOK,
+		Document: newDocumentResponse(updated),
+		audit:    auditDocument(AuditDocumentUpdated, op.ID, doc, updated),
+	}
+	// saving the same content is not an edit
+	if updated.Version != doc.Version {
+		res.saved = updated
+		res.oldBody = doc.Body
+	}
+	return res, nil
+}
+
+func newBatchValidationError(v ValidationErrors) *batchError {
+	err := newBatchError(
+		http.StatusUnprocessableEntity,
+		CodeValidationFailed,
+		"operation has invalid fields",
+	)
+	err.err.Details = v
+	return err
+}
@@ -0,0 +1,754 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the server. It is read from defaults, then
+// a TOML or YAML file, then environment variables, then flags, each
+// overriding the ones before.
+type Config struct {
+	ListenAddr  string `toml:"listen_addr" yaml:"listen_addr"`
+	DatabaseURL string `toml:"database_url" yaml:"database_url"`
+	BaseURL     string `toml:"base_url" yaml:"base_url"`
+	// StaticDir is served under /static/ when set. In production a web
+	// server in front of lakehouse usually serves it instead.
+	StaticDir string `toml:"static_dir" yaml:"static_dir"`
+	// ReloadTemplates reads templates from internal/templates on every use
+	// instead of the ones built in, for development.
+	ReloadTemplates bool `toml:"reload_templates" yaml:"reload_templates"`
+	// TrashRetention is how long deleted documents stay in the trash.
+	TrashRetention time.Duration `toml:"trash_retention" yaml:"trash_retention"`
+	// TrustProxy takes the ip of clients from the X-Forwarded-For header
+	// set by a proxy in front of lakehouse. Without a proxy it lets clients
+	// pick their ip.
+	TrustProxy bool `toml:"trust_proxy" yaml:"trust_proxy"`
+
+	Timeouts TimeoutConfig `toml:"timeouts" yaml:"timeouts"`
+	Cookie   CookieConfig  `toml:"cookie" yaml:"cookie"`
+	Login    LoginConfig   `toml:"login" yaml:"login"`
+	Mail     MailConfig    `toml:"mail" yaml:"mail"`
+	Log      LogConfig     `toml:"log" yaml:"log"`
+	Features FeatureConfig `toml:"features" yaml:"features"`
+	Metrics  MetricsConfig `toml:"metrics" yaml:"metrics"`
+	Tracing  TracingConfig `toml:"tracing" yaml:"tracing"`
+}
+
+type TimeoutConfig struct {
+	Read  time.Duration `toml:"read" yaml:"read"`
+	Write time.Duration `toml:"write" yaml:"write"`
+	Idle  time.Duration `toml:"idle" yaml:"idle"`
+	// Shutdown is how long in-flight requests have to finish on shutdown.
+	// It should be shorter than the stop timeout of the systemd service.
+	Shutdown time.Duration `toml:"shutdown" yaml:"shutdown"`
+}
+
+// CookieConfig is the session cookie. A zero MaxAge makes it last until the
+// browser is closed.
+type CookieConfig struct {
+	Name     string        `toml:"name" yaml:"name"`
+	Secure   bool          `toml:"secure" yaml:"secure"`
+	SameSite string        `toml:"same_site" yaml:"same_site"`
+	MaxAge   time.Duration `toml:"max_age" yaml:"max_age"`
+}
+
+// LoginConfig limits failed logins. Limiter keeps the failures in memory,
+// or counts them in Postgres to share them between instances. An account
+// is locked for LockoutDuration after LockoutAfter failures, an ip after
+// five times as many.
+type LoginConfig struct {
+	Limiter         string        `toml:"limiter" yaml:"limiter"`
+	LockoutAfter    int           `toml:"lockout_after" yaml:"lockout_after"`
+	LockoutDuration time.Duration `toml:"lockout_duration" yaml:"lockout_duration"`
+}
+
+// MailConfig selects how digests are sent: written to files in Dir, or
+// through an smtp server.
+type MailConfig struct {
+	Mailer       string `toml:"mailer" yaml:"mailer"`
+	From         string `toml:"from" yaml:"from"`
+	Dir          string `toml:"dir" yaml:"dir"`
+	SMTPAddr     string `toml:"smtp_addr" yaml:"smtp_addr"`
+	SMTPUsername string `toml:"smtp_username" yaml:"smtp_username"`
+	SMTPPassword string `toml:"smtp_password" yaml:"smtp_password"`
+}
+
+// LogConfig is the format, json or console, and the minimum level of logs.
+type LogConfig struct {
+	Format string `toml:"format" yaml:"format"`
+	Level  string `toml:"level" yaml:"level"`
+}
+
+// FeatureConfig turns optional parts of the server on and off.
+type FeatureConfig struct {
+	GraphQL bool `toml:"graphql" yaml:"graphql"`
+	// DeprecatedAPI serves the API under /api/ as well as /api/v1/.
+	DeprecatedAPI bool `toml:"deprecated_api" yaml:"deprecated_api"`
+	Digests       bool `toml:"digests" yaml:"digests"`
+	TrashPurge    bool `toml:"trash_purge" yaml:"trash_purge"`
+}
+
+// MetricsConfig is the prometheus endpoint, off by default. It is served at
+// /metrics on its own ListenAddr if set, or else next to the pages behind
+// Token, which is then required.
+type MetricsConfig struct {
+	Enabled    bool   `toml:"enabled" yaml:"enabled"`
+	ListenAddr string `toml:"listen_addr" yaml:"listen_addr"`
+	Token      string `toml:"token" yaml:"token"`
+	// CollabStatsURL is the stats endpoint of the websocket server.
+	CollabStatsURL string `toml:"collab_stats_url" yaml:"collab_stats_url"`
+}
+
+// TracingConfig selects where OpenTelemetry spans go: nowhere, an OTLP
+// collector over HTTP, or stdout for local debugging. Endpoint is the
+// host:port of the collector, OTEL_EXPORTER_OTLP_ENDPOINT if empty.
+type TracingConfig struct {
+	Exporter string `toml:"exporter" yaml:"exporter"`
+	Endpoint string `toml:"endpoint" yaml:"endpoint"`
+	Insecure bool   `toml:"insecure" yaml:"insecure"`
+	// SampleRatio is the share of new traces recorded, traces started by a
+	// caller are recorded if the caller records them.
+	SampleRatio float64 `toml:"sample_ratio" yaml:"sample_ratio"`
+}
+
+const (
+	MailerFile = "file"
+	MailerSMTP = "smtp"
+)
+
+// DefaultConfig returns the configuration used for anything not set.
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:     ":8000",
+		BaseURL:        "http://127.0.0.1:8000",
+		TrashRetention: 30 * 24 * time.Hour,
+		Timeouts: TimeoutConfig{
+			Read:     5 * time.Second,
+			Write:    10 * time.Second,
+			Idle:     2 * time.Minute,
+			Shutdown: 10 * time.Second,
+		},
+		Cookie: CookieConfig{
+			Name:     "session",
+			SameSite: "lax",
+		},
+		Login: LoginConfig{
+			Limiter:         LoginLimiterMemory,
+			LockoutAfter:    10,
+			LockoutDuration: 15 * time.Minute,
+		},
+		Mail: MailConfig{
+			Mailer: MailerFile,
+			From:   "noreply@lakehousedocs.com",
+			Dir:    "./mail/",
+		},
+		Log: LogConfig{
+			Format: LogFormatJSON,
+			Level:  "info",
+		},
+		Features: FeatureConfig{
+			GraphQL:       true,
+			DeprecatedAPI: true,
+			Digests:       true,
+			TrashPurge:    true,
+		},
+		Metrics: MetricsConfig{
+			CollabStatsURL: "http://127.0.0.1:8001/stats",
+		},
+		Tracing: TracingConfig{
+			Exporter:    TraceExporterNone,
+			SampleRatio: 1,
+		},
+	}
+}
+
+// configSetting is a setting that can be set by an environment variable and
+// a flag. Secrets have a redact function to hide them when shown.
+type configSetting struct {
+	key    string
+	env    string
+	usage  string
+	redact func(string) string
+	field  func(c *Config) interface{}
+}
+
+var configSettings = []configSetting{
+	{
+		key:   "listen_addr",
+		env:   "LISTEN_ADDR",
+		usage: "address to listen on",
+		field: func(c *Config) interface{} { return &c.ListenAddr },
+	},
+	{
+		key:    "database_url",
+		env:    "DATABASE_URL",
+		usage:  "postgres connection url",
+		redact: redactURL,
+		field:  func(c *Config) interface{} { return &c.DatabaseURL },
+	},
+	{
+		key:   "base_url",
+		env:   "BASE_URL",
+		usage: "public url of the server, used in emails",
+		field: func(c *Config) interface{} { return &c.BaseURL },
+	},
+	{
+		key:   "static_dir",
+		env:   "STATIC_DIR",
+		usage: "directory served under /static/, if set",
+		field: func(c *Config) interface{} { return &c.StaticDir },
+	},
+	{
+		key:   "reload_templates",
+		env:   "RELOAD_TEMPLATES",
+		usage: "read templates from internal/templates on every use",
+		field: func(c *Config) interface{} { return &c.ReloadTemplates },
+	},
+	{
+		key:   "trash_retention",
+		env:   "TRASH_RETENTION",
+		usage: "how long deleted documents stay in the trash",
+		field: func(c *Config) interface{} { return &c.TrashRetention },
+	},
+	{
+		key:   "trust_proxy",
+		env:   "TRUST_PROXY",
+		usage: "take client ips from the X-Forwarded-For header",
+		field: func(c *Config) interface{} { return &c.TrustProxy },
+	},
+	{
+		key:   "timeouts.read",
+		env:   "READ_TIMEOUT",
+		usage: "timeout for reading a request",
+		field: func(c *Config) interface{} { return &c.Timeouts.Read },
+	},
+	{
+		key:   "timeouts.write",
+		env:   "WRITE_TIMEOUT",
+		usage: "timeout for writing a response",
+		field: func(c *Config) interface{} { return &c.Timeouts.Write },
+	},
+	{
+		key:   "timeouts.idle",
+		env:   "IDLE_TIMEOUT",
+		usage: "timeout for idle keep-alive connections",
+		field: func(c *Config) interface{} { return &c.Timeouts.Idle },
+	},
+	{
+		key:   "timeouts.shutdown",
+		env:   "SHUTDOWN_TIMEOUT",
+		usage: "how long in-flight requests have to finish on shutdown",
+		field: func(c *Config) interface{} { return &c.Timeouts.Shutdown },
+	},
+	{
+		key:   "cookie.name",
+		env:   "COOKIE_NAME",
+		usage: "name of the session cookie",
+		field: func(c *Config) interface{} { return &c.Cookie.Name },
+	},
+	{
+		key:   "cookie.secure",
+		env:   "COOKIE_SECURE",
+		usage: "send the session cookie over https only",
+		field: func(c *Config) interface{} { return &c.Cookie.Secure },
+	},
+	{
+		key:   "cookie.same_site",
+		env:   "COOKIE_SAME_SITE",
+		usage: "same site mode of the session cookie: lax, strict or none",
+		field: func(c *Config) interface{} { return &c.Cookie.SameSite },
+	},
+	{
+		key:   "cookie.max_age",
+		env:   "COOKIE_MAX_AGE",
+		usage: "lifetime of the session cookie, 0 until the browser closes",
+		field: func(c *Config) interface{} { return &c.Cookie.MaxAge },
+	},
+	{
+		key:   "login.limiter",
+		env:   "LOGIN_LIMITER",
+		usage: "where failed logins are counted: memory or postgres",
+		field: func(c *Config) interface{} { return &c.Login.Limiter },
+	},
+	{
+		key:   "login.lockout_after",
+		env:   "LOGIN_LOCKOUT_AFTER",
+		usage: "failed logins that lock an account",
+		field: func(c *Config) interface{} { return &c.Login.LockoutAfter },
+	},
+	{
+		key:   "login.lockout_duration",
+		env:   "LOGIN_LOCKOUT_DURATION",
+		usage: "how long a locked account stays locked",
+		field: func(c *Config) interface{} { return &c.Login.LockoutDuration },
+	},
+	{
+		key:   "mail.mailer",
+		env:   "MAILER",
+		usage: "how to send emails: file or smtp",
+		field: func(c *Config) interface{} { return &c.Mail.Mailer },
+	},
+	{
+		key:   "mail.from",
+		env:   "MAIL_FROM",
+		usage: "sender address of emails",
+		field: func(c *Config) interface{} { return &c.Mail.From },
+	},
+	{
+		key:   "mail.dir",
+		env:   "MAIL_DIR",
+		usage: "directory emails are written to by the file mailer",
+		field: func(c *Config) interface{} { return &c.Mail.Dir },
+	},
+	{
+		key:   "mail.smtp_addr",
+		env:   "SMTP_ADDR",
+		usage: "address of the smtp server",
+		field: func(c *Config) interface{} { return &c.Mail.SMTPAddr },
+	},
+	{
+		key:   "mail.smtp_username",
+		env:   "SMTP_USERNAME",
+		usage: "username for the smtp server",
+		field: func(c *Config) interface{} { return &c.Mail.SMTPUsername },
+	},
+	{
+		key:    "mail.smtp_password",
+		env:    "SMTP_PASSWORD",
+		usage:  "password for the smtp server",
+		redact: redactAll,
+		field:  func(c *Config) interface{} { return &c.Mail.SMTPPassword },
+	},
+	{
+		key:   "log.format",
+		env:   "LOG_FORMAT",
+		usage: "format of logs: json or console",
+		field: func(c *Config) interface{} { return &c.Log.Format },
+	},
+	{
+		key:   "log.level",
+		env:   "LOG_LEVEL",
+		usage: "minimum level of logs: debug, info, warn or error",
+		field: func(c *Config) interface{} { return &c.Log.Level },
+	},
+	{
+		key:   "features.graphql",
+		env:   "FEATURE_GRAPHQL",
+		usage: "serve the graphql endpoint",
+		field: func(c *Config) interface{} { return &c.Features.GraphQL },
+	},
+	{
+		key:   "features.deprecated_api",
+		env:   "FEATURE_DEPRECATED_API",
+		usage: "serve the api under /api/ as well as /api/v1/",
+		field: func(c *Config) interface{} { return &c.Features.DeprecatedAPI },
+	},
+	{
+		key:   "features.digests",
+		env:   "FEATURE_DIGESTS",
+		usage: "send email digests",
+		field: func(c *Config) interface{} { return &c.Features.Digests },
+	},
+	{
+		key:   "features.trash_purge",
+		env:   "FEATURE_TRASH_PURGE",
+		usage: "purge documents from the trash after the retention",
+		field: func(c *Config) interface{} { return &c.Features.TrashPurge },
+	},
+	{
+		key:   "metrics.enabled",
+		env:   "METRICS_ENABLED",
+		usage: "serve prometheus metrics at /metrics",
+		field: func(c *Config) interface{} { return &c.Metrics.Enabled },
+	},
+	{
+		key:   "metrics.listen_addr",
+		env:   "METRICS_LISTEN_ADDR",
+		usage: "separate address to serve metrics on, if set",
+		field: func(c *Config) interface{} { return &c.Metrics.ListenAddr },
+	},
+	{
+		key:    "metrics.token",
+		env:    "METRICS_TOKEN",
+		usage:  "bearer token required to read metrics, if set",
+		redact: redactAll,
+		field:  func(c *Config) interface{} { return &c.Metrics.Token },
+	},
+	{
+		key:   "metrics.collab_stats_url",
+		env:   "METRICS_COLLAB_STATS_URL",
+		usage: "stats url of the websocket server, if set",
+		field: func(c *Config) interface{} { return &c.Metrics.CollabStatsURL },
+	},
+	{
+		key:   "tracing.exporter",
+		env:   "TRACING_EXPORTER",
+		usage: "where to send traces: none, otlp or stdout",
+		field: func(c *Config) interface{} { return &c.Tracing.Exporter },
+	},
+	{
+		key:   "tracing.endpoint",
+		env:   "TRACING_ENDPOINT",
+		usage: "host:port of the otlp collector",
+		field: func(c *Config) interface{} { return &c.Tracing.Endpoint },
+	},
+	{
+		key:   "tracing.insecure",
+		env:   "TRACING_INSECURE",
+		usage: "send traces to the otlp collector over http",
+		field: func(c *Config) interface{} { return &c.Tracing.Insecure },
+	},
+	{
+		key:   "tracing.sample_ratio",
+		env:   "TRACING_SAMPLE_RATIO",
+		usage: "share of new traces recorded, from 0 to 1",
+		field: func(c *Config) interface{} { return &c.Tracing.SampleRatio },
+	},
+}
+
+// flagName returns the flag of a setting, its key with dashes.
+func (s configSetting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+// set parses value into the setting of c.
+func (s configSetting) set(c *Config, value string) error {
+	var err error
+	switch p := s.field(c).(type) {
+	case *string:
+		*p = value
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*p, err = time.ParseDuration(value)
+	case *float64:
+		*p, err = strconv.ParseFloat(value, 64)
+	case *int:
+		*p, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.key, err)
+	}
+	return nil
+}
+
+// configFlag keeps the value of a flag until it is applied after the file
+// and the environment.
+type configFlag struct {
+	key    string
+	flags  map[string]string
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	return ""
+}
+
+func (f *configFlag) Set(v string) error {
+	f.flags[f.key] = v
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// LoadConfig reads the configuration from the file given with -config or
+// the CONFIG environment variable, environment variables and flags in args.
+func LoadConfig(
+	args []string,
+	lookupEnv func(string) (string, bool),
+) (*Config, error) {
+	fs := flag.NewFlagSet("lakehouse", flag.ContinueOnError)
+	path, _ := lookupEnv("CONFIG")
+	fs.StringVar(&path, "config", path, "TOML or YAML configuration file")
+	flags := map[string]string{}
+	for _, s := range configSettings {
+		_, isBool := s.field(&Config{}).(*bool)
+		fs.Var(
+			&configFlag{key: s.key, flags: flags, isBool: isBool},
+			s.flagName(),
+			s.usage,
+		)
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	c := DefaultConfig()
+	if path != "" {
+		err = c.readFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// DEBUG=1 and TRASH_RETENTION_DAYS are the old ways of setting these
+	if v, _ := lookupEnv("DEBUG"); v == "1" {
+		c.StaticDir = "./static/"
+		c.ReloadTemplates = true
+		c.Log.Format = LogFormatConsole
+		c.Log.Level = "debug"
+	}
+	if v, ok := lookupEnv("TRASH_RETENTION_DAYS"); ok {
+		days, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("TRASH_RETENTION_DAYS: %w", err)
+		}
+		c.TrashRetention = time.Duration(days) * 24 * time.Hour
+	}
+	for _, s := range configSettings {
+		if v, ok := lookupEnv(s.env); ok {
+			err = s.set(c, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, s := range configSettings {
+		if v, ok := flags[s.key]; ok {
+			err = s.set(c, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// readFile reads a TOML or YAML file, by its extension, into c. Unknown keys
+// are an error so that typos do not go unnoticed.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown key %s", path, undecoded[0])
+		}
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%s: config file must be .toml, .yaml or .yml", path)
+	}
+	return nil
+}
+
+// Validate returns all the problems of the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen_addr: %w", err))
+	}
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("database_url: required"))
+	}
+	u, err := url.Parse(c.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, errors.New("base_url: must be an http(s) url"))
+	}
+	if c.StaticDir != "" {
+		info, err := os.Stat(c.StaticDir)
+		if err != nil || !info.IsDir() {
+			errs = append(errs, errors.New("static_dir: not a directory"))
+		}
+	}
+	if c.TrashRetention <= 0 {
+		errs = append(errs, errors.New("trash_retention: must be positive"))
+	}
+	if c.Timeouts.Read <= 0 || c.Timeouts.Write <= 0 ||
+		c.Timeouts.Idle <= 0 || c.Timeouts.Shutdown <= 0 {
+		errs = append(errs, errors.New("timeouts: must be positive"))
+	}
+	if c.Cookie.Name == "" {
+		errs = append(errs, errors.New("cookie.name: required"))
+	}
+	if c.Cookie.MaxAge < 0 {
+		errs = append(errs, errors.New("cookie.max_age: must not be negative"))
+	}
+	switch c.Cookie.SameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.Cookie.Secure {
+			errs = append(errs, errors.New(
+				"cookie.same_site: none needs cookie.secure",
+			))
+		}
+	default:
+		errs = append(errs, errors.New(
+			"cookie.same_site: must be lax, strict or none",
+		))
+	}
+	if c.Login.Limiter != LoginLimiterMemory &&
+		c.Login.Limiter != LoginLimiterPostgres {
+		errs = append(errs, errors.New(
+			"login.limiter: must be memory or postgres",
+		))
+	}
+	if c.Login.LockoutAfter <= loginFreeAttempts {
+		errs = append(errs, fmt.Errorf(
+			"login.lockout_after: must be more than %d",
+			loginFreeAttempts,
+		))
+	}
+	if c.Login.LockoutDuration <= 0 {
+		errs = append(errs, errors.New(
+			"login.lockout_duration: must be positive",
+		))
+	}
+	switch c.Mail.Mailer {
+	case MailerFile:
+		if c.Mail.Dir == "" {
+			errs = append(errs, errors.New("mail.dir: required"))
+		}
+	case MailerSMTP:
+		if c.Mail.SMTPAddr == "" {
+			errs = append(errs, errors.New("mail.smtp_addr: required"))
+		}
+	default:
+		errs = append(errs, errors.New("mail.mailer: must be file or smtp"))
+	}
+	if c.Mail.From == "" {
+		errs = append(errs, errors.New("mail.from: required"))
+	}
+	if c.Log.Format != LogFormatJSON && c.Log.Format != LogFormatConsole {
+		errs = append(errs, errors.New("log.format: must be json or console"))
+	}
+	if _, err := zap.ParseAtomicLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	switch c.Tracing.Exporter {
+	case TraceExporterNone, TraceExporterOTLP, TraceExporterStdout:
+	default:
+		errs = append(errs, errors.New(
+			"tracing.exporter: must be none, otlp or stdout",
+		))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, errors.New(
+			"tracing.sample_ratio: must be from 0 to 1",
+		))
+	}
+	if c.Metrics.ListenAddr != "" {
+		_, _, err := net.SplitHostPort(c.Metrics.ListenAddr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("metrics.listen_addr: %w", err))
+		}
+	} else if c.Metrics.Enabled && c.Metrics.Token == "" {
+		errs = append(errs, errors.New(
+			"metrics.token: required without metrics.listen_addr",
+		))
+	}
+	if c.Metrics.CollabStatsURL != "" {
+		u, err := url.Parse(c.Metrics.CollabStatsURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, errors.New(
+				"metrics.collab_stats_url: must be an http(s) url",
+			))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration without its secrets.
+func (c *Config) Redacted() *Config {
+	r := *c
+	for _, s := range configSettings {
+		if s.redact == nil {
+			continue
+		}
+		p := s.field(&r).(*string)
+		if *p != "" {
+			*p = s.redact(*p)
+		}
+	}
+	return &r
+}
+
+func redactAll(string) string {
+	return "xxxxx"
+}
+
+// redactURL keeps everything but the password of a url, or hides all of a
+// connection string that is not a url.
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return redactAll(v)
+	}
+	if _, ok := u.Query()["password"]; ok {
+		q := u.Query()
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+// WriteTOML writes the configuration as a TOML file.
+func (c *Config) WriteTOML(w io.Writer) error {
+	return toml.NewEncoder(w).Encode(c)
+}
+
+// sameSite returns the same site mode of the session cookie.
+func (c CookieConfig) sameSite() http.SameSite {
+	switch c.SameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// Session returns the session cookie holding token.
+func (c CookieConfig) Session(token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     c.Name,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(c.MaxAge.Seconds()),
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: c.sameSite(),
+	}
+}
+
+// ExpiredSession returns a session cookie that deletes the one the browser
+// has.
+func (c CookieConfig) ExpiredSession() *http.Cookie {
+	cookie := c.Session("")
+	cookie.MaxAge = -1
+	return cookie
+}
@@ -0,0 +1,513 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envOf returns a lookupEnv over env.
+func envOf(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+// writeConfigFile writes a configuration file named name and returns its
+// path.
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	toml := writeConfigFile(t, "lakehouse.toml", `
+listen_addr = ":7000"
+base_url = "https://file.example.com"
+
+[timeouts]
+read = "7s"
+
+[login]
+lockout_after = 6
+`)
+	yaml := writeConfigFile(t, "lakehouse.yaml", `
+listen_addr: ":7001"
+cookie:
+  name: yaml_session
+`)
+
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		check func(t *testing.T, c *Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, c *Config) {
+				if c.ListenAddr != ":8000" || c.Timeouts.Read != 5*time.Second ||
+					c.TrashRetention != 30*24*time.Hour || c.Metrics.Enabled {
+					t.Errorf("config = %+v", c)
+				}
+			},
+		},
+		{
+			name: "toml file over defaults",
+			args: []string{"-config", toml},
+			check: func(t *testing.T, c *Config) {
+				if c.ListenAddr != ":7000" ||
+					c.BaseURL != "https://file.example.com" ||
+					c.Timeouts.Read != 7*time.Second ||
+					c.Login.LockoutAfter != 6 {
+					t.Errorf("config = %+v", c)
+				}
+				// settings the file leaves out keep their defaults
+				if c.Timeouts.Write != 10*time.Second ||
+					c.Cookie.Name != "session" {
+					t.Errorf("defaults lost: %+v", c)
+				}
+			},
+		},
+		{
+			name: "yaml file from CONFIG",
+			env:  map[string]string{"CONFIG": yaml},
+			check: func(t *testing.T, c *Config) {
+				if c.ListenAddr != ":7001" || c.Cookie.Name != "yaml_session" {
+					t.Errorf("config = %+v", c)
+				}
+			},
+		},
+		{
+			name: "-config over CONFIG",
+			args: []string{"-config", toml},
+			env:  map[string]string{"CONFIG": yaml},
+			check: func(t *testing.T, c *Config) {
+				if c.ListenAddr != ":7000" {
+					t.Errorf("listen_addr = %q", c.ListenAddr)
+				}
+			},
+		},
+		{
+			name: "env over file",
+			args: []string{"-config", toml},
+			env: map[string]string{
+				"LISTEN_ADDR":  ":7100",
+				"READ_TIMEOUT": "9s",
+			},
+			check: func(t *testing.T, c *Config) {
+				if c.ListenAddr != ":7100" || c.Timeouts.Read != 9*time.Second {
+					t.Errorf("config = %+v", c)
+				}
+				if c.BaseURL != "https://file.example.com" {
+					t.Errorf("base_url = %q", c.BaseURL)
+				}
+			},
+		},
+		{
+			name: "flags over env",
+			args: []string{
+				"-config", toml,
+				"-listen-addr", ":7200",
+				"-cookie-secure",
+				"-tracing-sample-ratio", "0.5",
+			},
+			env: map[string]string{
+				"LISTEN_ADDR":   ":7100",
+				"COOKIE_SECURE": "false",
+			},
+			check: func(t *testing.T, c *Config) {
+				if c.ListenAddr != ":7200" || !c.Cookie.Secure ||
+					c.Tracing.SampleRatio != 0.5 {
+					t.Errorf("config = %+v", c)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := LoadConfig(tt.args, envOf(tt.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func TestLoadConfigLegacyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(t *testing.T, c *Config)
+	}{
+		{
+			name: "DEBUG",
+			env:  map[string]string{"DEBUG": "1"},
+			check: func(t *testing.T, c *Config) {
+				if c.StaticDir != "./static/" || !c.ReloadTemplates ||
+					c.Log.Format != LogFormatConsole || c.Log.Level != "debug" {
+					t.Errorf("config = %+v", c)
+				}
+			},
+		},
+		{
+			name: "DEBUG other than 1",
+			env:  map[string]string{"DEBUG": "0"},
+			check: func(t *testing.T, c *Config) {
+				if c.ReloadTemplates || c.StaticDir != "" {
+					t.Errorf("config = %+v", c)
+				}
+			},
+		},
+		{
+			name: "new settings over DEBUG",
+			env:  map[string]string{"DEBUG": "1", "LOG_LEVEL": "warn"},
+			check: func(t *testing.T, c *Config) {
+				if c.Log.Level != "warn" || !c.ReloadTemplates {
+					t.Errorf("config = %+v", c)
+				}
+			},
+		},
+		{
+			name: "TRASH_RETENTION_DAYS",
+			env:  map[string]string{"TRASH_RETENTION_DAYS": "7"},
+			check: func(t *testing.T, c *Config) {
+				if c.TrashRetention != 7*24*time.Hour {
+					t.Errorf("trash_retention = %v", c.TrashRetention)
+				}
+			},
+		},
+		{
+			name: "TRASH_RETENTION over TRASH_RETENTION_DAYS",
+			env: map[string]string{
+				"TRASH_RETENTION_DAYS": "7",
+				"TRASH_RETENTION":      "36h",
+			},
+			check: func(t *testing.T, c *Config) {
+				if c.TrashRetention != 36*time.Hour {
+					t.Errorf("trash_retention = %v", c.TrashRetention)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := LoadConfig(nil, envOf(tt.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "unknown toml key",
+			args: []string{"-config", writeConfigFile(
+				t, "typo.toml", "listen_adr = \":7000\"\n",
+			)},
+			want: "unknown key listen_adr",
+		},
+		{
+			name: "unknown yaml key",
+			args: []string{"-config", writeConfigFile(
+				t, "typo.yaml", "listen_adr: \":7000\"\n",
+			)},
+			want: "listen_adr",
+		},
+		{
+			name: "unknown file type",
+			args: []string{"-config", writeConfigFile(
+				t, "lakehouse.ini", "",
+			)},
+			want: "must be .toml, .yaml or .yml",
+		},
+		{
+			name: "missing file",
+			args: []string{"-config", "/nonexistent/lakehouse.toml"},
+			want: "no such file",
+		},
+		{
+			name: "bad legacy days",
+			env:  map[string]string{"TRASH_RETENTION_DAYS": "a week"},
+			want: "TRASH_RETENTION_DAYS",
+		},
+		{
+			name: "bad env duration",
+			env:  map[string]string{"READ_TIMEOUT": "5"},
+			want: "timeouts.read",
+		},
+		{
+			name: "bad flag bool",
+			args: []string{"-cookie-secure=maybe"},
+			want: "cookie.secure",
+		},
+		{
+			name: "unknown flag",
+			args: []string{"-listen", ":7000"},
+			want: "-listen",
+		},
+		{
+			name: "argument",
+			args: []string{"serve"},
+			want: `unexpected argument "serve"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(tt.args, envOf(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// validConfig returns the defaults with what they leave out set.
+func validConfig() *Config {
+	c := DefaultConfig()
+	c.DatabaseURL = "postgres://lakehouse@localhost/lakehouse"
+	return c
+}
+
+func TestConfigValidate(t *testing.T) {
+	err := validConfig().Validate()
+	if err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+	for _, metrics := range []MetricsConfig{
+		{Enabled: true, Token: "secret"},
+		{Enabled: true, ListenAddr: "127.0.0.1:9100"},
+	} {
+		c := validConfig()
+		c.Metrics = metrics
+		if err := c.Validate(); err != nil {
+			t.Errorf("metrics %+v: %v", metrics, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "listen address",
+			change: func(c *Config) { c.ListenAddr = "8000" },
+			want:   []string{"listen_addr:"},
+		},
+		{
+			name:   "database url",
+			change: func(c *Config) { c.DatabaseURL = "" },
+			want:   []string{"database_url: required"},
+		},
+		{
+			name:   "base url",
+			change: func(c *Config) { c.BaseURL = "example.com" },
+			want:   []string{"base_url: must be an http(s) url"},
+		},
+		{
+			name:   "static dir",
+			change: func(c *Config) { c.StaticDir = "/nonexistent" },
+			want:   []string{"static_dir: not a directory"},
+		},
+		{
+			name:   "trash retention",
+			change: func(c *Config) { c.TrashRetention = 0 },
+			want:   []string{"trash_retention: must be positive"},
+		},
+		{
+			name:   "timeouts",
+			change: func(c *Config) { c.Timeouts.Shutdown = -time.Second },
+			want:   []string{"timeouts: must be positive"},
+		},
+		{
+			name: "same site none without secure",
+			change: func(c *Config) {
+				c.Cookie.SameSite = "none"
+				c.Cookie.Secure = false
+			},
+			want: []string{"cookie.same_site: none needs cookie.secure"},
+		},
+		{
+			name:   "same site",
+			change: func(c *Config) { c.Cookie.SameSite = "loose" },
+			want:   []string{"cookie.same_site: must be lax, strict or none"},
+		},
+		{
+			name: "cookie",
+			change: func(c *Config) {
+				c.Cookie.Name = ""
+				c.Cookie.MaxAge = -time.Hour
+			},
+			want: []string{
+				"cookie.name: required",
+				"cookie.max_age: must not be negative",
+			},
+		},
+		{
+			name: "login",
+			change: func(c *Config) {
+				c.Login.Limiter = "redis"
+				c.Login.LockoutAfter = loginFreeAttempts
+				c.Login.LockoutDuration = 0
+			},
+			want: []string{
+				"login.limiter: must be memory or postgres",
+				"login.lockout_after: must be more than",
+				"login.lockout_duration: must be positive",
+			},
+		},
+		{
+			name: "smtp without address",
+			change: func(c *Config) {
+				c.Mail.Mailer = MailerSMTP
+				c.Mail.From = ""
+			},
+			want: []string{"mail.smtp_addr: required", "mail.from: required"},
+		},
+		{
+			name:   "mailer",
+			change: func(c *Config) { c.Mail.Mailer = "pigeon" },
+			want:   []string{"mail.mailer: must be file or smtp"},
+		},
+		{
+			name: "log",
+			change: func(c *Config) {
+				c.Log.Format = "xml"
+				c.Log.Level = "loud"
+			},
+			want: []string{
+				"log.format: must be json or console",
+				"log.level:",
+			},
+		},
+		{
+			name: "tracing",
+			change: func(c *Config) {
+				c.Tracing.Exporter = "jaeger"
+				c.Tracing.SampleRatio = 2
+			},
+			want: []string{
+				"tracing.exporter: must be none, otlp or stdout",
+				"tracing.sample_ratio: must be from 0 to 1",
+			},
+		},
+		{
+			name:   "metrics next to the pages without a token",
+			change: func(c *Config) { c.Metrics.Enabled = true },
+			want: []string{
+				"metrics.token: required without metrics.listen_addr",
+			},
+		},
+		{
+			name: "metrics",
+			change: func(c *Config) {
+				c.Metrics.ListenAddr = "9100"
+				c.Metrics.CollabStatsURL = "ftp://127.0.0.1/stats"
+			},
+			want: []string{
+				"metrics.listen_addr:",
+				"metrics.collab_stats_url: must be an http(s) url",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.change(c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatal("config is valid")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("err = %v, want %q", err, want)
+				}
+			}
+			if n := len(strings.Split(err.Error(), "\n")); n != len(tt.want) {
+				t.Errorf("%d errors, want %d: %v", n, len(tt.want), err)
+			}
+		})
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	tests := []struct {
+		name        string
+		databaseURL string
+		want        string
+	}{
+		{
+			name:        "url password",
+			databaseURL: "postgres://lakehouse:hunter2@db:5432/lakehouse",
+			want:        "postgres://lakehouse:xxxxx@db:5432/lakehouse",
+		},
+		{
+			name:        "password parameter",
+			databaseURL: "postgres://lakehouse@db/lakehouse?password=hunter2",
+			want:        "postgres://lakehouse@db/lakehouse?password=xxxxx",
+		},
+		{
+			name:        "without password",
+			databaseURL: "postgres://lakehouse@db/lakehouse?sslmode=disable",
+			want:        "postgres://lakehouse@db/lakehouse?sslmode=disable",
+		},
+		{
+			name:        "connection string",
+			databaseURL: "host=db user=lakehouse password=hunter2",
+			want:        "xxxxx",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			c.DatabaseURL = tt.databaseURL
+			c.Mail.SMTPPassword = "hunter2"
+			c.Metrics.Token = "hunter2"
+
+			r := c.Redacted()
+			if r.DatabaseURL != tt.want {
+				t.Errorf("database_url = %q, want %q", r.DatabaseURL, tt.want)
+			}
+			if r.Mail.SMTPPassword != "xxxxx" || r.Metrics.Token != "xxxxx" {
+				t.Errorf("secrets are shown: %+v %+v", r.Mail, r.Metrics)
+			}
+			var b strings.Builder
+			err := r.WriteTOML(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(b.String(), "hunter2") {
+				t.Errorf("redacted config has a secret:\n%s", b.String())
+			}
+			// the original is left alone
+			if c.DatabaseURL != tt.databaseURL ||
+				c.Mail.SMTPPassword != "hunter2" {
+				t.Errorf("original config changed: %+v", c)
+			}
+		})
+	}
+
+	// empty secrets stay empty, so it shows they are not set
+	r := validConfig().Redacted()
+	if r.Mail.SMTPPassword != "" || r.Metrics.Token != "" {
+		t.Errorf("unset secrets are shown as set: %+v %+v", r.Mail, r.Metrics)
+	}
+}
@@ -1,8 +1,50 @@
 package internal
 
+import "context"
+
 type ContextKey int
 
 const (
 	KeyUsername        ContextKey = iota
 	KeyIsAuthenticated ContextKey = iota
+	KeyUserID          ContextKey = iota
+	KeyUnreadCount     ContextKey = iota
+	KeyGraphQLLoaders  ContextKey = iota
+	KeyRequestID       ContextKey = iota
+	KeyLogger          ContextKey = iota
+	KeyCSRFToken       ContextKey = iota
+	KeyIsAdmin         ContextKey = iota
+	KeyClientIP        ContextKey = iota
+	KeyUserAgent       ContextKey = iota
+	KeyPasswordReset   ContextKey = iota
 )
+
+// usernameFromContext returns the authenticated user's username, or "" for
+// anonymous requests.
+func usernameFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(KeyUsername).(string)
+	return username
+}
+
+// userIDFromContext returns the authenticated user's id, or 0 for anonymous
+// requests.
+func userIDFromContext(ctx context.Context) int64 {
+	id, _ := ctx.Value(KeyUserID).(int64)
+	return id
+}
+
+// ownerFromContext returns the id of the authenticated user as the owner of
+// what they create, nil for anonymous requests.
+func ownerFromContext(ctx context.Context) *int64 {
+	id := userIDFromContext(ctx)
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// isAdminFromContext reports whether the authenticated user is an admin.
+func isAdminFromContext(ctx context.Context) bool {
+	isAdmin, _ := ctx.Value(KeyIsAdmin).(bool)
+	return isAdmin
+}
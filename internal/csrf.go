@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// CSRFField is the hidden form field that carries the CSRF token.
+	CSRFField = "csrf_token"
+	// CSRFHeader carries the CSRF token of requests made by scripts.
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// csrfMessage explains a rejected form to users, most likely a page opened
+// before logging in or out.
+const csrfMessage = "This form has expired or was not sent from this " +
+	"site. Go back, reload the page and try again."
+
+// SessionToken returns the session token of a request, from its bearer
+// token if it has one or else from the session cookie.
+func SessionToken(r *http.Request, cookieName string) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	c, err := r.Cookie(cookieName)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// bearerToken returns the token of an Authorization: Bearer header.
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// csrfToken derives the token forms carry from a secret only the browser
+// has, so that another site can neither read nor guess it.
+func csrfToken(secret string) string {
+	sum := sha256.Sum256([]byte("lakehouse csrf\x00" + secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// csrfTokenFromContext returns the CSRF token for the forms of a page.
+func csrfTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(KeyCSRFToken).(string)
+	return token
+}
+
+// preSessionCookie returns the cookie that holds the CSRF secret of a
+// browser without a session, so that the login and signup forms are
+// protected too.
+func (page *Page) preSessionCookie(secret string) *http.Cookie {
+	cookie := page.cookie.Session(secret)
+	cookie.Name = page.cookie.Name + "_csrf"
+	cookie.MaxAge = 0
+	return cookie
+}
+
+// CSRF is a middleware that checks the CSRF token of POST, PATCH, PUT and
+// DELETE requests authenticated by cookie. The token is derived from the
+// session, or from a pre-session cookie for anonymous users, and is put in
+// the request context for the forms of pages. Requests with a bearer token
+// are exempt since browsers never send one on their own, and so are API
+// requests without a session cookie.
+func (page *Page) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the secret is the session token once logged in
+		var secret string
+		session, err := r.Cookie(page.cookie.Name)
+		hasSession := err == nil
+		isAuthenticated, _ := r.Context().Value(KeyIsAuthenticated).(bool)
+		preSession, err := r.Cookie(page.preSessionCookie("").Name)
+		switch {
+		case isAuthenticated:
+			secret = session.Value
+		case err == nil:
+			secret = preSession.Value
+		case !isAPIRequest(r) && !strings.HasPrefix(r.URL.Path, "/static/"):
+			b := make([]byte, 32)
+			_, err := rand.Read(b)
+			if err != nil {
+				panic(err)
+			}
+			secret = base64.RawURLEncoding.EncodeToString(b)
+			http.SetCookie(w, page.preSessionCookie(secret))
+		}
+		want := csrfToken(secret)
+		ctx := context.WithValue(r.Context(), KeyCSRFToken, want)
+		r = r.WithContext(ctx)
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions,
+			http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isAPIRequest(r) && !hasSession {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		got := r.Header.Get(CSRFHeader)
+		if got == "" {
+			got = r.PostFormValue(CSRFField)
+		}
+		if secret == "" ||
+			subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			reason := "invalid csrf token"
+			if got == "" {
+				reason = "missing csrf token"
+			}
+			page.log(r).With(
+				zap.String("origin", r.Header.Get("Origin")),
+				zap.String("referer", r.Referer()),
+			).Warn(reason)
+			if isAPIRequest(r) {
+				writeAPIError(
+					w,
+					http.StatusForbidden,
+					CodeForbidden,
+					reason+": send it in the "+CSRFHeader+
+						" header, or authenticate with a bearer token",
+				)
+				return
+			}
+			page.renderErrorMessage(w, r, http.StatusForbidden, csrfMessage)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
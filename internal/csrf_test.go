@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newCSRFHandler returns the CSRF middleware around a handler that
+// responds with 200 and the token of the request context.
+func newCSRFHandler(t *testing.T) (*Page, http.Handler) {
+	t.Helper()
+	templates, err := NewTemplates(TemplateFS(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := DefaultConfig().Cookie
+	page := NewHandlerPage(nil, templates, cookie, nil, zap.NewNop())
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(csrfTokenFromContext(r.Context())))
+	})
+	return page, page.CSRF(next)
+}
+
+// formRequest returns a form POST to path with the given csrf token, and
+// without one if token is empty.
+func formRequest(path string, token string) *http.Request {
+	form := url.Values{"title": {"t"}}
+	if token != "" {
+		form.Set(CSRFField, token)
+	}
+	r := httptest.NewRequest(
+		http.MethodPost,
+		path,
+		strings.NewReader(form.Encode()),
+	)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// withSession marks r as logged in with the session token.
+func withSession(r *http.Request, cookieName string, token string) {
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: token})
+	*r = *r.WithContext(
+		context.WithValue(r.Context(), KeyIsAuthenticated, true),
+	)
+}
+
+func TestCSRF(t *testing.T) {
+	page, h := newCSRFHandler(t)
+	name := page.cookie.Name
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    int
+	}{
+		{
+			name: "bearer token",
+			request: func() *http.Request {
+				r := formRequest("/new/save", "")
+				r.Header.Set("Authorization", "Bearer abc")
+				return r
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "bearer token with a session cookie",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodDelete, "/api/v1/docs/1", nil)
+				withSession(r, name, "session")
+				r.Header.Set("Authorization", "Bearer abc")
+				return r
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "api without a session cookie",
+			request: func() *http.Request {
+				return httptest.NewRequest(
+					http.MethodPost,
+					"/api/v1/docs",
+					strings.NewReader(`{"title":"t"}`),
+				)
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "api with a session cookie and no token",
+			request: func() *http.Request {
+				r := httptest.NewRequest(
+					http.MethodPost,
+					"/api/v1/docs",
+					strings.NewReader(`{"title":"t"}`),
+				)
+				withSession(r, name, "session")
+				return r
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "api with a session cookie and the header",
+			request: func() *http.Request {
+				r := httptest.NewRequest(
+					http.MethodPost,
+					"/api/v1/docs",
+					strings.NewReader(`{"title":"t"}`),
+				)
+				withSession(r, name, "session")
+				r.Header.Set(CSRFHeader, csrfToken("session"))
+				return r
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "form without a token",
+			request: func() *http.Request {
+				r := formRequest("/new/save", "")
+				withSession(r, name, "session")
+				return r
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "form with a wrong token",
+			request: func() *http.Request {
+				r := formRequest("/new/save", csrfToken("other"))
+				withSession(r, name, "session")
+				return r
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "form with the token",
+			request: func() *http.Request {
+				r := formRequest("/new/save", csrfToken("session"))
+				withSession(r, name, "session")
+				return r
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "anonymous form without a pre-session cookie",
+			request: func() *http.Request {
+				return formRequest("/login", csrfToken(""))
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "anonymous form with a wrong token",
+			request: func() *http.Request {
+				r := formRequest("/login", csrfToken("other"))
+				r.AddCookie(page.preSessionCookie("pre"))
+				return r
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "get without a token",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				withSession(r, name, "session")
+				return r
+			},
+			want: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.request())
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestCSRFPreSession(t *testing.T) {
+	page, h := newCSRFHandler(t)
+
+	// the login page sets the pre-session cookie and puts its token in
+	// the form
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	var preSession *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == page.preSessionCookie("").Name {
+			preSession = c
+		}
+	}
+	if preSession == nil || preSession.Value == "" {
+		t.Fatalf("no pre-session cookie in %v", w.Result().Cookies())
+	}
+	token := w.Body.String()
+	if token != csrfToken(preSession.Value) {
+		t.Fatalf("token = %q, not derived from the cookie", token)
+	}
+
+	// the form posted back with both is accepted
+	r := formRequest("/login", token)
+	r.AddCookie(preSession)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("pre-session cookie set again: %v", w.Result().Cookies())
+	}
+
+	// another browser gets another secret
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if w.Body.String() == token {
+		t.Errorf("two browsers got the same token")
+	}
+
+	// api requests do not start a pre-session
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/docs", nil))
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("api request set %v", w.Result().Cookies())
+	}
+}
@@ -0,0 +1,757 @@
+// Package diagram draws graphviz dot graphs as SVG, for the dot code blocks
+// of documents.
+//
+// The layout is done here rather than by graphviz: the server is a single
+// static binary, and there is no pure Go library of the dot layout to use
+// instead, only bindings to the C library or to a WebAssembly build of it.
+// gonum parses the dot language. The layout is a plain layered one, ranking
+// nodes along the longest path, ordering ranks by the barycenter of their
+// neighbours, and bending edges that would overlap one another or cross a
+// node.
+package diagram
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gonum.org/v1/gonum/graph/formats/dot"
+	"gonum.org/v1/gonum/graph/formats/dot/ast"
+)
+
+const (
+	MaxNodes = 200
+	MaxEdges = 500
+
+	diagramNodeHeight = 36.0
+	diagramCharWidth  = 7.5
+	diagramNodeGap    = 24.0
+	diagramRankGap    = 48.0
+	diagramMargin     = 8.0
+	diagramArrowSize  = 8.0
+	// diagramEdgeSpread is how far apart the control points of curved
+	// edges are moved, between edges that join the same two nodes and on
+	// each try to get around a node.
+	diagramEdgeSpread = 32.0
+	// diagramEdgeClearance is the room kept between a curved edge and the
+	// nodes it goes around.
+	diagramEdgeClearance = 4.0
+	// diagramBendTries is how many times an edge is bent further before it
+	// is drawn across a node anyway.
+	diagramBendTries = 8
+	// diagramCurveSamples is how many points of a curve are checked
+	// against the nodes.
+	diagramCurveSamples = 16
+	// diagramLoopSize is how far the loop of an edge from a node to itself
+	// reaches out.
+	diagramLoopSize = 24.0
+	// diagramOrderPasses is how many times nodes are reordered within their
+	// rank to reduce edge crossings.
+	diagramOrderPasses = 4
+)
+
+var (
+	ErrEmpty    = errors.New("diagram has no graph")
+	ErrTooLarge = errors.New("diagram is too large")
+)
+
+type diagramNode struct {
+	label string
+	shape string
+	rank  int
+	order float64
+	// x and y are the center, w and h the size
+	x, y, w, h float64
+}
+
+type diagramEdge struct {
+	from  int
+	to    int
+	label string
+	// curved edges are drawn through the control point cx, cy
+	curved bool
+	cx, cy float64
+	// loop counts the edges from a node to itself, from 1
+	loop int
+}
+
+// diagram is a graph parsed from graphviz dot, laid out in ranks from top to
+// bottom, or from left to right with rankdir=LR. It supports the label and
+// shape of nodes and the label of edges.
+type diagram struct {
+	directed    bool
+	leftToRight bool
+	nodes       []*diagramNode
+	index       map[string]int
+	edges       []*diagramEdge
+	// seen collects the nodes of the subgraph being read, if any
+	seen map[int]bool
+}
+
+// Render lays out a graphviz dot graph and returns it as SVG.
+func Render(src string) (string, error) {
+	d, err := parseDiagram(src)
+	if err != nil {
+		return "", err
+	}
+	d.rank()
+	d.order()
+	width, height := d.place()
+	width = math.Max(width, d.route()+diagramMargin)
+	return d.svg(width, height), nil
+}
+
+// parseDiagram reads the first graph of a dot source.
+func parseDiagram(src string) (*diagram, error) {
+	f, err := dot.ParseString(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Graphs) == 0 {
+		return nil, ErrEmpty
+	}
+	g := f.Graphs[0]
+	d := &diagram{
+		directed: g.Directed,
+		index:    map[string]int{},
+	}
+	err = d.addStmts(g.Stmts, map[string]string{}, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	if len(d.nodes) == 0 {
+		return nil, ErrEmpty
+	}
+	return d, nil
+}
+
+func (d *diagram) addStmts(
+	stmts []ast.Stmt,
+	nodeAttrs map[string]string,
+	edgeAttrs map[string]string,
+) error {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.NodeStmt:
+			i := d.node(s.Node.ID, nodeAttrs)
+			setNodeAttrs(d.nodes[i], s.Attrs)
+		case *ast.EdgeStmt:
+			from, err := d.vertex(s.From, nodeAttrs, edgeAttrs)
+			if err != nil {
+				return err
+			}
+			label := edgeAttrs["label"]
+			for _, a := range s.Attrs {
+				if a.Key == "label" {
+					label = unquoteDOT(a.Val)
+				}
+			}
+			for e := s.To; e != nil; e = e.To {
+				to, err := d.vertex(e.Vertex, nodeAttrs, edgeAttrs)
+				if err != nil {
+					return err
+				}
+				for _, f := range from {
+					for _, t := range to {
+						d.edges = append(d.edges, &diagramEdge{
+							from:  f,
+							to:    t,
+							label: label,
+						})
+					}
+				}
+				from = to
+			}
+		case *ast.AttrStmt:
+			switch s.Kind {
+			case ast.GraphKind:
+				for _, a := range s.Attrs {
+					d.setGraphAttr(a)
+				}
+			case ast.NodeKind:
+				for _, a := range s.Attrs {
+					nodeAttrs[a.Key] = unquoteDOT(a.Val)
+				}
+			case ast.EdgeKind:
+				for _, a := range s.Attrs {
+					edgeAttrs[a.Key] = unquoteDOT(a.Val)
+				}
+			}
+		case *ast.Attr:
+			d.setGraphAttr(s)
+		case *ast.Subgraph:
+			_, err := d.vertex(s, nodeAttrs, edgeAttrs)
+			if err != nil {
+				return err
+			}
+		}
+		if len(d.nodes) > MaxNodes || len(d.edges) > MaxEdges {
+			return ErrTooLarge
+		}
+	}
+	return nil
+}
+
+// vertex returns the nodes an edge end refers to: a node, or all the nodes
+// of a subgraph. Attributes set in a subgraph only apply inside it.
+func (d *diagram) vertex(
+	v ast.Vertex,
+	nodeAttrs map[string]string,
+	edgeAttrs map[string]string,
+) ([]int, error) {
+	switch v := v.(type) {
+	case *ast.Node:
+		return []int{d.node(v.ID, nodeAttrs)}, nil
+	case *ast.Subgraph:
+		outer := d.seen
+		d.seen = map[int]bool{}
+		err := d.addStmts(v.Stmts, copyAttrs(nodeAttrs), copyAttrs(edgeAttrs))
+		inner := d.seen
+		d.seen = outer
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]int, 0, len(inner))
+		for i := range inner {
+			ids = append(ids, i)
+			if outer != nil {
+				outer[i] = true
+			}
+		}
+		sort.Ints(ids)
+		return ids, nil
+	}
+	return nil, nil
+}
+
+// node returns the index of a node, adding it with the current node
+// attributes the first time it is seen.
+func (d *diagram) node(id string, attrs map[string]string) int {
+	id = unquoteDOT(id)
+	i, ok := d.index[id]
+	if !ok {
+		n := &diagramNode{label: id, shape: "ellipse"}
+		if label, ok := attrs["label"]; ok {
+			n.label = label
+		}
+		if shape, ok := attrs["shape"]; ok {
+			n.shape = shape
+		}
+		i = len(d.nodes)
+		d.index[id] = i
+		d.nodes = append(d.nodes, n)
+	}
+	if d.seen != nil {
+		d.seen[i] = true
+	}
+	return i
+}
+
+func (d *diagram) setGraphAttr(a *ast.Attr) {
+	if a.Key == "rankdir" {
+		d.leftToRight = strings.EqualFold(unquoteDOT(a.Val), "LR")
+	}
+}
+
+func setNodeAttrs(n *diagramNode, attrs []*ast.Attr) {
+	for _, a := range attrs {
+		switch a.Key {
+		case "label":
+			n.label = unquoteDOT(a.Val)
+		case "shape":
+			n.shape = unquoteDOT(a.Val)
+		}
+	}
+}
+
+func copyAttrs(attrs map[string]string) map[string]string {
+	c := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		c[k] = v
+	}
+	return c
+}
+
+// unquoteDOT returns the text of a dot id, which may be quoted or an HTML
+// label. Line breaks in labels become spaces.
+func unquoteDOT(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = strings.NewReplacer(
+			`\"`, `"`,
+			`\n`, " ",
+			`\l`, " ",
+			`\r`, " ",
+		).Replace(s[1 : len(s)-1])
+	} else if len(s) >= 2 && s[0] == '<' && s[len(s)-1] == '>' {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+// rank puts every node one rank below the lowest of the nodes with an edge
+// to it. Edges that close a cycle are ignored.
+func (d *diagram) rank() {
+	out := make([][]int, len(d.nodes))
+	for _, e := range d.edges {
+		if e.from != e.to {
+			out[e.from] = append(out[e.from], e.to)
+		}
+	}
+
+	// depth first search, keeping the edges that are not back edges in
+	// reverse post order, which is a topological order
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(d.nodes))
+	forward := make([][]int, len(d.nodes))
+	var topo []int
+	var visit func(u int)
+	visit = func(u int) {
+		state[u] = visiting
+		for _, v := range out[u] {
+			if state[v] == visiting {
+				continue
+			}
+			forward[u] = append(forward[u], v)
+			if state[v] == unvisited {
+				visit(v)
+			}
+		}
+		state[u] = visited
+		topo = append(topo, u)
+	}
+	for u := range d.nodes {
+		if state[u] == unvisited {
+			visit(u)
+		}
+	}
+
+	for i := len(topo) - 1; i >= 0; i-- {
+		u := topo[i]
+		for _, v := range forward[u] {
+			if d.nodes[v].rank < d.nodes[u].rank+1 {
+				d.nodes[v].rank = d.nodes[u].rank + 1
+			}
+		}
+	}
+}
+
+// ranks returns the nodes of each rank, in their current order.
+func (d *diagram) ranks() [][]int {
+	var ranks [][]int
+	for i, n := range d.nodes {
+		for len(ranks) <= n.rank {
+			ranks = append(ranks, nil)
+		}
+		ranks[n.rank] = append(ranks[n.rank], i)
+	}
+	for _, r := range ranks {
+		sort.SliceStable(r, func(a, b int) bool {
+			return d.nodes[r[a]].order < d.nodes[r[b]].order
+		})
+	}
+	return ranks
+}
+
+// order moves every node towards the average position of its neighbours in
+// the ranks above, then in the ranks below, which removes most crossings.
+func (d *diagram) order() {
+	for i, n := range d.nodes {
+		n.order = float64(i)
+	}
+	neighbours := make([][]int, len(d.nodes))
+	for _, e := range d.edges {
+		neighbours[e.from] = append(neighbours[e.from], e.to)
+		neighbours[e.to] = append(neighbours[e.to], e.from)
+	}
+
+	ranks := d.ranks()
+	reorder := func(rank int, above bool) {
+		for _, i := range ranks[rank] {
+			sum, count := 0.0, 0
+			for _, j := range neighbours[i] {
+				r := d.nodes[j].rank
+				if (above && r < rank) || (!above && r > rank) {
+					sum += d.nodes[j].order
+					count++
+				}
+			}
+			if count > 0 {
+				d.nodes[i].order = sum / float64(count)
+			}
+		}
+		sort.SliceStable(ranks[rank], func(a, b int) bool {
+			return d.nodes[ranks[rank][a]].order <
+				d.nodes[ranks[rank][b]].order
+		})
+		for pos, i := range ranks[rank] {
+			d.nodes[i].order = float64(pos)
+		}
+	}
+	for pass := 0; pass < diagramOrderPasses; pass++ {
+		for r := 1; r < len(ranks); r++ {
+			reorder(r, true)
+		}
+		for r := len(ranks) - 2; r >= 0; r-- {
+			reorder(r, false)
+		}
+	}
+}
+
+// place sizes the nodes and sets their centers, each rank centered on the
+// widest one. It returns the size of the diagram.
+func (d *diagram) place() (float64, float64) {
+	for _, n := range d.nodes {
+		n.h = diagramNodeHeight
+		n.w = math.Max(
+			float64(utf8.RuneCountInString(n.label))*diagramCharWidth+24,
+			48,
+		)
+		if n.shape == "circle" || n.shape == "doublecircle" {
+			n.h = n.w
+		}
+	}
+
+	// across is the axis along a rank, along the axis between ranks
+	size := func(n *diagramNode) (across float64, along float64) {
+		if d.leftToRight {
+			return n.h, n.w
+		}
+		return n.w, n.h
+	}
+
+	ranks := d.ranks()
+	rankAcross := make([]float64, len(ranks))
+	rankAlong := make([]float64, len(ranks))
+	maxAcross := 0.0
+	for r, nodes := range ranks {
+		for i, n := range nodes {
+			across, along := size(d.nodes[n])
+			if i > 0 {
+				rankAcross[r] += diagramNodeGap
+			}
+			rankAcross[r] += across
+			rankAlong[r] = math.Max(rankAlong[r], along)
+		}
+		maxAcross = math.Max(maxAcross, rankAcross[r])
+	}
+
+	start := diagramMargin
+	for r, nodes := range ranks {
+		pos := diagramMargin + (maxAcross-rankAcross[r])/2
+		for _, i := range nodes {
+			n := d.nodes[i]
+			across, _ := size(n)
+			a, b := pos+across/2, start+rankAlong[r]/2
+			if d.leftToRight {
+				n.x, n.y = b, a
+			} else {
+				n.x, n.y = a, b
+			}
+			pos += across + diagramNodeGap
+		}
+		start += rankAlong[r] + diagramRankGap
+	}
+
+	totalAlong := start - diagramRankGap + diagramMargin
+	totalAcross := maxAcross + 2*diagramMargin
+	if d.leftToRight {
+		return totalAlong, totalAcross
+	}
+	return totalAcross, totalAlong
+}
+
+// route bends the edges that would overlap. Edges between the same two
+// nodes, like the two of a cycle a -> b -> a, curve away from each other,
+// and edges that would cross a node, like the one closing a cycle around a
+// chain, curve around it. Edges from a node to itself are drawn as loops on
+// its right, and route returns how far right they reach.
+func (d *diagram) route() float64 {
+	right := 0.0
+	loops := make([]int, len(d.nodes))
+	groups := map[[2]int][]*diagramEdge{}
+	var pairs [][2]int
+	for _, e := range d.edges {
+		if e.from == e.to {
+			loops[e.from]++
+			e.loop = loops[e.from]
+			_, x := d.nodes[e.from].loop(e.loop)
+			right = math.Max(right, x+diagramArrowSize+labelWidth(e.label))
+			continue
+		}
+		pair := [2]int{e.from, e.to}
+		if pair[0] > pair[1] {
+			pair[0], pair[1] = pair[1], pair[0]
+		}
+		if groups[pair] == nil {
+			pairs = append(pairs, pair)
+		}
+		groups[pair] = append(groups[pair], e)
+	}
+
+	for _, pair := range pairs {
+		a, b := d.nodes[pair[0]], d.nodes[pair[1]]
+		dx, dy := b.x-a.x, b.y-a.y
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			continue
+		}
+		// control points are moved along the normal of the line from the
+		// first node of the pair to the other, whichever way an edge goes
+		nx, ny := -dy/length, dx/length
+		mx, my := (a.x+b.x)/2, (a.y+b.y)/2
+		edges := groups[pair]
+		for i, e := range edges {
+			bend := (float64(i) - float64(len(edges)-1)/2) *
+				diagramEdgeSpread
+			step := diagramEdgeSpread
+			if bend < 0 {
+				step = -step
+			}
+			for try := 0; try < diagramBendTries; try++ {
+				if !d.crosses(e, mx+nx*bend, my+ny*bend) {
+					break
+				}
+				bend += step
+			}
+			e.curved = bend != 0
+			e.cx, e.cy = mx+nx*bend, my+ny*bend
+		}
+	}
+	return right
+}
+
+// crosses reports whether an edge drawn through the control point cx, cy
+// passes over a node other than its ends.
+func (d *diagram) crosses(e *diagramEdge, cx float64, cy float64) bool {
+	from, to := d.nodes[e.from], d.nodes[e.to]
+	for s := 1; s < diagramCurveSamples; s++ {
+		t := float64(s) / diagramCurveSamples
+		x := quadratic(from.x, cx, to.x, t)
+		y := quadratic(from.y, cy, to.y, t)
+		for i, n := range d.nodes {
+			if i == e.from || i == e.to {
+				continue
+			}
+			if math.Abs(x-n.x) < n.w/2+diagramEdgeClearance &&
+				math.Abs(y-n.y) < n.h/2+diagramEdgeClearance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// quadratic returns the point at t of a quadratic Bézier curve, along one
+// axis.
+func quadratic(p0 float64, c float64, p1 float64, t float64) float64 {
+	return (1-t)*(1-t)*p0 + 2*(1-t)*t*c + t*t*p1
+}
+
+// loop returns the cubic Bézier curve of the k-th loop of n, from the top
+// of its right side to the bottom, and the x of its rightmost point.
+func (n *diagramNode) loop(k int) (curve [4][2]float64, right float64) {
+	size := diagramLoopSize * float64(k)
+	x1, y1 := n.boundary(1, -0.5)
+	x2, y2 := n.boundary(1, 0.5)
+	curve = [4][2]float64{
+		{x1, y1},
+		{x1 + size, y1 - size/2},
+		{x2 + size, y2 + size/2},
+		{x2, y2},
+	}
+	return curve, x1 + size*3/4
+}
+
+// labelWidth is about how wide a label is drawn.
+func labelWidth(label string) float64 {
+	return float64(utf8.RuneCountInString(label)) * diagramCharWidth
+}
+
+// boundary returns the point where a line from the center of n in the
+// direction dx, dy leaves its shape.
+func (n *diagramNode) boundary(dx float64, dy float64) (float64, float64) {
+	hw, hh := n.w/2, n.h/2
+	var t float64
+	switch n.shape {
+	case "box", "rect", "rectangle", "square", "plaintext", "plain", "none":
+		t = math.Min(hw/math.Abs(dx), hh/math.Abs(dy))
+	case "diamond":
+		t = 1 / (math.Abs(dx)/hw + math.Abs(dy)/hh)
+	default:
+		t = 1 / math.Hypot(dx/hw, dy/hh)
+	}
+	return n.x + dx*t, n.y + dy*t
+}
+
+func (d *diagram) svg(width float64, height float64) string {
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		`<svg class="diagram" width="%s" height="%s" viewBox="0 0 %s %s">`,
+		svgNumber(width),
+		svgNumber(height),
+		svgNumber(width),
+		svgNumber(height),
+	)
+
+	b.WriteString(`<g class="diagram-edges">`)
+	for _, e := range d.edges {
+		d.writeSVGEdge(&b, e)
+	}
+	b.WriteString(`</g>`)
+
+	b.WriteString(`<g class="diagram-nodes">`)
+	for _, n := range d.nodes {
+		switch n.shape {
+		case "plaintext", "plain", "none":
+		case "box", "rect", "rectangle", "square":
+			fmt.Fprintf(
+				&b,
+				`<rect class="diagram-node" x="%s" y="%s" width="%s" height="%s"/>`,
+				svgNumber(n.x-n.w/2),
+				svgNumber(n.y-n.h/2),
+				svgNumber(n.w),
+				svgNumber(n.h),
+			)
+		case "diamond":
+			fmt.Fprintf(
+				&b,
+				`<polygon class="diagram-node" points="%s,%s %s,%s %s,%s %s,%s"/>`,
+				svgNumber(n.x),
+				svgNumber(n.y-n.h/2),
+				svgNumber(n.x+n.w/2),
+				svgNumber(n.y),
+				svgNumber(n.x),
+				svgNumber(n.y+n.h/2),
+				svgNumber(n.x-n.w/2),
+				svgNumber(n.y),
+			)
+		default:
+			fmt.Fprintf(
+				&b,
+				`<ellipse class="diagram-node" cx="%s" cy="%s" rx="%s" ry="%s"/>`,
+				svgNumber(n.x),
+				svgNumber(n.y),
+				svgNumber(n.w/2),
+				svgNumber(n.h/2),
+			)
+		}
+		writeSVGText(&b, "diagram-label", n.x, n.y, n.label)
+	}
+	b.WriteString(`</g></svg>`)
+	return b.String()
+}
+
+// writeSVGEdge writes an edge as a line, or a curve if it was bent or is a
+// loop, with an arrow at its end in a directed graph.
+func (d *diagram) writeSVGEdge(b *strings.Builder, e *diagramEdge) {
+	from, to := d.nodes[e.from], d.nodes[e.to]
+	var tipX, tipY, dirX, dirY, labelX, labelY float64
+	switch {
+	case e.loop > 0:
+		c, right := from.loop(e.loop)
+		fmt.Fprintf(
+			b,
+			`<path class="diagram-edge" d="M %s,%s C %s,%s %s,%s %s,%s"/>`,
+			svgNumber(c[0][0]),
+			svgNumber(c[0][1]),
+			svgNumber(c[1][0]),
+			svgNumber(c[1][1]),
+			svgNumber(c[2][0]),
+			svgNumber(c[2][1]),
+			svgNumber(c[3][0]),
+			svgNumber(c[3][1]),
+		)
+		tipX, tipY = c[3][0], c[3][1]
+		dirX, dirY = c[3][0]-c[2][0], c[3][1]-c[2][1]
+		labelX = right + diagramArrowSize + labelWidth(e.label)/2
+		labelY = from.y
+	case e.curved:
+		x1, y1 := from.boundary(e.cx-from.x, e.cy-from.y)
+		x2, y2 := to.boundary(e.cx-to.x, e.cy-to.y)
+		fmt.Fprintf(
+			b,
+			`<path class="diagram-edge" d="M %s,%s Q %s,%s %s,%s"/>`,
+			svgNumber(x1),
+			svgNumber(y1),
+			svgNumber(e.cx),
+			svgNumber(e.cy),
+			svgNumber(x2),
+			svgNumber(y2),
+		)
+		tipX, tipY = x2, y2
+		dirX, dirY = x2-e.cx, y2-e.cy
+		labelX = quadratic(x1, e.cx, x2, 0.5)
+		labelY = quadratic(y1, e.cy, y2, 0.5)
+	default:
+		dx, dy := to.x-from.x, to.y-from.y
+		if dx == 0 && dy == 0 {
+			return
+		}
+		x1, y1 := from.boundary(dx, dy)
+		x2, y2 := to.boundary(-dx, -dy)
+		fmt.Fprintf(
+			b,
+			`<line class="diagram-edge" x1="%s" y1="%s" x2="%s" y2="%s"/>`,
+			svgNumber(x1),
+			svgNumber(y1),
+			svgNumber(x2),
+			svgNumber(y2),
+		)
+		tipX, tipY = x2, y2
+		dirX, dirY = dx, dy
+		labelX, labelY = (x1+x2)/2, (y1+y2)/2
+	}
+
+	if d.directed {
+		// a triangle with its tip on the target
+		length := math.Hypot(dirX, dirY)
+		ux, uy := dirX/length, dirY/length
+		bx, by := tipX-ux*diagramArrowSize, tipY-uy*diagramArrowSize
+		px, py := -uy*diagramArrowSize/2, ux*diagramArrowSize/2
+		fmt.Fprintf(
+			b,
+			`<polygon class="diagram-arrow" points="%s,%s %s,%s %s,%s"/>`,
+			svgNumber(tipX),
+			svgNumber(tipY),
+			svgNumber(bx+px),
+			svgNumber(by+py),
+			svgNumber(bx-px),
+			svgNumber(by-py),
+		)
+	}
+	if e.label != "" {
+		writeSVGText(b, "diagram-edge-label", labelX, labelY, e.label)
+	}
+}
+
+// writeSVGText writes a line of text centered on x, y.
+func writeSVGText(
+	b *strings.Builder,
+	class string,
+	x float64,
+	y float64,
+	text string,
+) {
+	fmt.Fprintf(
+		b,
+		`<text class="%s" x="%s" y="%s" text-anchor="middle">%s</text>`,
+		class,
+		svgNumber(x),
+		svgNumber(y+4.5),
+		html.EscapeString(text),
+	)
+}
+
+func svgNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
@@ -0,0 +1,273 @@
+package diagram
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// layoutDiagram parses and lays out a dot source like Render.
+func layoutDiagram(t *testing.T, src string) *diagram {
+	t.Helper()
+	d, err := parseDiagram(src)
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	d.rank()
+	d.order()
+	d.place()
+	d.route()
+	return d
+}
+
+func (d *diagram) rankOf(id string) int {
+	return d.nodes[d.index[id]].rank
+}
+
+func TestDiagramRanks(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		ranks map[string]int
+	}{
+		{
+			name:  "chain",
+			src:   `digraph { a -> b -> c }`,
+			ranks: map[string]int{"a": 0, "b": 1, "c": 2},
+		},
+		{
+			name:  "longest path wins",
+			src:   `digraph { a -> b -> c; a -> c }`,
+			ranks: map[string]int{"a": 0, "b": 1, "c": 2},
+		},
+		{
+			name:  "diamond",
+			src:   `digraph { a -> {b c}; {b c} -> d }`,
+			ranks: map[string]int{"a": 0, "b": 1, "c": 1, "d": 2},
+		},
+		{
+			name:  "unconnected nodes",
+			src:   `digraph { a; b; c -> d }`,
+			ranks: map[string]int{"a": 0, "b": 0, "c": 0, "d": 1},
+		},
+		{
+			name:  "cycle",
+			src:   `digraph { a -> b -> c -> a }`,
+			ranks: map[string]int{"a": 0, "b": 1, "c": 2},
+		},
+		{
+			name:  "two cycle",
+			src:   `digraph { a -> b -> a }`,
+			ranks: map[string]int{"a": 0, "b": 1},
+		},
+		{
+			name:  "self loop",
+			src:   `digraph { a -> a; a -> b }`,
+			ranks: map[string]int{"a": 0, "b": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := layoutDiagram(t, tt.src)
+			for id, want := range tt.ranks {
+				if got := d.rankOf(id); got != want {
+					t.Errorf("rank of %s = %d, want %d", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagramLeftToRight(t *testing.T) {
+	d := layoutDiagram(t, `digraph { rankdir=LR; a -> b }`)
+	a, b := d.nodes[d.index["a"]], d.nodes[d.index["b"]]
+	if a.y != b.y || a.x >= b.x {
+		t.Fatalf("a at %v,%v and b at %v,%v, want b right of a",
+			a.x, a.y, b.x, b.y)
+	}
+}
+
+func TestDiagramCycleEdgesDoNotOverlap(t *testing.T) {
+	t.Run("two cycle", func(t *testing.T) {
+		d := layoutDiagram(t, `digraph { a -> b -> a }`)
+		ab, ba := d.edges[0], d.edges[1]
+		if !ab.curved || !ba.curved {
+			t.Fatalf("edges of a two cycle are straight")
+		}
+		if ab.cx == ba.cx && ab.cy == ba.cy {
+			t.Fatalf("both edges curve through %v,%v", ab.cx, ab.cy)
+		}
+	})
+
+	t.Run("edge closing a cycle around a chain", func(t *testing.T) {
+		d := layoutDiagram(t, `digraph { a -> b -> c -> a }`)
+		for _, e := range d.edges {
+			from := d.nodes[e.from]
+			to := d.nodes[e.to]
+			cx, cy := (from.x+to.x)/2, (from.y+to.y)/2
+			if e.curved {
+				cx, cy = e.cx, e.cy
+			}
+			if d.crosses(e, cx, cy) {
+				t.Errorf("edge %d -> %d crosses a node", e.from, e.to)
+			}
+		}
+		ca := d.edges[2]
+		if !ca.curved {
+			t.Fatalf("edge c -> a is drawn straight through b")
+		}
+	})
+
+	t.Run("parallel edges", func(t *testing.T) {
+		d := layoutDiagram(t, `digraph { a -> b; a -> b; a -> b }`)
+		seen := map[[2]float64]bool{}
+		for _, e := range d.edges {
+			seen[[2]float64{e.cx, e.cy}] = true
+		}
+		if len(seen) != 3 {
+			t.Fatalf("%d distinct curves for 3 edges", len(seen))
+		}
+	})
+
+	t.Run("self loops", func(t *testing.T) {
+		svg, err := Render(`digraph { a -> a; a -> a }`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(svg, `<path class="diagram-edge"`); n != 2 {
+			t.Fatalf("%d loops drawn, want 2:\n%s", n, svg)
+		}
+		if n := strings.Count(svg, `class="diagram-arrow"`); n != 2 {
+			t.Fatalf("%d arrows drawn, want 2", n)
+		}
+	})
+}
+
+func TestDiagramLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "node id",
+			src:  `digraph { start }`,
+			want: []string{`>start</text>`},
+		},
+		{
+			name: "node label",
+			src:  `digraph { a [label="first step"] }`,
+			want: []string{`>first step</text>`},
+		},
+		{
+			name: "default node attributes",
+			src:  `digraph { node [shape=box label="x"]; a }`,
+			want: []string{`<rect class="diagram-node"`, `>x</text>`},
+		},
+		{
+			name: "line breaks",
+			src:  `digraph { a [label="one\ntwo"] }`,
+			want: []string{`>one two</text>`},
+		},
+		{
+			name: "html label",
+			src:  `digraph { a [label=<bold>] }`,
+			want: []string{`>bold</text>`},
+		},
+		{
+			name: "edge label",
+			src:  `digraph { a -> b [label="next"] }`,
+			want: []string{`class="diagram-edge-label"`, `>next</text>`},
+		},
+		{
+			name: "default edge attributes",
+			src:  `digraph { edge [label="e"]; a -> b }`,
+			want: []string{`>e</text>`},
+		},
+		{
+			name: "loop label",
+			src:  `digraph { a -> a [label="again"] }`,
+			want: []string{`>again</text>`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svg, err := Render(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(svg, want) {
+					t.Errorf("svg has no %s:\n%s", want, svg)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagramArrows(t *testing.T) {
+	svg, err := Render(`graph { a -- b }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(svg, "diagram-arrow") {
+		t.Errorf("undirected graph has arrows:\n%s", svg)
+	}
+	svg, err = Render(`digraph { a -> b }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(svg, "diagram-arrow") {
+		t.Errorf("directed graph has no arrows:\n%s", svg)
+	}
+}
+
+func TestDiagramEscapesLabels(t *testing.T) {
+	src := `digraph {
+		a [label="<script>alert(1)</script> & \"q\""]
+		a -> b [label="<b>"]
+	}`
+	svg, err := Render(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(svg, "<script>") || strings.Contains(svg, "<b>") {
+		t.Fatalf("label is not escaped:\n%s", svg)
+	}
+	for _, want := range []string{
+		`&lt;script&gt;alert(1)&lt;/script&gt; &amp; &#34;q&#34;`,
+		`&lt;b&gt;`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("svg has no %s:\n%s", want, svg)
+		}
+	}
+}
+
+func TestDiagramErrors(t *testing.T) {
+	var big strings.Builder
+	big.WriteString("digraph {")
+	for i := 0; i <= MaxNodes; i++ {
+		big.WriteString(" n")
+		big.WriteString(strings.Repeat("x", i))
+		big.WriteString(";")
+	}
+	big.WriteString("}")
+
+	tests := []struct {
+		src  string
+		want error
+	}{
+		{`digraph {}`, ErrEmpty},
+		{big.String(), ErrTooLarge},
+	}
+	for _, tt := range tests {
+		_, err := Render(tt.src)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%.20q: err = %v, want %v", tt.src, err, tt.want)
+		}
+	}
+	if _, err := Render(`digraph { a -> }`); err == nil {
+		t.Errorf("invalid dot rendered")
+	}
+}
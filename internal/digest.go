@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+const (
+	DocumentEventCreated = "created"
+	DocumentEventEdited  = "edited"
+)
+
+// digestPeriod returns how often a digest is sent for a frequency, or 0 if
+// the frequency is not valid or turned off.
+func digestPeriod(frequency string) time.Duration {
+	switch frequency {
+	case DigestDaily:
+		return 24 * time.Hour
+	case DigestWeekly:
+		return 7 * 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// digestDocument groups the events of one document within a digest.
+type digestDocument struct {
+	Title   string
+	URL     string
+	Created bool
+	Edits   int
+	Editors []string
+}
+
+// Digester periodically emails users a summary of activity on the documents
+// they follow: which were created and which edited, by whom. Following
+// folders and reporting new comments wait on folders and comments.
+type Digester struct {
+	store     *SQLStore
+	mailer    Mailer
+	templates *Templates
+	baseURL   string
+	logger    *zap.Logger
+}
+
+func NewDigester(
+	store *SQLStore,
+	mailer Mailer,
+	templates *Templates,
+	baseURL string,
+	logger *zap.Logger,
+) *Digester {
+	return &Digester{
+		store:     store,
+		mailer:    mailer,
+		templates: templates,
+		baseURL:   baseURL,
+		logger:    logger,
+	}
+}
+
+// Run sends due digests every interval until ctx is done.
+func (d *Digester) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := d.SendDue(ctx, time.Now())
+		if err != nil {
+			d.logger.With(
+				zap.Error(err),
+			).Error("failed to send digests")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendDue sends a digest to every user whose digest period has elapsed.
+// Users with no activity in their period get no email.
+func (d *Digester) SendDue(ctx context.Context, now time.Time) error {
+	users, err := d.store.GetAllUserWithDigest(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, user := range users {
+		period := digestPeriod(user.DigestFrequency)
+		if period == 0 {
+			continue
+		}
+		since := now.Add(-period)
+		if user.DigestSentAt != nil {
+			if now.Sub(*user.DigestSentAt) < period {
+				continue
+			}
+			since = *user.DigestSentAt
+		}
+
+		err = d.send(ctx, user, since)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %d digest: %w", user.ID, err))
+			continue
+		}
+		err = d.store.UpdateUserDigestSentAt(ctx, user.ID, now)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Digester) send(
+	ctx context.Context,
+	user *User,
+	since time.Time,
+) error {
+	events, err := d.store.GetDigestEvents(ctx, user.ID, since)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	// group events by document, in order of first activity
+	var documents []*digestDocument
+	byID := map[int64]*digestDocument{}
+	for _, e := range events {
+		doc, ok := byID[e.DocumentID]
+		if !ok {
+			doc = &digestDocument{
+				Title: e.DocumentTitle,
+				URL:   d.baseURL + "/docs/" + strconv.FormatInt(e.DocumentID, 10),
+			}
+			byID[e.DocumentID] = doc
+			documents = append(documents, doc)
+		}
+		switch e.Kind {
+		case DocumentEventCreated:
+			doc.Created = true
+		case DocumentEventEdited:
+			doc.Edits++
+		}
+		if e.ActorUsername != "" && !containsString(doc.Editors, e.ActorUsername) {
+			doc.Editors = append(doc.Editors, e.ActorUsername)
+		}
+	}
+
+	data := map[string]interface{}{
+		"Username":  user.Username,
+		"Frequency": user.DigestFrequency,
+		"Since":     since,
+		"Documents": documents,
+		"BaseURL":   d.baseURL,
+	}
+
+	var htmlBody bytes.Buffer
+	t, err := d.templates.HTML("email/digest.html")
+	if err != nil {
+		return err
+	}
+	err = t.Execute(&htmlBody, data)
+	if err != nil {
+		return err
+	}
+
+	var textBody bytes.Buffer
+	tt, err := d.templates.Text("email/digest.txt")
+	if err != nil {
+		return err
+	}
+	err = tt.Execute(&textBody, data)
+	if err != nil {
+		return err
+	}
+
+	return d.mailer.Send(ctx, &Message{
+		To:       user.Email,
+		Subject:  "lakehouse " + user.DigestFrequency + " digest",
+		TextBody: textBody.String(),
+		HTMLBody: htmlBody.String(),
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
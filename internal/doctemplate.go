@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+)
+
+// ErrTemplateNotFound is returned when a document is created from an id that
+// is not a template.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// placeholderRegexp matches placeholders like {{date}} or {{ author }}.
+var placeholderRegexp = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// ExpandPlaceholders replaces the {{name}} placeholders of text with their
+// value in vars. Unknown placeholders are left as they are.
+func ExpandPlaceholders(text string, vars map[string]string) string {
+	return placeholderRegexp.ReplaceAllStringFunc(text, func(m string) string {
+		name := placeholderRegexp.FindStringSubmatch(m)[1]
+		value, ok := vars[name]
+		if !ok {
+			return m
+		}
+		return value
+	})
+}
+
+// getTemplate returns the template document with id.
+func getTemplate(
+	ctx context.Context,
+	store Store,
+	id int64,
+) (*Document, error) {
+	doc, err := store.GetOneDocument(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !doc.IsTemplate) {
+		return nil, ErrTemplateNotFound
+	}
+	return doc, err
+}
+
+// fromTemplate returns the title and body of a document created from tmpl.
+// Empty fields default to the template's. Then {{date}}, {{author}} and
+// {{title}} are expanded, {{title}} being the expanded title.
+func fromTemplate(
+	tmpl *Document,
+	title string,
+	body string,
+	author string,
+	now time.Time,
+) (string, string) {
+	if title == "" {
+		title = tmpl.Title
+	}
+	if body == "" {
+		body = tmpl.Body
+	}
+	vars := map[string]string{
+		"date":   now.Format("2006-01-02"),
+		"author": author,
+		"title":  "",
+	}
+	title = ExpandPlaceholders(title, vars)
+	vars["title"] = title
+	return title, ExpandPlaceholders(body, vars)
+}
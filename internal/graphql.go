@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"go.uber.org/zap"
+)
+
+const (
+	// MaxQueryDepth is how deeply fields can be nested in a query.
+	MaxQueryDepth = 10
+	// MaxQueryComplexity bounds the number of fields a query can resolve,
+	// counting list fields once per item they may return.
+	MaxQueryComplexity = 5000
+)
+
+// listFieldSize is the number of items of a list field, for the complexity
+// of a query: expected without a limit argument, and at most max with one.
+type listFieldSize struct {
+	expected int
+	max      int
+}
+
+var listFieldSizes = map[string]listFieldSize{
+	"documents": {DefaultPageLimit, MaxPageLimit},
+	"revisions": {DefaultRevisionLimit, MaxRevisionLimit},
+	"backlinks": {10, 10},
+}
+
+type GraphQL struct {
+	store  *SQLStore
+	logger *zap.Logger
+	schema graphql.Schema
+}
+
+func NewHandlerGraphQL(store *SQLStore, logger *zap.Logger) *GraphQL {
+	g := &GraphQL{
+		store:  store,
+		logger: logger,
+	}
+	schema, err := g.newGraphQLSchema()
+	if err != nil {
+		panic(err)
+	}
+	g.schema = schema
+	return g
+}
+
+// graphQLError is an error in the data of a GraphQL response. Its code and
+// details are the same as those of the REST API.
+type graphQLError struct {
+	APIError
+	current interface{}
+}
+
+func newGraphQLError(code string, message string) *graphQLError {
+	return &graphQLError{APIError: APIError{Code: code, Message: message}}
+}
+
+func newValidationError(v ValidationErrors) *graphQLError {
+	err := newGraphQLError(CodeValidationFailed, "request has invalid fields")
+	err.Details = v
+	return err
+}
+
+func newQueryError(err error) *graphQLError {
+	field := strings.TrimPrefix(err.Error(), "invalid ")
+	e := newGraphQLError(CodeBadRequest, "invalid argument")
+	e.Details = []FieldError{{Field: field, Message: err.Error()}}
+	return e
+}
+
+func (e *graphQLError) Error() string {
+	return e.Message
+}
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.Code}
+	if len(e.Details) > 0 {
+		ext["details"] = e.Details
+	}
+	if e.current != nil {
+		ext["current"] = e.current
+	}
+	return ext
+}
+
+// internalError logs err and returns an error that does not leak it.
+func (g *GraphQL) internalError(
+	ctx context.Context,
+	err error,
+	message string,
+) error {
+	RequestLogger(ctx, g.logger).With(
+		zap.Error(err),
+	).Error(message)
+	return newGraphQLError(CodeInternal, "something went wrong")
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// QueryHandler runs a GraphQL query from a POST JSON body, or from the
+// query string of a GET request. Mutations need a POST.
+func (g *GraphQL) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		values := r.URL.Query()
+		req.Query = values.Get("query")
+		req.OperationName = values.Get("operationName")
+		if v := values.Get("variables"); v != "" {
+			err := json.Unmarshal([]byte(v), &req.Variables)
+			if err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{
+			Body: []byte(req.Query),
+			Name: "GraphQL request",
+		}),
+	})
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err)
+		return
+	}
+	validation := graphql.ValidateDocument(&g.schema, doc, nil)
+	if !validation.IsValid {
+		writeJSON(w, http.StatusBadRequest, &graphql.Result{
+			Errors: validation.Errors,
+		})
+		return
+	}
+
+	op := findOperation(doc, req.OperationName)
+	if op == nil {
+		writeGraphQLError(
+			w,
+			http.StatusBadRequest,
+			fmt.Errorf("unknown operation %q", req.OperationName),
+		)
+		return
+	}
+	if r.Method == http.MethodGet &&
+		op.Operation != ast.OperationTypeQuery {
+		writeGraphQLError(
+			w,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%s operations need a POST request", op.Operation),
+		)
+		return
+	}
+	err = checkQueryLimits(doc, op, req.Variables)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := context.WithValue(
+		r.Context(),
+		KeyGraphQLLoaders,
+		newGraphQLLoaders(g.store),
+	)
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        g.schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeGraphQLError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &graphql.Result{
+		Errors: gqlerrors.FormatErrors(err),
+	})
+}
+
+// findOperation returns the operation of a document to run: the one with
+// the given name, or the only one if name is empty.
+func findOperation(doc *ast.Document, name string) *ast.OperationDefinition {
+	var found *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if name == "" {
+			if found != nil {
+				return nil
+			}
+			found = op
+		} else if op.Name != nil && op.Name.Value == name {
+			return op
+		}
+	}
+	return found
+}
+
+// checkQueryLimits rejects operations that nest deeper than MaxQueryDepth
+// or may resolve more than MaxQueryComplexity fields. Introspection fields
+// are not counted.
+func checkQueryLimits(
+	doc *ast.Document,
+	op *ast.OperationDefinition,
+	variables map[string]interface{},
+) error {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+	defaults := map[string]ast.Value{}
+	for _, def := range op.VariableDefinitions {
+		if def.DefaultValue != nil {
+			defaults[def.Variable.Name.Value] = def.DefaultValue
+		}
+	}
+	l := queryLimits{
+		fragments: fragments,
+		variables: variables,
+		defaults:  defaults,
+	}
+	depth, complexity := l.measure(op.SelectionSet)
+	if depth > MaxQueryDepth {
+		return fmt.Errorf(
+			"query depth %d is over the limit of %d",
+			depth,
+			MaxQueryDepth,
+		)
+	}
+	if complexity > MaxQueryComplexity {
+		return fmt.Errorf(
+			"query complexity %d is over the limit of %d",
+			complexity,
+			MaxQueryComplexity,
+		)
+	}
+	return nil
+}
+
+type queryLimits struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	// defaults are the declared defaults of variables
+	defaults map[string]ast.Value
+}
+
+// measure returns the depth and complexity of a selection set. Fragment
+// cycles are rejected by validation before this runs.
+func (l queryLimits) measure(set *ast.SelectionSet) (int, int) {
+	if set == nil {
+		return 0, 0
+	}
+	maxDepth, total := 0, 0
+	for _, sel := range set.Selections {
+		var depth, complexity int
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(sel.Name.Value, "__") {
+				continue
+			}
+			depth, complexity = l.measure(sel.SelectionSet)
+			depth++
+			complexity = 1 + complexity*l.listSize(sel)
+		case *ast.InlineFragment:
+			depth, complexity = l.measure(sel.SelectionSet)
+		case *ast.FragmentSpread:
+			f, ok := l.fragments[sel.Name.Value]
+			if !ok {
+				continue
+			}
+			depth, complexity = l.measure(f.SelectionSet)
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		total += complexity
+	}
+	return maxDepth, total
+}
+
+// listSize is how many items a field may return, 1 for non-list fields.
+// Limits out of range count as the nearest valid one, so that a field the
+// resolver refuses cannot lower the complexity of the others.
+func (l queryLimits) listSize(field *ast.Field) int {
+	sizes, ok := listFieldSizes[field.Name.Value]
+	if !ok {
+		return 1
+	}
+	size := sizes.expected
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "limit" {
+			continue
+		}
+		if n, ok := l.intValue(arg.Value); ok {
+			size = n
+		}
+	}
+	if size < 1 {
+		return 1
+	}
+	if size > sizes.max {
+		return sizes.max
+	}
+	return size
+}
+
+// intValue returns the integer of a literal or variable, falling back to
+// the declared default of a variable without a value.
+func (l queryLimits) intValue(value ast.Value) (int, bool) {
+	switch v := value.(type) {
+	case *ast.IntValue:
+		n, err := strconv.Atoi(v.Value)
+		return n, err == nil
+	case *ast.Variable:
+		name := v.Name.Value
+		switch n := l.variables[name].(type) {
+		case float64:
+			return int(n), true
+		case int:
+			return n, true
+		}
+		if def, ok := l.defaults[name]; ok {
+			return l.intValue(def)
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,546 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+const (
+	DefaultRevisionLimit = 10
+	MaxRevisionLimit     = 20
+)
+
+// graphQLLoaders batch the nested lookups of one GraphQL request.
+type graphQLLoaders struct {
+	users     *loader[int64, *User]
+	authors   *loader[int64, *User]
+	backlinks *loader[int64, []*Document]
+	revisions *loader[int64, []*DocumentEvent]
+}
+
+func newGraphQLLoaders(store *SQLStore) *graphQLLoaders {
+	return &graphQLLoaders{
+		users: newLoader(func(
+			ctx context.Context,
+			ids []int64,
+		) (map[int64]*User, error) {
+			users, err := store.GetAllUserByID(ctx, ids)
+			if err != nil {
+				return nil, err
+			}
+			m := map[int64]*User{}
+			for _, u := range users {
+				m[u.ID] = u
+			}
+			return m, nil
+		}),
+		authors:   newLoader(store.GetDocumentAuthors),
+		backlinks: newLoader(store.GetDocumentBacklinks),
+		revisions: newLoader(func(
+			ctx context.Context,
+			ids []int64,
+		) (map[int64][]*DocumentEvent, error) {
+			events, err := store.GetRecentDocumentEvents(
+				ctx,
+				ids,
+				MaxRevisionLimit,
+			)
+			if err != nil {
+				return nil, err
+			}
+			m := map[int64][]*DocumentEvent{}
+			for _, e := range events {
+				m[e.DocumentID] = append(m[e.DocumentID], e)
+			}
+			return m, nil
+		}),
+	}
+}
+
+func loadersFromContext(ctx context.Context) *graphQLLoaders {
+	return ctx.Value(KeyGraphQLLoaders).(*graphQLLoaders)
+}
+
+// parseGraphQLID reads an ID argument, which is a numeric string.
+func parseGraphQLID(v interface{}) (int64, bool) {
+	s, _ := v.(string)
+	id, err := strconv.ParseInt(s, 10, 64)
+	return id, err == nil
+}
+
+// newGraphQLSchema describes documents, their authors, backlinks and
+// revisions, and users. Nested fields are resolved through the loaders so
+// that each level of a query costs one database round trip.
+func (g *GraphQL) newGraphQLSchema() (graphql.Schema, error) {
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id": userField(graphql.NewNonNull(graphql.ID),
+				func(u *User) interface{} { return u.ID }),
+			"username": userField(graphql.NewNonNull(graphql.String),
+				func(u *User) interface{} { return u.Username }),
+			"email": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Only shown to the user themself and to admins.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u := p.Source.(*User)
+					if u.ID != userIDFromContext(p.Context) &&
+						!isAdminFromContext(p.Context) {
+						return nil, nil
+					}
+					return u.Email, nil
+				},
+			},
+			"createdAt": userField(graphql.NewNonNull(graphql.DateTime),
+				func(u *User) interface{} { return u.CreatedAt }),
+			"updatedAt": userField(graphql.NewNonNull(graphql.DateTime),
+				func(u *User) interface{} { return u.UpdatedAt }),
+		},
+	})
+
+	revisionType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Revision",
+		Description: "A change to a document: its creation or an edit.",
+		Fields: graphql.Fields{
+			"id": revisionField(graphql.NewNonNull(graphql.ID),
+				func(e *DocumentEvent) interface{} { return e.ID }),
+			"kind": revisionField(graphql.NewNonNull(graphql.String),
+				func(e *DocumentEvent) interface{} { return e.Kind }),
+			"createdAt": revisionField(graphql.NewNonNull(graphql.DateTime),
+				func(e *DocumentEvent) interface{} { return e.CreatedAt }),
+			"actor": &graphql.Field{
+				Type: userType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					e := p.Source.(*DocumentEvent)
+					if e.ActorID == 0 {
+						return nil, nil
+					}
+					loaders := loadersFromContext(p.Context)
+					return loaders.users.load(p.Context, e.ActorID), nil
+				},
+			},
+		},
+	})
+
+	var documentType *graphql.Object
+	documentType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Document",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": documentField(graphql.NewNonNull(graphql.ID),
+					func(d *Document) interface{} { return d.ID }),
+				"title": documentField(graphql.NewNonNull(graphql.String),
+					func(d *Document) interface{} { return d.Title }),
+				"body": documentField(graphql.NewNonNull(graphql.String),
+					func(d *Document) interface{} { return d.Body }),
+				"version": documentField(graphql.NewNonNull(graphql.Int),
+					func(d *Document) interface{} { return d.Version }),
+				"createdAt": documentField(
+					graphql.NewNonNull(graphql.DateTime),
+					func(d *Document) interface{} { return d.CreatedAt },
+				),
+				"updatedAt": documentField(
+					graphql.NewNonNull(graphql.DateTime),
+					func(d *Document) interface{} { return d.UpdatedAt },
+				),
+				"isTemplate": documentField(
+					graphql.NewNonNull(graphql.Boolean),
+					func(d *Document) interface{} { return d.IsTemplate },
+				),
+				"author": &graphql.Field{
+					Type: userType,
+					Resolve: func(
+						p graphql.ResolveParams,
+					) (interface{}, error) {
+						d := p.Source.(*Document)
+						loaders := loadersFromContext(p.Context)
+						return loaders.authors.load(p.Context, d.ID), nil
+					},
+				},
+				"backlinks": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(
+						graphql.NewNonNull(documentType),
+					)),
+					Description: "Documents that link to this one.",
+					Resolve: func(
+						p graphql.ResolveParams,
+					) (interface{}, error) {
+						d := p.Source.(*Document)
+						loaders := loadersFromContext(p.Context)
+						return loaders.backlinks.load(p.Context, d.ID), nil
+					},
+				},
+				"revisions": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(
+						graphql.NewNonNull(revisionType),
+					)),
+					Description: "The latest changes, newest first.",
+					Args: graphql.FieldConfigArgument{
+						"limit": &graphql.ArgumentConfig{
+							Type:         graphql.Int,
+							DefaultValue: DefaultRevisionLimit,
+						},
+					},
+					Resolve: g.resolveRevisions,
+				},
+			}
+		}),
+	})
+
+	documentPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "DocumentPage",
+		Fields: graphql.Fields{
+			"nodes": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(documentType),
+				)),
+			},
+			"nextCursor": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Cursor of the next page, null on the last page.",
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"document": &graphql.Field{
+				Type: documentType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.ID),
+					},
+				},
+				Resolve: g.resolveDocument,
+			},
+			"documents": &graphql.Field{
+				Type: graphql.NewNonNull(documentPageType),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{
+						Type:         graphql.Int,
+						DefaultValue: DefaultPageLimit,
+					},
+					"cursor": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+					"sort": &graphql.ArgumentConfig{
+						Type:         graphql.String,
+						DefaultValue: "title",
+					},
+				},
+				Resolve: g.resolveDocuments,
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Type: graphql.ID,
+					},
+					"username": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+				},
+				Resolve: g.resolveUser,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createDocument": &graphql.Field{
+				Type: graphql.NewNonNull(documentType),
+				Args: graphql.FieldConfigArgument{
+					"title": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+					"body": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: g.resolveCreateDocument,
+			},
+			"updateDocument": &graphql.Field{
+				Type: graphql.NewNonNull(documentType),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.ID),
+					},
+					"title": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+					"body": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+					"version": &graphql.ArgumentConfig{
+						Type:        graphql.NewNonNull(graphql.Int),
+						Description: "Version the update is based on.",
+					},
+				},
+				Resolve: g.resolveUpdateDocument,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+}
+
+func userField(
+	t graphql.Output,
+	get func(*User) interface{},
+) *graphql.Field {
+	return &graphql.Field{
+		Type: t,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*User)), nil
+		},
+	}
+}
+
+func documentField(
+	t graphql.Output,
+	get func(*Document) interface{},
+) *graphql.Field {
+	return &graphql.Field{
+		Type: t,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*Document)), nil
+		},
+	}
+}
+
+func revisionField(
+	t graphql.Output,
+	get func(*DocumentEvent) interface{},
+) *graphql.Field {
+	return &graphql.Field{
+		Type: t,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*DocumentEvent)), nil
+		},
+	}
+}
+
+func (g *GraphQL) resolveDocument(
+	p graphql.ResolveParams,
+) (interface{}, error) {
+	id, ok := parseGraphQLID(p.Args["id"])
+	if !ok {
+		return nil, nil
+	}
+	doc, err := g.store.GetOneDocument(p.Context, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, g.internalError(p.Context, err, "failed to get document")
+	}
+	return doc, nil
+}
+
+func (g *GraphQL) resolveDocuments(
+	p graphql.ResolveParams,
+) (interface{}, error) {
+	q := DocumentQuery{}
+	q.Limit, _ = p.Args["limit"].(int)
+	q.Cursor, _ = p.Args["cursor"].(string)
+	q.Sort, _ = p.Args["sort"].(string)
+	if q.Limit < 1 || q.Limit > MaxPageLimit {
+		return nil, newQueryError(ErrInvalidLimit)
+	}
+	_, _, err := parseDocumentSort(q.Sort)
+	if err != nil {
+		return nil, newQueryError(err)
+	}
+
+	docs, next, err := g.store.GetPageDocument(p.Context, q)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			return nil, newQueryError(err)
+		}
+		return nil, g.internalError(p.Context, err, "failed to get all documents")
+	}
+	page := map[string]interface{}{"nodes": docs, "nextCursor": nil}
+	if next != "" {
+		page["nextCursor"] = next
+	}
+	return page, nil
+}
+
+func (g *GraphQL) resolveRevisions(
+	p graphql.ResolveParams,
+) (interface{}, error) {
+	d := p.Source.(*Document)
+	limit, _ := p.Args["limit"].(int)
+	if limit < 1 || limit > MaxRevisionLimit {
+		return nil, newQueryError(ErrInvalidLimit)
+	}
+	load := loadersFromContext(p.Context).revisions.load(p.Context, d.ID)
+	return func() (interface{}, error) {
+		v, err := load()
+		if err != nil {
+			return nil, err
+		}
+		events := v.([]*DocumentEvent)
+		if len(events) > limit {
+			events = events[:limit]
+		}
+		return events, nil
+	}, nil
+}
+
+func (g *GraphQL) resolveUser(p graphql.ResolveParams) (interface{}, error) {
+	var user *User
+	var err error
+	if username, ok := p.Args["username"].(string); ok {
+		user, err = g.store.GetOneUserByUsername(p.Context, username)
+	} else if id, ok := parseGraphQLID(p.Args["id"]); ok {
+		user, err = g.store.GetOneUser(p.Context, id)
+	} else {
+		return nil, newGraphQLError(
+			CodeBadRequest,
+			"user needs an id or a username",
+		)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, g.internalError(p.Context, err, "failed to get user")
+	}
+	return user, nil
+}
+
+func (g *GraphQL) resolveCreateDocument(
+	p graphql.ResolveParams,
+) (interface{}, error) {
+	title, _ := p.Args["title"].(string)
+	body, _ := p.Args["body"].(string)
+	v := ValidateDocument(title, body)
+	if len(v) > 0 {
+		return nil, newValidationError(v)
+	}
+
+	now := time.Now()
+	d := &Document{
+		Title:     title,
+		Body:      body,
+		CreatedAt: now,
+		UpdatedAt: now,
+		OwnerID:   ownerFromContext(p.Context),
+	}
+	id, err := g.store.InsertDocument(p.Context, d)
+	if err != nil {
+		return nil, g.internalError(p.Context, err, "failed to insert document")
+	}
+	recordAudit(
+		p.Context,
+		g.store,
+		g.logger,
+		auditDocument(AuditDocumentCreated, id, nil, d),
+	)
+
+	userID := userIDFromContext(p.Context)
+	if userID != 0 {
+		err = g.store.InsertDocumentFollow(p.Context, userID, id)
+		if err != nil {
+			return nil, g.internalError(p.Context, err, "failed to follow document")
+		}
+	}
+	err = recordDocumentSaved(p.Context, g.store, userID, id, true, "", body)
+	if err != nil {
+		return nil, g.internalError(p.Context, err, "failed to record document")
+	}
+
+	doc, err := g.store.GetOneDocument(p.Context, id)
+	if err != nil {
+		return nil, g.internalError(p.Context, err, "failed to get document")
+	}
+	return doc, nil
+}
+
+func (g *GraphQL) resolveUpdateDocument(
+	p graphql.ResolveParams,
+) (interface{}, error) {
+	id, ok := parseGraphQLID(p.Args["id"])
+	if !ok {
+		return nil, newGraphQLError(CodeNotFound, "document not found")
+	}
+	var title, body *string
+	var v ValidationErrors
+	if t, ok := p.Args["title"].(string); ok {
+		title = &t
+		validateTitle(&v, t)
+	}
+	if b, ok := p.Args["body"].(string); ok {
+		body = &b
+		validateBody(&v, b)
+	}
+	if len(v) > 0 {
+		return nil, newValidationError(v)
+	}
+	version := p.Args["version"].(int)
+
+	doc, err := g.store.GetOneDocument(p.Context, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, newGraphQLError(CodeNotFound, "document not found")
+		}
+		return nil, g.internalError(p.Context, err, "failed to get document")
+	}
+	updated, err := g.store.UpdateDocumentContent(
+		p.Context,
+		id,
+		title,
+		body,
+		nil,
+		int64(version),
+	)
+	if errors.Is(err, ErrVersionConflict) {
+		current, err := g.store.GetOneDocument(p.Context, id)
+		if err != nil {
+			return nil, g.internalError(p.Context, err, "failed to get document")
+		}
+		conflict := newGraphQLError(
+			CodeConflict,
+			"document has been changed since this version",
+		)
+		conflict.current = apiResponse(current)
+		return nil, conflict
+	}
+	if err != nil {
+		return nil, g.internalError(p.Context, err, "failed to update document")
+	}
+	recordAudit(
+		p.Context,
+		g.store,
+		g.logger,
+		auditDocument(AuditDocumentUpdated, id, doc, updated),
+	)
+	if updated.Version == doc.Version {
+		// saving the same content is not an edit
+		return updated, nil
+	}
+	err = recordDocumentSaved(
+		p.Context,
+		g.store,
+		userIDFromContext(p.Context),
+		id,
+		false,
+		doc.Body,
+		updated.Body,
+	)
+	if err != nil {
+		return nil, g.internalError(p.Context, err, "failed to record document")
+	}
+	return updated, nil
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"go.uber.org/zap"
+)
+
+// heavyDocuments resolves 2401 fields with a limit of 100.
+const heavyDocuments = `documents(limit: %s) {
+	nodes { id title backlinks { id title } }
+}`
+
+func checkQuery(
+	t *testing.T,
+	query string,
+	variables map[string]interface{},
+) error {
+	t.Helper()
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(query)}),
+	})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	op := findOperation(doc, "")
+	if op == nil {
+		t.Fatal("no operation")
+	}
+	return checkQueryLimits(doc, op, variables)
+}
+
+func heavyQuery(header string, limit string, extra string) string {
+	field := strings.Replace(heavyDocuments, "%s", limit, 1)
+	return "query " + header + " {\n" +
+		"a: " + field + "\n" +
+		"b: " + field + "\n" +
+		"c: " + field + "\n" +
+		extra + "\n}"
+}
+
+func TestCheckQueryLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		wantErr   bool
+	}{
+		{
+			name:    "over complexity",
+			query:   heavyQuery("", "100", ""),
+			wantErr: true,
+		},
+		{
+			name: "negative limit does not offset others",
+			query: heavyQuery(
+				"",
+				"100",
+				"d: documents(limit: -1000000) { nodes { id } }",
+			),
+			wantErr: true,
+		},
+		{
+			name:    "limit over the maximum counts as the maximum",
+			query:   heavyQuery("", "1000000", ""),
+			wantErr: true,
+		},
+		{
+			name:  "small limits",
+			query: heavyQuery("", "5", ""),
+		},
+		{
+			name:    "variable without value uses declared default",
+			query:   heavyQuery("($n: Int = 100)", "$n", ""),
+			wantErr: true,
+		},
+		{
+			name:      "variable value",
+			query:     heavyQuery("($n: Int = 100)", "$n", ""),
+			variables: map[string]interface{}{"n": float64(5)},
+		},
+		{
+			name: "negative variable does not offset others",
+			query: heavyQuery(
+				"($n: Int, $m: Int)",
+				"$n",
+				"d: documents(limit: $m) { nodes { id } }",
+			),
+			variables: map[string]interface{}{
+				"n": float64(100),
+				"m": float64(-1000000),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkQuery(t, tt.query, tt.variables)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListSizeClamps(t *testing.T) {
+	tests := []struct {
+		limit string
+		want  int
+	}{
+		{"-5", 1},
+		{"0", 1},
+		{"7", 7},
+		{"100", MaxPageLimit},
+		{"5000", MaxPageLimit},
+	}
+	for _, tt := range tests {
+		query := "{ documents(limit: " + tt.limit + ") { nextCursor } }"
+		doc, err := parser.Parse(parser.ParseParams{
+			Source: source.NewSource(&source.Source{Body: []byte(query)}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := findOperation(doc, "")
+		field := op.SelectionSet.Selections[0]
+		l := queryLimits{}
+		got := l.listSize(field.(*ast.Field))
+		if got != tt.want {
+			t.Errorf("limit %s: size = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestUserEmailVisibility(t *testing.T) {
+	g := NewHandlerGraphQL(nil, zap.NewNop())
+	userType, ok := g.schema.Type("User").(*graphql.Object)
+	if !ok {
+		t.Fatal("no User type")
+	}
+	email := userType.Fields()["email"]
+	if _, ok := email.Type.(*graphql.NonNull); ok {
+		t.Fatal("email is non-null, so it cannot be hidden")
+	}
+
+	user := &User{ID: 1, Username: "ada", Email: "ada@example.com"}
+	tests := []struct {
+		name    string
+		userID  int64
+		isAdmin bool
+		want    interface{}
+	}{
+		{name: "anonymous", want: nil},
+		{name: "another user", userID: 2, want: nil},
+		{name: "the user", userID: 1, want: user.Email},
+		{name: "an admin", userID: 2, isAdmin: true, want: user.Email},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), KeyUserID, tt.userID)
+			ctx = context.WithValue(ctx, KeyIsAdmin, tt.isAdmin)
+			got, err := email.Resolve(graphql.ResolveParams{
+				Source:  user,
+				Context: ctx,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("email = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,11 +2,12 @@ package internal
 
 import (
 	"database/sql"
+	_ "embed"
 	"encoding/json"
 	"errors"
-	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	chi "github.com/go-chi/chi/v5"
@@ -14,30 +15,65 @@ import (
 )
 
 type API struct {
-	store  *SQLStore
+	store  Store
 	logger *zap.Logger
 }
 
-func NewHandlerAPI(store *SQLStore) *API {
+func NewHandlerAPI(store Store, logger *zap.Logger) *API {
 	return &API{
-		store: store,
+		store:  store,
+		logger: logger,
 	}
 }
 
+// Routes registers the endpoints of the API on r, which is mounted under
+// /api/v1.
+func (api *API) Routes(r chi.Router) {
+	// API errors are JSON too
+	r.NotFound(api.NotFoundHandler)
+	r.MethodNotAllowed(api.MethodNotAllowedHandler)
+
+	// API Documents
+	r.Post("/docs", api.InsertDocumentHandler)
+	r.Get("/docs", api.GetAllDocumentHandler)
+	r.Post("/docs/batch", api.BatchDocumentHandler)
+	r.Patch("/docs/{id}", api.UpdateDocumentHandler)
+	r.Get("/docs/{id}", api.GetOneDocumentHandler)
+	r.Delete("/docs/{id}", api.DeleteDocumentHandler)
+
+	// API Users
+	r.Post("/users", api.InsertUserHandler)
+	r.Get("/users/{id}", api.GetOneUserHandler)
+	r.Patch("/users/{id}", api.UpdateUserHandler)
+
+	// API Notifications
+	r.Get("/notifications", api.GetAllNotificationHandler)
+
+	// API description
+	r.Get("/openapi.json", api.OpenAPIHandler)
+}
+
 func (api *API) InsertUserHandler(w http.ResponseWriter, r *http.Request) {
 	type ReqBody struct {
-		Username string
-		Email    string
+		Username string `json:"username"`
+		Email    string `json:"email"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	var rb ReqBody
 	err := decoder.Decode(&rb)
 	if err != nil {
-		panic(err)
+		writeJSONDecodeError(w, err)
+		return
 	}
+	rb.Email = strings.ToLower(rb.Email)
 
-	if rb.Username == "" || rb.Email == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	v, err := ValidateUser(r.Context(), api.store, 0, &rb.Username, &rb.Email)
+	if err != nil {
+		api.internalError(w, r, err, "failed to validate user")
+		return
+	}
+	if len(v) > 0 {
+		writeValidationError(w, v)
 		return
 	}
 
@@ -48,26 +84,31 @@ func (api *API) InsertUserHandler(w http.ResponseWriter, r *http.Request) {
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
-	_, err = api.store.InsertUser(r.Context(), u)
+	id, err := api.store.InsertUser(r.Context(), u)
+	if isUniqueViolation(err) {
+		// signed up by someone else since it was validated
+		v.add("username", "username is already taken")
+		writeValidationError(w, v)
+		return
+	}
 	if err != nil {
-		panic(err)
+		api.internalError(w, r, err, "failed to insert user")
+		return
 	}
+	u.ID = id
+	recordAudit(
+		r.Context(),
+		api.store,
+		api.logger,
+		auditUser(AuditUserCreated, id, nil, u),
+	)
+	writeResource(w, http.StatusCreated, u)
 }
 
 func (api *API) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		api.logger.With(
-			zap.Error(err),
-		).Error("invalid id")
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	b, err := io.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeAPIError(w, http.StatusNotFound, CodeNotFound, "user not found")
 		return
 	}
 
@@ -76,188 +117,459 @@ func (api *API) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		Email    *string `json:"email"`
 	}
 	var rb ReqBody
-	err = json.Unmarshal(b, &rb)
+	err = json.NewDecoder(r.Body).Decode(&rb)
 	if err != nil {
-		api.logger.With(
-			zap.Error(err),
-		).Error("failed to parse input data")
-		w.WriteHeader(http.StatusBadGateway)
+		writeJSONDecodeError(w, err)
 		return
 	}
+	if rb.Email != nil {
+		email := strings.ToLower(*rb.Email)
+		rb.Email = &email
+	}
+
+	before, err := api.store.GetOneUser(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeAPIError(w, http.StatusNotFound, CodeNotFound, "user not found")
+			return
+		}
+		api.internalError(w, r, err, "failed to get user")
+		return
+	}
+
+	v, err := ValidateUser(r.Context(), api.store, id, rb.Username, rb.Email)
+	if err != nil {
+		api.internalError(w, r, err, "failed to validate user")
+		return
+	}
+	if len(v) > 0 {
+		writeValidationError(w, v)
+		return
+	}
+
 	if rb.Username != nil {
 		err = api.store.UpdateUser(r.Context(), id, "username", *rb.Username)
+		if isUniqueViolation(err) {
+			v.add("username", "username is already taken")
+			writeValidationError(w, v)
+			return
+		}
 		if err != nil {
-			panic(err)
+			api.internalError(w, r, err, "failed to update user")
+			return
 		}
 	}
 	if rb.Email != nil {
 		err = api.store.UpdateUser(r.Context(), id, "email", *rb.Email)
 		if err != nil {
-			panic(err)
+			api.internalError(w, r, err, "failed to update user")
+			return
 		}
 	}
-	w.WriteHeader(http.StatusOK)
+
+	user, err := api.store.GetOneUser(r.Context(), id)
+	if err != nil {
+		api.internalError(w, r, err, "failed to get user")
+		return
+	}
+	recordAudit(
+		r.Context(),
+		api.store,
+		api.logger,
+		auditUser(AuditUserUpdated, id, before, user),
+	)
+	writeResource(w, http.StatusOK, user)
 }
 
 func (api *API) GetOneUserHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		api.logger.With(
-			zap.Error(err),
-		).Error("invalid id")
-		w.WriteHeader(http.StatusNotFound)
+		writeAPIError(w, http.StatusNotFound, CodeNotFound, "user not found")
 		return
 	}
 
 	user, err := api.store.GetOneUser(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
+			writeAPIError(w, http.StatusNotFound, CodeNotFound, "user not found")
 			return
 		}
-		api.logger.With(
-			zap.Error(err),
-		).Error("failed to get user")
-		w.WriteHeader(http.StatusInternalServerError)
+		api.internalError(w, r, err, "failed to get user")
 		return
 	}
-	res, err := json.MarshalIndent(user, "", "  ")
-	if err != nil {
-		panic(err)
-	}
-	_, err = w.Write(res)
-	if err != nil {
-		panic(err)
-	}
+	writeResource(w, http.StatusOK, user)
 }
 
+// InsertDocumentHandler creates a document. With ?template={id} the title
+// and body default to the template's and their placeholders are expanded.
 func (api *API) InsertDocumentHandler(w http.ResponseWriter, r *http.Request) {
 	type ReqBody struct {
-		Title string
-		Body  string
+		Title      string `json:"title"`
+		Body       string `json:"body"`
+		IsTemplate bool   `json:"is_template"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	var rb ReqBody
 	err := decoder.Decode(&rb)
 	if err != nil {
-		panic(err)
+		writeJSONDecodeError(w, err)
+		return
 	}
 
-	if rb.Title == "" || rb.Body == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	now := time.Now()
+	var v ValidationErrors
+	if t := r.URL.Query().Get("template"); t != "" {
+		templateID, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			writeQueryError(w, errors.New("invalid template"))
+			return
+		}
+		tmpl, err := getTemplate(r.Context(), api.store, templateID)
+		if errors.Is(err, ErrTemplateNotFound) {
+			v.add("template", "template not found")
+		} else if err != nil {
+			api.internalError(w, r, err, "failed to get template")
+			return
+		} else {
+			rb.Title, rb.Body = fromTemplate(
+				tmpl,
+				rb.Title,
+				rb.Body,
+				usernameFromContext(r.Context()),
+				now,
+			)
+		}
+	}
+	v = append(v, ValidateDocument(rb.Title, rb.Body)...)
+	if len(v) > 0 {
+		writeValidationError(w, v)
 		return
 	}
 
-	now := time.Now()
 	d := &Document{
-		Title:     rb.Title,
-		Body:      rb.Body,
-		CreatedAt: now,
-		UpdatedAt: now,
+		Title:      rb.Title,
+		Body:       rb.Body,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		IsTemplate: rb.IsTemplate,
+		OwnerID:    ownerFromContext(r.Context()),
 	}
 
-	_, err = api.store.InsertDocument(r.Context(), d)
+	id, err := api.store.InsertDocument(r.Context(), d)
 	if err != nil {
-		panic(err)
+		api.internalError(w, r, err, "failed to insert document")
+		return
 	}
-}
+	recordAudit(
+		r.Context(),
+		api.store,
+		api.logger,
+		auditDocument(AuditDocumentCreated, id, nil, d),
+	)
 
-func (api *API) UpdateDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	userID := userIDFromContext(r.Context())
+	if userID != 0 {
+		err = api.store.InsertDocumentFollow(r.Context(), userID, id)
+		if err != nil {
+			api.internalError(w, r, err, "failed to follow document")
+			return
+		}
+	}
+	err = recordDocumentSaved(
+		r.Context(),
+		api.store,
+		userID,
+		id,
+		true,
+		"",
+		d.Body,
+	)
 	if err != nil {
-		api.logger.With(
-			zap.Error(err),
-		).Error("invalid id")
-		w.WriteHeader(http.StatusNotFound)
+		api.internalError(w, r, err, "failed to record document")
+		return
+	}
+
+	doc, err := api.store.GetOneDocument(r.Context(), id)
+	if err != nil {
+		api.internalError(w, r, err, "failed to get document")
 		return
 	}
+	w.Header().Set("ETag", documentETag(doc))
+	writeResource(w, http.StatusCreated, doc)
+}
 
-	b, err := io.ReadAll(r.Body)
-	defer r.Body.Close()
+func (api *API) UpdateDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeAPIError(w, http.StatusNotFound, CodeNotFound, "document not found")
 		return
 	}
 
 	type ReqBody struct {
-		Title *string `json:"title"`
-		Body  *string `json:"body"`
+		Title      *string `json:"title"`
+		Body       *string `json:"body"`
+		Version    int64   `json:"version"`
+		IsTemplate *bool   `json:"is_template"`
 	}
 	var rb ReqBody
-	err = json.Unmarshal(b, &rb)
+	err = json.NewDecoder(r.Body).Decode(&rb)
 	if err != nil {
-		api.logger.With(
-			zap.Error(err),
-		).Error("failed to parse input data")
-		w.WriteHeader(http.StatusBadGateway)
+		writeJSONDecodeError(w, err)
 		return
 	}
+
+	var v ValidationErrors
 	if rb.Title != nil {
-		err = api.store.UpdateDocument(r.Context(), id, "title", *rb.Title)
-		if err != nil {
-			panic(err)
-		}
+		validateTitle(&v, *rb.Title)
 	}
 	if rb.Body != nil {
-		err = api.store.UpdateDocument(r.Context(), id, "body", *rb.Body)
+		validateBody(&v, *rb.Body)
+	}
+	if len(v) > 0 {
+		writeValidationError(w, v)
+		return
+	}
+
+	// the version to update can come from If-Match or the body
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+		rb.Version, err = parseDocumentETag(ifMatch)
 		if err != nil {
-			panic(err)
+			writeAPIError(
+				w,
+				http.StatusPreconditionFailed,
+				CodePreconditionFailed,
+				"If-Match is not a document version",
+			)
+			return
 		}
 	}
-	w.WriteHeader(http.StatusOK)
-}
+	if rb.Version == 0 {
+		// an update that is not based on a version could overwrite a
+		// change it has never seen
+		writeAPIError(
+			w,
+			http.StatusPreconditionRequired,
+			CodePreconditionRequired,
+			"send the version to update in If-Match or the body",
+		)
+		return
+	}
 
-func (api *API) GetAllDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	docs, err := api.store.GetAllDocument(r.Context())
+	doc, err := api.store.GetOneDocument(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
+			writeAPIError(
+				w,
+				http.StatusNotFound,
+				CodeNotFound,
+				"document not found",
+			)
 			return
 		}
-		api.logger.With(
-			zap.Error(err),
-		).Error("failed to get all documents")
-		w.WriteHeader(http.StatusInternalServerError)
+		api.internalError(w, r, err, "failed to get document")
+		return
+	}
+	updated, err := api.store.UpdateDocumentContent(
+		r.Context(),
+		id,
+		rb.Title,
+		rb.Body,
+		rb.IsTemplate,
+		rb.Version,
+	)
+	if errors.Is(err, ErrVersionConflict) {
+		// respond with the current version so the client can merge
+		current, err := api.store.GetOneDocument(r.Context(), id)
+		if err != nil {
+			api.internalError(w, r, err, "failed to get document")
+			return
+		}
+		w.Header().Set("ETag", documentETag(current))
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error": APIError{
+				Code:    CodeConflict,
+				Message: "document has been changed since this version",
+			},
+			"current": apiResponse(current),
+		})
 		return
 	}
-	res, err := json.MarshalIndent(docs, "", "  ")
 	if err != nil {
-		panic(err)
+		api.internalError(w, r, err, "failed to update document")
+		return
 	}
-	_, err = w.Write(res)
+	recordAudit(
+		r.Context(),
+		api.store,
+		api.logger,
+		auditDocument(AuditDocumentUpdated, id, doc, updated),
+	)
+	// changing is_template alone, or saving the same content, is not an edit
+	if updated.Version != doc.Version {
+		err = recordDocumentSaved(
+			r.Context(),
+			api.store,
+			userIDFromContext(r.Context()),
+			id,
+			false,
+			doc.Body,
+			updated.Body,
+		)
+		if err != nil {
+			api.internalError(w, r, err, "failed to record document")
+			return
+		}
+	}
+	w.Header().Set("ETag", documentETag(updated))
+	writeResource(w, http.StatusOK, updated)
+}
+
+func (api *API) GetAllDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseDocumentQuery(r)
 	if err != nil {
-		panic(err)
+		writeQueryError(w, err)
+		return
+	}
+
+	docs, next, err := api.store.GetPageDocument(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			writeQueryError(w, err)
+			return
+		}
+		api.internalError(w, r, err, "failed to get all documents")
+		return
 	}
+
+	// leave out fields that were not asked for
+	body := apiResponse(docs)
+	if len(q.Fields) > 0 {
+		list := make([]map[string]interface{}, len(docs))
+		for i, doc := range docs {
+			list[i] = selectDocumentFields(doc, q.Fields)
+		}
+		body = list
+	}
+
+	if next != "" {
+		w.Header().Add(
+			"Link",
+			"<"+nextPageURL(r.URL, next)+">; rel=\"next\"",
+		)
+	}
+	writeJSON(w, http.StatusOK, body)
 }
 
 func (api *API) GetOneDocumentHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		api.logger.With(
-			zap.Error(err),
-		).Error("invalid id")
-		w.WriteHeader(http.StatusNotFound)
+		writeAPIError(w, http.StatusNotFound, CodeNotFound, "document not found")
 		return
 	}
 
 	doc, err := api.store.GetOneDocument(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
+			writeAPIError(
+				w,
+				http.StatusNotFound,
+				CodeNotFound,
+				"document not found",
+			)
 			return
 		}
-		api.logger.With(
-			zap.Error(err),
-		).Error("failed to get document")
-		w.WriteHeader(http.StatusInternalServerError)
+		api.internalError(w, r, err, "failed to get document")
 		return
 	}
-	res, err := json.MarshalIndent(doc, "", "  ")
+	w.Header().Set("ETag", documentETag(doc))
+	writeResource(w, http.StatusOK, doc)
+}
+
+func (api *API) GetAllNotificationHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		writeAPIError(
+			w,
+			http.StatusUnauthorized,
+			CodeUnauthorized,
+			"log in to see notifications",
+		)
+		return
+	}
+
+	notifications, err := api.store.GetAllNotification(r.Context(), userID)
 	if err != nil {
-		panic(err)
+		api.internalError(w, r, err, "failed to get notifications")
+		return
 	}
-	_, err = w.Write(res)
+	writeResource(w, http.StatusOK, notifications)
+}
+
+func (api *API) DeleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	if userIDFromContext(r.Context()) == 0 {
+		writeAPIError(
+			w,
+			http.StatusUnauthorized,
+			CodeUnauthorized,
+			"log in to delete documents",
+		)
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		panic(err)
+		writeAPIError(w, http.StatusNotFound, CodeNotFound, "document not found")
+		return
+	}
+
+	err = api.store.TrashDocument(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeAPIError(
+				w,
+				http.StatusNotFound,
+				CodeNotFound,
+				"document not found",
+			)
+			return
+		}
+		api.internalError(w, r, err, "failed to delete document")
+		return
+	}
+	recordAudit(
+		r.Context(),
+		api.store,
+		api.logger,
+		auditDocument(AuditDocumentDeleted, id, nil, nil),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// documentETag returns the entity tag of a document, which is its version.
+func documentETag(doc *Document) string {
+	return `"` + strconv.FormatInt(doc.Version, 10) + `"`
+}
+
+// parseDocumentETag returns the document version an entity tag refers to.
+func parseDocumentETag(etag string) (int64, error) {
+	etag = strings.TrimPrefix(etag, "W/")
+	etag = strings.Trim(etag, `"`)
+	return strconv.ParseInt(etag, 10, 64)
+}
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// OpenAPIHandler serves the OpenAPI 3 description of the API.
+func (api *API) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(openAPIDocument)
+	if err != nil {
+		RequestLogger(r.Context(), api.logger).With(
+			zap.Error(err),
+		).Error("failed to write openapi document")
 	}
 }
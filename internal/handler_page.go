@@ -7,43 +7,60 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	chi "github.com/go-chi/chi/v5"
-	"github.com/microcosm-cc/bluemonday"
-	"github.com/russross/blackfriday/v2"
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Page struct {
-	store  *SQLStore
-	logger *zap.Logger
+	store     *SQLStore
+	templates *Templates
+	cookie    CookieConfig
+	limiter   LoginLimiter
+	markdown  *MarkdownCache
+	logger    *zap.Logger
 }
 
-func NewHandlerPage(store *SQLStore) *Page {
+func NewHandlerPage(
+	store *SQLStore,
+	templates *Templates,
+	cookie CookieConfig,
+	limiter LoginLimiter,
+	logger *zap.Logger,
+) *Page {
 	return &Page{
-		store: store,
+		store:     store,
+		templates: templates,
+		cookie:    cookie,
+		limiter:   limiter,
+		markdown:  NewMarkdownCache(),
+		logger:    logger,
 	}
 }
 
+// log returns the logger of a request.
+func (page *Page) log(r *http.Request) *zap.Logger {
+	return RequestLogger(r.Context(), page.logger)
+}
+
 func (page *Page) RenderIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/index.html",
-	)
+	t, err := page.templates.HTML("index.html")
 	if err != nil {
-		panic(err)
+		page.internalError(w, r, err, "cannot compile index template")
+		return
 	}
 	err = t.Execute(w, map[string]interface{}{
 		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
 		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
 	})
 	if err != nil {
 		panic(err)
@@ -52,20 +69,17 @@ func (page *Page) RenderIndex(w http.ResponseWriter, r *http.Request) {
 
 func (page *Page) RenderDashboard(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/dashboard.html",
-	)
+	t, err := page.templates.HTML("dashboard.html")
 	if err != nil {
-		page.logger.With(
-			zap.Error(err),
-		).Error("cannot compile dashboard template")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "cannot compile dashboard template")
 		return
 	}
 	err = t.Execute(w, map[string]interface{}{
 		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
 		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"IsAdmin":         isAdminFromContext(r.Context()),
 	})
 	if err != nil {
 		panic(err)
@@ -73,47 +87,82 @@ func (page *Page) RenderDashboard(w http.ResponseWriter, r *http.Request) {
 }
 
 func (page *Page) RenderLogin(w http.ResponseWriter, r *http.Request) {
+	page.renderLogin(w, r, http.StatusOK, "", "")
+}
+
+// renderLogin renders the login form, with the submitted username and why
+// logging in failed if it did.
+func (page *Page) renderLogin(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	username string,
+	loginError string,
+) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/login.html",
-	)
+	t, err := page.templates.HTML("login.html")
 	if err != nil {
-		page.logger.With(
-			zap.Error(err),
-		).Error("cannot compile login template")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "cannot compile login template")
 		return
 	}
-	err = t.Execute(w, nil)
+	w.WriteHeader(status)
+	err = t.Execute(w, map[string]interface{}{
+		"FormUsername": username,
+		"Error":        loginError,
+		"CSRFToken":    csrfTokenFromContext(r.Context()),
+	})
 	if err != nil {
 		panic(err)
 	}
 }
 
+// recordLogin keeps a login attempt for the limiter and the audit log. It
+// only logs a failure, which must not stop the response.
+func (page *Page) recordLogin(
+	r *http.Request,
+	ip string,
+	username string,
+	succeeded bool,
+) {
+	err := page.limiter.Record(r.Context(), &LoginAttempt{
+		Username:  username,
+		IP:        ip,
+		Succeeded: succeeded,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("failed to record login attempt")
+	}
+}
+
 func (page *Page) DeleteSession(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("session")
+	c, err := r.Cookie(page.cookie.Name)
 	if err != nil {
-		fmt.Println(err)
 		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 	tokenHash := c.Value
 
 	// delete session
 	err = page.store.DeleteSession(r.Context(), tokenHash)
 	if err != nil {
-		fmt.Println(err)
+		page.log(r).With(
+			zap.Error(err),
+		).Error("failed to delete session")
+	}
+	if userID := userIDFromContext(r.Context()); userID != 0 {
+		recordAudit(
+			r.Context(),
+			page.store,
+			page.logger,
+			auditUser(AuditLogout, userID, nil, nil),
+		)
 	}
 
 	// delete cookie by setting a new one with same name and max age < 0
-	cookie := http.Cookie{
-		Name:     "session",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
+	http.SetCookie(w, page.cookie.ExpiredSession())
 
 	// redirect to index
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -127,22 +176,95 @@ func (page *Page) CreateSession(w http.ResponseWriter, r *http.Request) {
 	data.Username = r.FormValue("username")
 	data.Password = r.FormValue("password")
 
-	user, err := page.store.GetOneUserByUsername(r.Context(), data.Username)
+	// refuse to check the password while the account or ip has to wait.
+	// The attempt is reserved until it is recorded, when this returns.
+	ip := clientIPFromContext(r.Context())
+	wait, release, err := page.limiter.Wait(r.Context(), ip, data.Username)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		page.internalError(w, r, err, "failed to count failed logins")
+		return
+	}
+	defer release()
+	if wait > 0 {
+		page.log(r).With(
+			zap.String("ip", ip),
+			zap.Duration("wait", wait),
+		).Warn("login rate limited")
+		wait = (wait + time.Second - 1).Truncate(time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+		page.renderLogin(
+			w,
+			r,
+			http.StatusTooManyRequests,
+			data.Username,
+			fmt.Sprintf("too many failed attempts, try again in %s", wait),
+		)
 		return
 	}
 
+	// the same error, after as long, for an unknown user and a wrong
+	// password
+	passwordHash := dummyPasswordHash()
+	user, err := page.store.GetOneUserByUsername(r.Context(), data.Username)
+	knownUser := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		page.internalError(w, r, err, "failed to get user")
+		return
+	}
+	if knownUser {
+		passwordHash = user.PasswordHash
+	}
 	err = bcrypt.CompareHashAndPassword(
-		[]byte(user.PasswordHash),
+		[]byte(passwordHash),
 		[]byte(data.Password),
 	)
-	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+	if !knownUser || err != nil {
+		page.log(r).With(
+			zap.String("ip", ip),
+			zap.Bool("known_user", knownUser),
+		).Info("failed login")
+		page.recordLogin(r, ip, data.Username, false)
+		e := &AuditEvent{
+			Kind:       AuditLoginFailed,
+			TargetType: AuditTargetUser,
+			After: auditSummary(map[string]interface{}{
+				"username": data.Username,
+			}),
+		}
+		if knownUser {
+			e.TargetID = &user.ID
+		}
+		recordAudit(r.Context(), page.store, page.logger, e)
+		page.renderLogin(
+			w,
+			r,
+			http.StatusBadRequest,
+			data.Username,
+			"wrong username or password",
+		)
+		return
+	}
+	if user.DisabledAt != nil {
+		page.log(r).With(
+			zap.String("ip", ip),
+		).Info("login to disabled account")
+		page.recordLogin(r, ip, data.Username, false)
+		e := auditUser(AuditLoginFailed, user.ID, nil, nil)
+		e.After = auditSummary(map[string]interface{}{
+			"username": data.Username,
+			"disabled": true,
+		})
+		recordAudit(r.Context(), page.store, page.logger, e)
+		page.renderLogin(
+			w,
+			r,
+			http.StatusForbidden,
+			data.Username,
+			"this account is disabled",
+		)
 		return
 	}
+	page.recordLogin(r, ip, data.Username, true)
 
 	// create session token
 	tokenBytes := make([]byte, 32)
@@ -159,38 +281,57 @@ func (page *Page) CreateSession(w http.ResponseWriter, r *http.Request) {
 		UserID:    user.ID,
 		TokenHash: tokenString,
 	}
-	_, err = page.store.InsertSession(r.Context(), session)
+	sessionID, err := page.store.InsertSession(r.Context(), session)
 	if err != nil {
-		panic(err)
+		page.internalError(w, r, err, "failed to insert session")
+		return
 	}
+	e := auditUser(AuditLogin, user.ID, nil, nil)
+	e.ActorID = &user.ID
+	e.ActorUsername = user.Username
+	recordAudit(r.Context(), page.store, page.logger, e)
+	recordAudit(r.Context(), page.store, page.logger, &AuditEvent{
+		ActorID:       &user.ID,
+		ActorUsername: user.Username,
+		Kind:          AuditTokenCreated,
+		TargetType:    AuditTargetSession,
+		TargetID:      &sessionID,
+	})
 
 	// set cookie with session token
-	cookie := http.Cookie{
-		Name:     "session",
-		Value:    tokenString,
-		Path:     "/",
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
+	http.SetCookie(w, page.cookie.Session(tokenString))
 
 	// respond
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func (page *Page) RenderNewUser(w http.ResponseWriter, r *http.Request) {
+	page.renderNewUser(w, r, http.StatusOK, "", "", nil)
+}
+
+// renderNewUser renders the signup form, with the submitted values and their
+// errors if any.
+func (page *Page) renderNewUser(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	username string,
+	email string,
+	v ValidationErrors,
+) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/signup.html",
-	)
+	t, err := page.templates.HTML("signup.html")
 	if err != nil {
-		page.logger.With(
-			zap.Error(err),
-		).Error("cannot compile signup template")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "cannot compile signup template")
 		return
 	}
-	err = t.Execute(w, nil)
+	w.WriteHeader(status)
+	err = t.Execute(w, map[string]interface{}{
+		"FormUsername": username,
+		"FormEmail":    email,
+		"Errors":       v.ByField(),
+		"CSRFToken":    csrfTokenFromContext(r.Context()),
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -201,36 +342,57 @@ func (page *Page) SaveNewUser(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	email := r.FormValue("email")
 	email = strings.ToLower(email)
+	password := r.FormValue("password1")
+
+	// validate data
+	v, err := ValidateUser(r.Context(), page.store, 0, &username, &email)
+	if err != nil {
+		page.internalError(w, r, err, "failed to validate user")
+		return
+	}
+	v = append(v, ValidatePassword(password, r.FormValue("password2"))...)
+	if len(v) > 0 {
+		page.renderNewUser(w, r, http.StatusBadRequest, username, email, v)
+		return
+	}
 
 	// generate password
-	password := r.FormValue("password")
 	hashedBytes, err := bcrypt.GenerateFromPassword(
 		[]byte(password),
 		bcrypt.DefaultCost,
 	)
 	if err != nil {
-		panic(err)
+		page.internalError(w, r, err, "failed to hash password")
+		return
 	}
 	passwordHash := string(hashedBytes)
 
-	// build req body
-	type ReqBody struct {
-		Username     string
-		Email        string
-		PasswordHash string
-	}
-	rb := &ReqBody{
-		Username:     username,
-		Email:        email,
-		PasswordHash: passwordHash,
-	}
-	fmt.Printf("%+v", rb)
-
 	// sql create
-	_, err = page.store.InsertUserPage(r.Context(), username, email, passwordHash)
+	id, err := page.store.InsertUserPage(
+		r.Context(),
+		username,
+		email,
+		passwordHash,
+	)
+	if isUniqueViolation(err) {
+		// signed up by someone else since it was validated
+		v.add("username", "username is already taken")
+		page.renderNewUser(w, r, http.StatusBadRequest, username, email, v)
+		return
+	}
 	if err != nil {
-		panic(err)
+		page.internalError(w, r, err, "failed to insert user")
+		return
 	}
+	e := auditUser(AuditUserCreated, id, nil, &User{
+		Username:        username,
+		Email:           email,
+		DigestFrequency: DigestOff,
+	})
+	// signing up is done by the new user
+	e.ActorID = &id
+	e.ActorUsername = username
+	recordAudit(r.Context(), page.store, page.logger, e)
 
 	// respond
 	http.Redirect(w, r, "/login", http.StatusFound)
@@ -240,10 +402,10 @@ func (page *Page) RenderOneDocument(w http.ResponseWriter, r *http.Request) {
 	// parse url doc id
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		page.logger.With(
+		page.log(r).With(
 			zap.Error(err),
 		).Error("invalid id")
-		w.WriteHeader(http.StatusNotFound)
+		page.renderError(w, r, http.StatusNotFound)
 		return
 	}
 
@@ -251,35 +413,45 @@ func (page *Page) RenderOneDocument(w http.ResponseWriter, r *http.Request) {
 	doc, err := page.store.GetOneDocument(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
+			page.renderError(w, r, http.StatusNotFound)
 			return
 		}
-		page.logger.With(
-			zap.Error(err),
-		).Error("failed to get document")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "failed to get document")
 		return
 	}
 
-	// compile markdown to html
-	markdownWithUnixLineEndings := strings.Replace(doc.Body, "\r\n", "\n", -1)
-	unsafeHTML := blackfriday.Run([]byte(markdownWithUnixLineEndings))
-	bodyHTML := bluemonday.UGCPolicy().SanitizeBytes(unsafeHTML)
+	// check if current user follows this document
+	isFollowing, err := page.store.IsFollowingDocument(
+		r.Context(),
+		userIDFromContext(r.Context()),
+		doc.ID,
+	)
+	if err != nil {
+		page.internalError(w, r, err, "failed to get document follow")
+		return
+	}
+
+	// compile markdown to html, once per version
+	body := page.markdown.Render(r.Context(), doc)
 
 	// respond
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/document.html",
-	)
+	t, err := page.templates.HTML("document.html")
 	if err != nil {
-		panic(err)
+		page.internalError(w, r, err, "cannot compile document template")
+		return
 	}
 	err = t.Execute(w, map[string]interface{}{
 		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
 		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
 		"Document":        doc,
-		"BodyHTML":        template.HTML(bodyHTML),
+		"BodyHTML":        body.HTML,
+		"TOC":             body.TOC,
+		"HasMath":         body.HasMath,
+		"HasMermaid":      body.HasMermaid,
+		"IsFollowing":     isFollowing,
 	})
 	if err != nil {
 		panic(err)
@@ -287,31 +459,41 @@ func (page *Page) RenderOneDocument(w http.ResponseWriter, r *http.Request) {
 }
 
 func (page *Page) RenderAllDocument(w http.ResponseWriter, r *http.Request) {
-	docs, err := page.store.GetAllDocument(r.Context())
+	q, err := parseDocumentQuery(r)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
+		page.renderError(w, r, http.StatusBadRequest)
+		return
+	}
+	q.Fields = []string{"id", "title", "updated_at"}
+
+	docs, next, err := page.store.GetPageDocument(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			page.renderError(w, r, http.StatusBadRequest)
 			return
 		}
-		page.logger.With(
-			zap.Error(err),
-		).Error("failed to get all documents")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "failed to get all documents")
 		return
 	}
+	var nextURL string
+	if next != "" {
+		nextURL = nextPageURL(r.URL, next)
+	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/document_list.html",
-	)
+	t, err := page.templates.HTML("document_list.html")
 	if err != nil {
-		panic(err)
+		page.internalError(w, r, err, "cannot compile document list template")
+		return
 	}
 	err = t.Execute(w, map[string]interface{}{
 		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
 		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
 		"DocumentList":    docs,
+		"Sort":            q.Sort,
+		"NextURL":         nextURL,
 	})
 	if err != nil {
 		panic(err)
@@ -319,21 +501,59 @@ func (page *Page) RenderAllDocument(w http.ResponseWriter, r *http.Request) {
 }
 
 func (page *Page) RenderNewDocument(w http.ResponseWriter, r *http.Request) {
+	// a picked template fills in the form, placeholders are expanded on save
+	var title, body string
+	templateID, _ := strconv.ParseInt(r.URL.Query().Get("template"), 10, 64)
+	if templateID != 0 {
+		tmpl, err := getTemplate(r.Context(), page.store, templateID)
+		if err != nil {
+			if errors.Is(err, ErrTemplateNotFound) {
+				page.renderError(w, r, http.StatusNotFound)
+				return
+			}
+			page.internalError(w, r, err, "failed to get template")
+			return
+		}
+		title = tmpl.Title
+		body = tmpl.Body
+	}
+	page.renderNewDocument(w, r, http.StatusOK, templateID, title, body, nil)
+}
+
+// renderNewDocument renders the new document form and template picker, with
+// the submitted values and their errors if any.
+func (page *Page) renderNewDocument(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	templateID int64,
+	title string,
+	body string,
+	v ValidationErrors,
+) {
+	templates, err := page.store.GetAllTemplateDocument(r.Context())
+	if err != nil {
+		page.internalError(w, r, err, "failed to get templates")
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/document_new.html",
-	)
+	t, err := page.templates.HTML("document_new.html")
 	if err != nil {
-		page.logger.With(
-			zap.Error(err),
-		).Error("cannot compile doc new template")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "cannot compile doc new template")
 		return
 	}
+	w.WriteHeader(status)
 	err = t.Execute(w, map[string]interface{}{
 		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
 		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"Templates":       templates,
+		"TemplateID":      templateID,
+		"FormTitle":       title,
+		"FormBody":        body,
+		"Errors":          v.ByField(),
 	})
 	if err != nil {
 		panic(err)
@@ -343,6 +563,7 @@ func (page *Page) RenderNewDocument(w http.ResponseWriter, r *http.Request) {
 func (page *Page) SaveNewDocument(w http.ResponseWriter, r *http.Request) {
 	title := r.FormValue("title")
 	body := r.FormValue("body")
+	templateID, _ := strconv.ParseInt(r.FormValue("template"), 10, 64)
 
 	type ReqBody struct {
 		Title string
@@ -352,24 +573,81 @@ func (page *Page) SaveNewDocument(w http.ResponseWriter, r *http.Request) {
 		Title: title,
 		Body:  body,
 	}
-	fmt.Printf("%+v", rb)
 
-	if rb.Title == "" || rb.Body == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	now := time.Now()
+	var v ValidationErrors
+	if templateID != 0 {
+		tmpl, err := getTemplate(r.Context(), page.store, templateID)
+		if errors.Is(err, ErrTemplateNotFound) {
+			v.add("template", "template not found")
+		} else if err != nil {
+			page.internalError(w, r, err, "failed to get template")
+			return
+		} else {
+			rb.Title, rb.Body = fromTemplate(
+				tmpl,
+				rb.Title,
+				rb.Body,
+				usernameFromContext(r.Context()),
+				now,
+			)
+		}
+	}
+	v = append(v, ValidateDocument(rb.Title, rb.Body)...)
+	if len(v) > 0 {
+		page.renderNewDocument(
+			w,
+			r,
+			http.StatusBadRequest,
+			templateID,
+			title,
+			body,
+			v,
+		)
 		return
 	}
 
-	now := time.Now()
 	d := &Document{
 		Title:     rb.Title,
 		Body:      rb.Body,
 		CreatedAt: now,
 		UpdatedAt: now,
+		OwnerID:   ownerFromContext(r.Context()),
 	}
 
-	_, err := page.store.InsertDocument(r.Context(), d)
+	id, err := page.store.InsertDocument(r.Context(), d)
 	if err != nil {
-		panic(err)
+		page.internalError(w, r, err, "failed to insert document")
+		return
+	}
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditDocument(AuditDocumentCreated, id, nil, d),
+	)
+
+	// author follows their own document and mentioned users get notified
+	userID := userIDFromContext(r.Context())
+	if userID != 0 {
+		err = page.store.InsertDocumentFollow(r.Context(), userID, id)
+		if err != nil {
+			page.internalError(w, r, err, "failed to follow document")
+			return
+		}
+	}
+	err = recordDocumentSaved(
+		r.Context(),
+		page.store,
+		userID,
+		id,
+		true,
+		"",
+		d.Body,
+	)
+	if err != nil {
+		page.internalError(w, r, err, "failed to record document")
+		return
 	}
 
 	http.Redirect(w, r, "/docs", http.StatusFound)
@@ -379,10 +657,10 @@ func (page *Page) RenderEditDocument(w http.ResponseWriter, r *http.Request) {
 	// parse url doc id
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		page.logger.With(
+		page.log(r).With(
 			zap.Error(err),
 		).Error("invalid id")
-		w.WriteHeader(http.StatusNotFound)
+		page.renderError(w, r, http.StatusNotFound)
 		return
 	}
 
@@ -390,33 +668,39 @@ func (page *Page) RenderEditDocument(w http.ResponseWriter, r *http.Request) {
 	doc, err := page.store.GetOneDocument(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
+			page.renderError(w, r, http.StatusNotFound)
 			return
 		}
-		page.logger.With(
-			zap.Error(err),
-		).Error("failed to get document")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "failed to get document")
 		return
 	}
 
-	// render
+	page.renderEditDocument(w, r, http.StatusOK, doc, nil)
+}
+
+// renderEditDocument renders the edit form of a document, with the
+// submitted values in doc and their errors if any.
+func (page *Page) renderEditDocument(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	doc *Document,
+	v ValidationErrors,
+) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/document_edit.html",
-	)
+	t, err := page.templates.HTML("document_edit.html")
 	if err != nil {
-		page.logger.With(
-			zap.Error(err),
-		).Error("cannot compile doc edit template")
-		w.WriteHeader(http.StatusInternalServerError)
+		page.internalError(w, r, err, "cannot compile doc edit template")
 		return
 	}
+	w.WriteHeader(status)
 	err = t.Execute(w, map[string]interface{}{
 		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
 		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
 		"Document":        doc,
+		"Errors":          v.ByField(),
 	})
 	if err != nil {
 		panic(err)
@@ -428,59 +712,501 @@ func (page *Page) SaveEditDocument(w http.ResponseWriter, r *http.Request) {
 	idAsString := chi.URLParam(r, "id")
 	id, err := strconv.ParseInt(idAsString, 10, 64)
 	if err != nil {
-		page.logger.With(
+		page.log(r).With(
 			zap.Error(err),
 		).Error("invalid id")
-		w.WriteHeader(http.StatusNotFound)
+		page.renderError(w, r, http.StatusNotFound)
 		return
 	}
 
 	// gather post form data
 	var data struct {
-		Title string
-		Body  string
+		Title   string
+		Body    string
+		Version int64
 	}
 	data.Title = r.FormValue("title")
 	data.Body = r.FormValue("body")
+	data.Version, err = strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil || data.Version < 1 {
+		page.renderError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	// keep previous body to find new mentions
+	doc, err := page.store.GetOneDocument(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to get document")
+		return
+	}
 
 	// validate data
-	if data.Title == "" || data.Body == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	v := ValidateDocument(data.Title, data.Body)
+	if len(v) > 0 {
+		submitted := *doc
+		submitted.Title = data.Title
+		submitted.Body = data.Body
+		submitted.Version = data.Version
+		page.renderEditDocument(w, r, http.StatusBadRequest, &submitted, v)
+		return
+	}
+
+	// write updated doc on database, unless someone else saved it first
+	updated, err := page.store.UpdateDocumentContent(
+		r.Context(),
+		id,
+		&data.Title,
+		&data.Body,
+		nil,
+		data.Version,
+	)
+	if errors.Is(err, ErrVersionConflict) {
+		page.renderDocumentConflict(w, r, data.Title, data.Body)
+		return
+	}
+	if err != nil {
+		page.internalError(w, r, err, "failed to update document")
 		return
 	}
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditDocument(AuditDocumentUpdated, id, doc, updated),
+	)
+
+	// notify mentioned users and followers, unless nothing changed
+	if updated.Version != doc.Version {
+		err = recordDocumentSaved(
+			r.Context(),
+			page.store,
+			userIDFromContext(r.Context()),
+			id,
+			false,
+			doc.Body,
+			data.Body,
+		)
+		if err != nil {
+			page.internalError(w, r, err, "failed to record document")
+			return
+		}
+	}
+
+	// respond
+	http.Redirect(w, r, "/docs/"+idAsString, http.StatusFound)
+}
 
-	// write updated doc on database
-	err = page.store.UpdateDocument(r.Context(), id, "title", data.Title)
+// renderDocumentConflict shows the submitted and the current version of a
+// document side by side, with a form to save a merge of the two.
+func (page *Page) renderDocumentConflict(
+	w http.ResponseWriter,
+	r *http.Request,
+	title string,
+	body string,
+) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		page.renderError(w, r, http.StatusNotFound)
+		return
+	}
+	doc, err := page.store.GetOneDocument(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to get document")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("document_conflict.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile doc conflict template")
+		return
+	}
+	w.WriteHeader(http.StatusConflict)
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"Document":        doc,
+		"YourTitle":       title,
+		"YourBody":        body,
+	})
 	if err != nil {
 		panic(err)
 	}
-	err = page.store.UpdateDocument(r.Context(), id, "body", data.Body)
+}
+
+func (page *Page) RenderEditor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("editor.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile dashboard template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+	})
 	if err != nil {
 		panic(err)
 	}
+}
+
+// SetDocumentTemplate marks a document as a template, or unmarks it when
+// is_template is not "true".
+func (page *Page) SetDocumentTemplate(w http.ResponseWriter, r *http.Request) {
+	idAsString := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idAsString, 10, 64)
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("invalid id")
+		page.renderError(w, r, http.StatusNotFound)
+		return
+	}
+
+	isTemplate := r.FormValue("is_template") == "true"
+	err = page.store.SetDocumentTemplate(r.Context(), id, isTemplate)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to set document template")
+		return
+	}
+	e := auditDocument(AuditDocumentUpdated, id, nil, nil)
+	e.After = auditSummary(map[string]interface{}{"is_template": isTemplate})
+	recordAudit(r.Context(), page.store, page.logger, e)
 
-	// respond
 	http.Redirect(w, r, "/docs/"+idAsString, http.StatusFound)
 }
 
-func (page *Page) RenderEditor(w http.ResponseWriter, r *http.Request) {
+func (page *Page) FollowDocument(w http.ResponseWriter, r *http.Request) {
+	page.setDocumentFollow(w, r, true)
+}
+
+func (page *Page) UnfollowDocument(w http.ResponseWriter, r *http.Request) {
+	page.setDocumentFollow(w, r, false)
+}
+
+func (page *Page) setDocumentFollow(
+	w http.ResponseWriter,
+	r *http.Request,
+	follow bool,
+) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// parse doc id from url
+	idAsString := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idAsString, 10, 64)
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("invalid id")
+		page.renderError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if follow {
+		err = page.store.InsertDocumentFollow(r.Context(), userID, id)
+	} else {
+		err = page.store.DeleteDocumentFollow(r.Context(), userID, id)
+	}
+	if err != nil {
+		page.internalError(w, r, err, "failed to set document follow")
+		return
+	}
+
+	http.Redirect(w, r, "/docs/"+idAsString, http.StatusFound)
+}
+
+func (page *Page) RenderNotifications(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	notifications, err := page.store.GetAllNotification(r.Context(), userID)
+	if err != nil {
+		page.internalError(w, r, err, "failed to get notifications")
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(
-		"internal/templates/layout.html",
-		"internal/templates/editor.html",
+	t, err := page.templates.HTML("notification_list.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile notification list template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated":  r.Context().Value(KeyIsAuthenticated),
+		"Username":         r.Context().Value(KeyUsername),
+		"UnreadCount":      r.Context().Value(KeyUnreadCount),
+		"CSRFToken":        csrfTokenFromContext(r.Context()),
+		"NotificationList": notifications,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (page *Page) MarkNotificationsRead(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	err := page.store.MarkAllNotificationRead(r.Context(), userID)
+	if err != nil {
+		page.internalError(w, r, err, "failed to mark notifications read")
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
+
+func (page *Page) RenderSettings(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := page.store.GetOneUser(r.Context(), userID)
+	if err != nil {
+		page.internalError(w, r, err, "failed to get user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("settings.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile settings template")
+		return
+	}
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"User":            user,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (page *Page) SaveSettings(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// validate data
+	digestFrequency := r.FormValue("digest_frequency")
+	if digestFrequency != DigestOff && digestPeriod(digestFrequency) == 0 {
+		page.renderError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err := page.store.UpdateUser(
+		r.Context(),
+		userID,
+		"digest_frequency",
+		digestFrequency,
 	)
 	if err != nil {
-		page.logger.With(
+		page.internalError(w, r, err, "failed to update settings")
+		return
+	}
+	e := auditUser(AuditUserUpdated, userID, nil, nil)
+	e.After = auditSummary(map[string]interface{}{
+		"digest_frequency": digestFrequency,
+	})
+	recordAudit(r.Context(), page.store, page.logger, e)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+func (page *Page) DeleteDocument(w http.ResponseWriter, r *http.Request) {
+	if userIDFromContext(r.Context()) == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// parse doc id from url
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		page.log(r).With(
 			zap.Error(err),
-		).Error("cannot compile dashboard template")
-		w.WriteHeader(http.StatusInternalServerError)
+		).Error("invalid id")
+		page.renderError(w, r, http.StatusNotFound)
+		return
+	}
+
+	err = page.store.TrashDocument(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to delete document")
+		return
+	}
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditDocument(AuditDocumentDeleted, id, nil, nil),
+	)
+
+	http.Redirect(w, r, "/docs", http.StatusFound)
+}
+
+func (page *Page) RenderTrash(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// admins see the whole trash, other users only their own documents
+	var owner *int64
+	if !isAdminFromContext(r.Context()) {
+		owner = &userID
+	}
+	docs, err := page.store.GetAllTrashedDocument(r.Context(), owner)
+	if err != nil {
+		page.internalError(w, r, err, "failed to get trashed documents")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("trash.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile trash template")
 		return
 	}
 	err = t.Execute(w, map[string]interface{}{
 		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
 		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"DocumentList":    docs,
 	})
 	if err != nil {
 		panic(err)
 	}
 }
+
+// RestoreDocument takes a document out of the trash. Admins can restore any
+// document, other users only the ones they own.
+func (page *Page) RestoreDocument(w http.ResponseWriter, r *http.Request) {
+	if userIDFromContext(r.Context()) == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// parse doc id from url
+	idAsString := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idAsString, 10, 64)
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("invalid id")
+		page.renderError(w, r, http.StatusNotFound)
+		return
+	}
+
+	var owner *int64
+	if !isAdminFromContext(r.Context()) {
+		owner = ownerFromContext(r.Context())
+	}
+	err = page.store.RestoreDocument(r.Context(), id, owner)
+	if err != nil {
+		if errors.Is(err, ErrNotOwner) {
+			page.renderError(w, r, http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to restore document")
+		return
+	}
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditDocument(AuditDocumentRestored, id, nil, nil),
+	)
+
+	http.Redirect(w, r, "/docs/"+idAsString, http.StatusFound)
+}
+
+// PurgeDocument deletes a document in the trash forever. Admins can purge
+// any document, other users only the ones they own.
+func (page *Page) PurgeDocument(w http.ResponseWriter, r *http.Request) {
+	if userIDFromContext(r.Context()) == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// parse doc id from url
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("invalid id")
+		page.renderError(w, r, http.StatusNotFound)
+		return
+	}
+
+	var owner *int64
+	if !isAdminFromContext(r.Context()) {
+		owner = ownerFromContext(r.Context())
+	}
+	err = page.store.PurgeDocument(r.Context(), id, owner)
+	if err != nil {
+		if errors.Is(err, ErrNotOwner) {
+			page.renderError(w, r, http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			page.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		page.internalError(w, r, err, "failed to purge document")
+		return
+	}
+	recordAudit(
+		r.Context(),
+		page.store,
+		page.logger,
+		auditDocument(AuditDocumentPurged, id, nil, nil),
+	)
+
+	http.Redirect(w, r, "/trash", http.StatusFound)
+}
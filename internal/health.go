@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ReadinessTimeout bounds the checks of the readiness endpoint.
+const ReadinessTimeout = 2 * time.Second
+
+// schemaColumns are the tables and columns of postgresql/schema.sql. The
+// server is not ready until the database has all of them, so keep this in
+// sync with the schema.
+var schemaColumns = map[string][]string{
+	"documents": {
+		"id", "created_at", "updated_at", "title", "body", "version",
+		"deleted_at", "is_template", "owner_id",
+	},
+	"users": {
+		"id", "created_at", "updated_at", "username", "email",
+		"password_hash", "digest_frequency", "digest_sent_at", "is_admin",
+		"disabled_at", "password_reset_required",
+	},
+	"sessions":         {"id", "user_id", "token_hash"},
+	"document_follows": {"user_id", "document_id"},
+	"notifications": {
+		"id", "user_id", "actor_id", "document_id", "kind", "read_at",
+		"created_at",
+	},
+	"document_events": {"id", "document_id", "actor_id", "kind", "created_at"},
+	"login_attempts":  {"id", "username", "ip", "succeeded", "created_at"},
+	"audit_events": {
+		"id", "actor_id", "actor_username", "kind", "target_type",
+		"target_id", "ip", "user_agent", "before", "after", "created_at",
+	},
+}
+
+type Health struct {
+	store  *SQLStore
+	logger *zap.Logger
+}
+
+func NewHandlerHealth(store *SQLStore, logger *zap.Logger) *Health {
+	return &Health{
+		store:  store,
+		logger: logger,
+	}
+}
+
+// LivenessHandler responds as long as the server is serving requests.
+func (h *Health) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadinessHandler responds with 503 Service Unavailable unless the database
+// is reachable and has the schema the server needs. The endpoint is public,
+// so each check is only "ok" or "fail" and the reasons are logged.
+func (h *Health) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+	defer cancel()
+	logger := RequestLogger(r.Context(), h.logger)
+
+	checks := map[string]string{
+		"database": "ok",
+		"schema":   "ok",
+	}
+	err := h.store.Ping(ctx)
+	if err != nil {
+		logger.With(zap.Error(err)).Warn("not ready, database unreachable")
+		checks["database"] = "fail"
+		checks["schema"] = "fail"
+	} else {
+		missing, err := h.store.GetMissingColumn(ctx, schemaColumns)
+		if err != nil {
+			logger.With(zap.Error(err)).Warn("not ready, cannot check schema")
+			checks["schema"] = "fail"
+		} else if len(missing) > 0 {
+			logger.With(
+				zap.Strings("missing", missing),
+			).Warn("not ready, schema is missing columns")
+			checks["schema"] = "fail"
+		}
+	}
+
+	res := map[string]interface{}{
+		"status": "ok",
+		"checks": checks,
+	}
+	status := http.StatusOK
+	for _, check := range checks {
+		if check != "ok" {
+			res["status"] = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, res)
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+func TestReadinessHidesErrors(t *testing.T) {
+	// nothing listens on a socket in dir, so the ping fails
+	dir := t.TempDir()
+	db, err := sqlx.Open(
+		"postgres",
+		"host="+dir+" dbname=lakehouse sslmode=disable",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	logger := zap.NewNop()
+	h := NewHandlerHealth(NewSQLStore(db, logger), logger)
+
+	w := httptest.NewRecorder()
+	h.ReadinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+	var res struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "unavailable" {
+		t.Errorf("status = %q", res.Status)
+	}
+	for name, check := range res.Checks {
+		if check != "fail" {
+			t.Errorf("check %s = %q, want fail", name, check)
+		}
+	}
+	if strings.Contains(w.Body.String(), dir) {
+		t.Errorf("response leaks the error: %s", w.Body.String())
+	}
+}
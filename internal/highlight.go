@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/russross/blackfriday/v2"
+)
+
+const (
+	highlightLightStyle = "github"
+	highlightDarkStyle  = "github-dark"
+)
+
+// highlightFormatter writes highlighted code with CSS classes, which
+// WriteHighlightCSS styles.
+var highlightFormatter = chromahtml.New(chromahtml.WithClasses(true))
+
+// highlightCode writes a code block highlighted for its language. It
+// returns false, having written nothing, if the language is unknown.
+func highlightCode(w io.Writer, node *blackfriday.Node) bool {
+	info := strings.Fields(string(node.Info))
+	if len(info) == 0 {
+		return false
+	}
+	lexer := lexers.Get(info[0])
+	if lexer == nil {
+		return false
+	}
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, string(node.Literal))
+	if err != nil {
+		return false
+	}
+	var buf bytes.Buffer
+	err = highlightFormatter.Format(&buf, styles.Get(highlightLightStyle), tokens)
+	if err != nil {
+		return false
+	}
+	buf.WriteString("\n")
+	_, _ = w.Write(buf.Bytes())
+	return true
+}
+
+// WriteHighlightCSS writes the stylesheet of highlighted code, with a light
+// theme and a dark one for dark mode. It is served as static/highlight.css.
+func WriteHighlightCSS(w io.Writer) error {
+	err := highlightFormatter.WriteCSS(w, styles.Get(highlightLightStyle))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "@media (prefers-color-scheme: dark) {\n")
+	if err != nil {
+		return err
+	}
+	err = highlightFormatter.WriteCSS(w, styles.Get(highlightDarkStyle))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "}\n")
+	return err
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AssetIntegrityFile lists the subresource integrity of the vendored
+// scripts and stylesheets, relative to the static directory. make vendor-js
+// writes it from the files npm has checked against the registry, so a file
+// changed on disk or on the way is refused by the browser.
+const AssetIntegrityFile = "vendor/integrity.txt"
+
+// LoadAssetIntegrity reads AssetIntegrityFile from staticDir and returns
+// the integrity of each file by its path under /static/. Without the file,
+// because the static files are served from elsewhere or were not vendored
+// yet, it returns fs.ErrNotExist.
+func LoadAssetIntegrity(staticDir string) (map[string]string, error) {
+	if staticDir == "" {
+		return nil, fs.ErrNotExist
+	}
+	f, err := os.Open(filepath.Join(staticDir, AssetIntegrityFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	integrity := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "sha384-") {
+			return nil, fmt.Errorf(
+				"%s:%d: want sha384-<hash> <path>",
+				AssetIntegrityFile,
+				line,
+			)
+		}
+		integrity[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(integrity) == 0 {
+		return nil, errors.New(AssetIntegrityFile + " is empty")
+	}
+	return integrity, nil
+}
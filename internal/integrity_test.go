@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadAssetIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	_, err := LoadAssetIntegrity(dir)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("err = %v without the file, want fs.ErrNotExist", err)
+	}
+	_, err = LoadAssetIntegrity("")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("err = %v without a static dir, want fs.ErrNotExist", err)
+	}
+
+	path := filepath.Join(dir, AssetIntegrityFile)
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(content string) {
+		t.Helper()
+		err := os.WriteFile(path, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("sha384-abc vendor/a.js\n\nsha384-def vendor/b.css\n")
+	integrity, err := LoadAssetIntegrity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integrity["vendor/a.js"] != "sha384-abc" ||
+		integrity["vendor/b.css"] != "sha384-def" || len(integrity) != 2 {
+		t.Fatalf("integrity = %v", integrity)
+	}
+
+	for _, content := range []string{
+		"",
+		"vendor/a.js\n",
+		"sha256-abc vendor/a.js\n",
+		"sha384-abc vendor/a.js extra\n",
+	} {
+		write(content)
+		if _, err := LoadAssetIntegrity(dir); err == nil {
+			t.Errorf("%q is accepted", content)
+		}
+	}
+}
+
+func TestDocumentScriptsIntegrity(t *testing.T) {
+	render := func(integrity map[string]string) string {
+		t.Helper()
+		templates, err := NewTemplates(TemplateFS(), false, integrity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl, err := templates.HTML("document.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		err = tmpl.Execute(&b, map[string]interface{}{
+			"Document":   &Document{Title: "t", UpdatedAt: time.Now()},
+			"TOC":        []TOCEntry{},
+			"HasMath":    true,
+			"HasMermaid": true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	files := []string{
+		"vendor/katex-0.16.9/katex.min.css",
+		"vendor/katex-0.16.9/katex.min.js",
+		"vendor/katex-0.16.9/contrib/auto-render.min.js",
+		"vendor/mermaid-10.9.1/mermaid.min.js",
+	}
+	integrity := map[string]string{}
+	for i, f := range files {
+		integrity[f] = "sha384-" + strings.Repeat("x", i+1)
+	}
+	page := render(integrity)
+	for _, f := range files {
+		want := `"/static/` + f + `" integrity="` + integrity[f] + `"`
+		if !strings.Contains(page, want) {
+			t.Errorf("page has no %s", want)
+		}
+	}
+
+	page = render(nil)
+	if strings.Contains(page, "integrity=") {
+		t.Errorf("page has an integrity without one given")
+	}
+	for _, f := range files {
+		if !strings.Contains(page, `"/static/`+f+`"`) {
+			t.Errorf("page does not link to %s", f)
+		}
+	}
+}
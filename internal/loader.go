@@ -0,0 +1,69 @@
+package internal
+
+import "context"
+
+// loader batches the lookups made while resolving one level of a GraphQL
+// query into a single fetch. load registers a key and returns a thunk;
+// the executor only calls thunks once every field of the level has been
+// resolved, so the first call fetches all the keys registered so far.
+//
+// Queries are resolved on one goroutine, so there is no locking.
+type loader[K comparable, V any] struct {
+	fetch   func(ctx context.Context, keys []K) (map[K]V, error)
+	pending []K
+	results map[K]V
+	errs    map[K]error
+}
+
+func newLoader[K comparable, V any](
+	fetch func(ctx context.Context, keys []K) (map[K]V, error),
+) *loader[K, V] {
+	return &loader[K, V]{
+		fetch:   fetch,
+		results: map[K]V{},
+		errs:    map[K]error{},
+	}
+}
+
+// load returns a thunk for the value of key. A missing key resolves to the
+// zero value of V.
+func (l *loader[K, V]) load(
+	ctx context.Context,
+	key K,
+) func() (interface{}, error) {
+	_, done := l.results[key]
+	if !done && !containsKey(l.pending, key) {
+		l.pending = append(l.pending, key)
+	}
+	return func() (interface{}, error) {
+		if len(l.pending) > 0 {
+			l.flush(ctx)
+		}
+		if err, ok := l.errs[key]; ok {
+			return nil, err
+		}
+		return l.results[key], nil
+	}
+}
+
+func (l *loader[K, V]) flush(ctx context.Context) {
+	keys := l.pending
+	l.pending = nil
+	values, err := l.fetch(ctx, keys)
+	for _, k := range keys {
+		if err != nil {
+			l.errs[k] = err
+			continue
+		}
+		l.results[k] = values[k]
+	}
+}
+
+func containsKey[K comparable](keys []K, key K) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+)
+
+// RequestIDHeader carries the id of a request, from a proxy in front of the
+// server if it sets one, and back to the client.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDRegexp matches the request ids accepted from clients.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// NewLogger builds the logger of the server, writing JSON lines for
+// production or readable lines for development.
+func NewLogger(cfg LogConfig) (*zap.Logger, error) {
+	zc := zap.NewProductionConfig()
+	if cfg.Format == LogFormatConsole {
+		zc = zap.NewDevelopmentConfig()
+	}
+	level, err := zap.ParseAtomicLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	zc.Level = level
+	return zc.Build()
+}
+
+// RequestID is a middleware that gives every request an id, and puts a
+// logger with it in the request context.
+func RequestID(logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !requestIDRegexp.MatchString(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			ctx := context.WithValue(r.Context(), KeyRequestID, id)
+			ctx = context.WithValue(
+				ctx,
+				KeyLogger,
+				logger.With(zap.String("request_id", id)),
+			)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// AccessLog is a middleware that logs every request once it is served. It
+// goes after the session middleware, so that the user is known.
+func AccessLog(fallback *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			log := RequestLogger(r.Context(), fallback).With(
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Int("status", status),
+				zap.Int("bytes", ww.BytesWritten()),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("remote_addr", r.RemoteAddr),
+			)
+			// the handler logs the error of a 5xx itself
+			if status >= http.StatusInternalServerError {
+				log.Warn("request")
+			} else {
+				log.Info("request")
+			}
+		})
+	}
+}
+
+// RequestLogger returns the logger of the request in ctx with its id, user,
+// route and trace, or fallback outside of a request.
+func RequestLogger(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	logger, ok := ctx.Value(KeyLogger).(*zap.Logger)
+	if !ok {
+		if fallback == nil {
+			return zap.NewNop()
+		}
+		return fallback
+	}
+	if username := usernameFromContext(ctx); username != "" {
+		logger = logger.With(zap.String("user", username))
+	}
+	if rctx := chi.RouteContext(ctx); rctx != nil {
+		if route := rctx.RoutePattern(); route != "" {
+			logger = logger.With(zap.String("route", route))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With(zap.String("trace_id", sc.TraceID().String()))
+	}
+	return logger
+}
@@ -0,0 +1,356 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	LoginLimiterMemory   = "memory"
+	LoginLimiterPostgres = "postgres"
+)
+
+const (
+	// loginFreeAttempts are the failures before logins are slowed down.
+	loginFreeAttempts = 3
+	// loginBaseDelay is the wait after the first failure past the free
+	// ones, doubled on every failure after it.
+	loginBaseDelay = time.Second
+	// loginIPFactor multiplies the thresholds of an ip, which many users
+	// behind the same NAT can share.
+	loginIPFactor = 5
+	// loginForgetAfter is how long failures count for.
+	loginForgetAfter = 24 * time.Hour
+	// maxLoginEntries bounds the memory of the in-memory limiter before
+	// forgotten entries are swept.
+	maxLoginEntries = 10000
+)
+
+// LoginLimiter slows down guessing passwords. Every failure of an account
+// or an ip past a few doubles the wait before the next attempt, and enough
+// of them lock it out for a while. Every attempt is kept in the database as
+// an audit record.
+type LoginLimiter interface {
+	// Wait returns how long ip must wait before trying to log in as
+	// username, zero if it may now. An attempt let through is reserved, so
+	// that attempts in parallel cannot all pass, until the returned release
+	// is called, after Record. release is never nil without an error.
+	Wait(
+		ctx context.Context,
+		ip string,
+		username string,
+	) (wait time.Duration, release func(), err error)
+	// Record keeps an attempt and counts it towards the waits.
+	Record(ctx context.Context, attempt *LoginAttempt) error
+}
+
+// NewLoginLimiter returns the limiter of cfg, keeping failures in memory or
+// counting them from the audit records in Postgres, which works across
+// instances.
+func NewLoginLimiter(store *SQLStore, cfg LoginConfig) LoginLimiter {
+	policy := loginPolicy{
+		lockoutAfter:    cfg.LockoutAfter,
+		lockoutDuration: cfg.LockoutDuration,
+	}
+	if cfg.Limiter == LoginLimiterPostgres {
+		return &SQLLoginLimiter{store: store, policy: policy}
+	}
+	return &MemoryLoginLimiter{
+		store:   store,
+		policy:  policy,
+		entries: map[string]*loginEntry{},
+	}
+}
+
+// loginPolicy turns failures into waits.
+type loginPolicy struct {
+	lockoutAfter    int
+	lockoutDuration time.Duration
+}
+
+// delay returns the wait after the last of failures, with thresholds
+// multiplied by factor.
+func (p loginPolicy) delay(failures int, factor int) time.Duration {
+	if failures >= p.lockoutAfter*factor {
+		return p.lockoutDuration
+	}
+	free := loginFreeAttempts * factor
+	if failures < free {
+		return 0
+	}
+	d := loginBaseDelay
+	for i := free; i < failures && d < p.lockoutDuration; i++ {
+		d *= 2
+	}
+	if d > p.lockoutDuration {
+		return p.lockoutDuration
+	}
+	return d
+}
+
+// wait returns how long is left of the wait after failures, the latest at
+// lastAt.
+func (p loginPolicy) wait(
+	failures int,
+	lastAt time.Time,
+	factor int,
+	now time.Time,
+) time.Duration {
+	wait := lastAt.Add(p.delay(failures, factor)).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+type loginEntry struct {
+	failures int
+	lastAt   time.Time
+	// inFlight are the attempts let through and not released yet
+	inFlight int
+}
+
+// MemoryLoginLimiter counts failures in memory, per instance.
+type MemoryLoginLimiter struct {
+	store  *SQLStore
+	policy loginPolicy
+
+	mu      sync.Mutex
+	entries map[string]*loginEntry
+}
+
+// Wait counts the attempts in flight as failures happening now, and
+// reserves one under the same lock it checks with.
+func (l *MemoryLoginLimiter) Wait(
+	ctx context.Context,
+	ip string,
+	username string,
+) (time.Duration, func(), error) {
+	now := time.Now()
+	keys := []string{"user:" + username, "ip:" + ip}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	wait := maxDuration(
+		l.wait(keys[0], 1, now),
+		l.wait(keys[1], loginIPFactor, now),
+	)
+	if wait > 0 {
+		return wait, func() {}, nil
+	}
+	for _, key := range keys {
+		l.entry(key, now).inFlight++
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, key := range keys {
+				e, ok := l.entries[key]
+				if !ok {
+					continue
+				}
+				e.inFlight--
+				if e.inFlight == 0 && e.failures == 0 {
+					delete(l.entries, key)
+				}
+			}
+		})
+	}
+	return 0, release, nil
+}
+
+// wait returns how long is left of the wait of key; l.mu must be held.
+func (l *MemoryLoginLimiter) wait(
+	key string,
+	factor int,
+	now time.Time,
+) time.Duration {
+	e, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	failures, lastAt := e.failures, e.lastAt
+	if now.Sub(lastAt) > loginForgetAfter {
+		failures = 0
+	}
+	if e.inFlight > 0 {
+		failures += e.inFlight
+		lastAt = now
+	}
+	return l.policy.wait(failures, lastAt, factor, now)
+}
+
+// entry returns the entry of key, adding it if there is none, with the
+// failures that no longer count cleared; l.mu must be held.
+func (l *MemoryLoginLimiter) entry(key string, now time.Time) *loginEntry {
+	e, ok := l.entries[key]
+	if !ok {
+		e = &loginEntry{}
+		l.entries[key] = e
+	}
+	if now.Sub(e.lastAt) > loginForgetAfter {
+		e.failures = 0
+	}
+	return e
+}
+
+func (l *MemoryLoginLimiter) Record(
+	ctx context.Context,
+	attempt *LoginAttempt,
+) error {
+	// counted first, so that an unreachable database does not stop it
+	l.count(attempt)
+	_, err := l.store.InsertLoginAttempt(ctx, attempt)
+	return err
+}
+
+func (l *MemoryLoginLimiter) count(attempt *LoginAttempt) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// a success clears the account, but not the ip, which an attacker
+	// could clear by logging in to an account of their own
+	if attempt.Succeeded {
+		key := "user:" + attempt.Username
+		if e, ok := l.entries[key]; ok {
+			e.failures = 0
+			if e.inFlight == 0 {
+				delete(l.entries, key)
+			}
+		}
+		return
+	}
+	if len(l.entries) >= maxLoginEntries {
+		for key, e := range l.entries {
+			if e.inFlight == 0 &&
+				attempt.CreatedAt.Sub(e.lastAt) > loginForgetAfter {
+				delete(l.entries, key)
+			}
+		}
+	}
+	for _, key := range []string{
+		"user:" + attempt.Username,
+		"ip:" + attempt.IP,
+	} {
+		e := l.entry(key, attempt.CreatedAt)
+		e.failures++
+		e.lastAt = attempt.CreatedAt
+	}
+}
+
+// SQLLoginLimiter counts failures from the audit records, so that every
+// instance sees the same ones.
+type SQLLoginLimiter struct {
+	store  *SQLStore
+	policy loginPolicy
+}
+
+// Wait takes advisory locks of the account and the ip until the attempt is
+// released, so that each attempt counts the failures of the ones before it.
+// While another attempt holds them it has to wait.
+func (l *SQLLoginLimiter) Wait(
+	ctx context.Context,
+	ip string,
+	username string,
+) (time.Duration, func(), error) {
+	tx, locked, err := l.store.TryLockLogin(ctx, username, ip)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !locked {
+		return loginBaseDelay, func() {}, nil
+	}
+	release := func() {
+		tx.Rollback() //nolint:errcheck
+	}
+
+	now := time.Now()
+	since := now.Add(-loginForgetAfter)
+	byUsername, err := l.store.GetLoginFailuresByUsername(ctx, username, since)
+	if err != nil {
+		release()
+		return 0, nil, err
+	}
+	byIP, err := l.store.GetLoginFailuresByIP(ctx, ip, since)
+	if err != nil {
+		release()
+		return 0, nil, err
+	}
+	var wait time.Duration
+	if byUsername.LastAt != nil {
+		wait = l.policy.wait(byUsername.Count, *byUsername.LastAt, 1, now)
+	}
+	if byIP.LastAt != nil {
+		wait = maxDuration(
+			wait,
+			l.policy.wait(byIP.Count, *byIP.LastAt, loginIPFactor, now),
+		)
+	}
+	if wait > 0 {
+		release()
+		return wait, func() {}, nil
+	}
+	return 0, release, nil
+}
+
+func (l *SQLLoginLimiter) Record(
+	ctx context.Context,
+	attempt *LoginAttempt,
+) error {
+	_, err := l.store.InsertLoginAttempt(ctx, attempt)
+	return err
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash returns a hash to check passwords of unknown users
+// against, so that they take as long to refuse as wrong passwords.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		hash, err := bcrypt.GenerateFromPassword(
+			[]byte("lakehouse"),
+			bcrypt.DefaultCost,
+		)
+		if err != nil {
+			panic(err)
+		}
+		dummyHash = string(hash)
+	})
+	return dummyHash
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// ClientIP returns the ip of the client of a request. Behind a trusted
+// proxy it is the last address of X-Forwarded-For, the one the proxy added.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			ip := strings.TrimSpace(hops[len(hops)-1])
+			if net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMemoryLimiter() *MemoryLoginLimiter {
+	return &MemoryLoginLimiter{
+		policy: loginPolicy{
+			lockoutAfter:    10,
+			lockoutDuration: time.Hour,
+		},
+		entries: map[string]*loginEntry{},
+	}
+}
+
+func TestMemoryLoginLimiterReservesAttempts(t *testing.T) {
+	l := newTestMemoryLimiter()
+	ctx := context.Background()
+
+	// attempts in flight count as failures, so only the free ones pass
+	var releases []func()
+	for i := 0; i < loginFreeAttempts; i++ {
+		wait, release, err := l.Wait(ctx, "192.0.2.1", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("attempt %d waits %s", i, wait)
+		}
+		releases = append(releases, release)
+	}
+	wait, release, err := l.Wait(ctx, "192.0.2.1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if wait == 0 {
+		t.Fatalf("attempt past the free ones in flight does not wait")
+	}
+
+	for _, release := range releases {
+		release()
+		// releasing twice does not free another attempt
+		release()
+	}
+	if len(l.entries) != 0 {
+		t.Fatalf("entries left after release: %v", l.entries)
+	}
+	wait, release, err = l.Wait(ctx, "192.0.2.1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if wait != 0 {
+		t.Fatalf("attempt after release waits %s", wait)
+	}
+}
+
+func TestMemoryLoginLimiterParallelAttempts(t *testing.T) {
+	l := newTestMemoryLimiter()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	passed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, release, err := l.Wait(ctx, "192.0.2.1", "alice")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			if wait == 0 {
+				mu.Lock()
+				passed++
+				mu.Unlock()
+				// hold the attempt like a password check would
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	if passed > loginFreeAttempts {
+		t.Fatalf("%d parallel attempts passed, want at most %d",
+			passed, loginFreeAttempts)
+	}
+}
+
+func TestMemoryLoginLimiterCountsFailures(t *testing.T) {
+	l := newTestMemoryLimiter()
+	ctx := context.Background()
+	now := time.Now()
+	for i := 0; i < loginFreeAttempts; i++ {
+		l.count(&LoginAttempt{
+			Username:  "alice",
+			IP:        "192.0.2.1",
+			CreatedAt: now,
+		})
+	}
+	wait, release, err := l.Wait(ctx, "192.0.2.2", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if wait <= 0 || wait > loginBaseDelay {
+		t.Fatalf("wait = %s, want up to %s", wait, loginBaseDelay)
+	}
+
+	// a success clears the account
+	l.count(&LoginAttempt{
+		Username:  "alice",
+		IP:        "192.0.2.3",
+		Succeeded: true,
+		CreatedAt: now,
+	})
+	wait, release, err = l.Wait(ctx, "192.0.2.2", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if wait != 0 {
+		t.Fatalf("wait after a success = %s", wait)
+	}
+}
+
+func TestLoginPolicyDelay(t *testing.T) {
+	p := loginPolicy{lockoutAfter: 10, lockoutDuration: time.Minute}
+	tests := []struct {
+		failures int
+		factor   int
+		want     time.Duration
+	}{
+		{0, 1, 0},
+		{2, 1, 0},
+		{3, 1, time.Second},
+		{4, 1, 2 * time.Second},
+		{8, 1, 32 * time.Second},
+		{9, 1, time.Minute},
+		{10, 1, time.Minute},
+		{14, loginIPFactor, 0},
+		{15, loginIPFactor, time.Second},
+		{50, loginIPFactor, time.Minute},
+	}
+	for _, tt := range tests {
+		got := p.delay(tt.failures, tt.factor)
+		if got != tt.want {
+			t.Errorf("delay(%d, %d) = %s, want %s",
+				tt.failures, tt.factor, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+type Message struct {
+	To       string
+	Subject  string
+	TextBody string
+	HTMLBody string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// FileMailer writes every message as an .eml file in a directory, for
+// development.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{
+		dir:  dir,
+		from: from,
+	}
+}
+
+var unsafeFilenameRegexp = regexp.MustCompile(`[^A-Za-z0-9@._-]`)
+
+func (m *FileMailer) Send(ctx context.Context, msg *Message) error {
+	data, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(m.dir, 0o750)
+	if err != nil {
+		return err
+	}
+	filename := fmt.Sprintf(
+		"%s-%s.eml",
+		time.Now().Format("20060102T150405.000000000"),
+		unsafeFilenameRegexp.ReplaceAllString(msg.To, "_"),
+	)
+	return os.WriteFile(filepath.Join(m.dir, filename), data, 0o600)
+}
+
+// SMTPMailer sends messages through an SMTP server.
+type SMTPMailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func NewSMTPMailer(
+	addr string,
+	username string,
+	password string,
+	from string,
+) *SMTPMailer {
+	return &SMTPMailer{
+		addr:     addr,
+		username: username,
+		password: password,
+		from:     from,
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	data, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, data)
+}
+
+// buildMessage encodes msg as a multipart/alternative email with a plaintext
+// and an HTML part.
+func buildMessage(from string, msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(
+		&buf,
+		"Subject: %s\r\n",
+		mime.QEncoding.Encode("utf-8", msg.Subject),
+	)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(
+		&buf,
+		"Content-Type: multipart/alternative; boundary=%s\r\n\r\n",
+		mw.Boundary(),
+	)
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", msg.TextBody},
+		{"text/html; charset=utf-8", msg.HTMLBody},
+	}
+	for _, p := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		_, err = qw.Write([]byte(p.body))
+		if err != nil {
+			return nil, err
+		}
+		err = qw.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
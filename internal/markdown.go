@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~sirodoht/lakehouse/internal/diagram"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const markdownExtensions = blackfriday.CommonExtensions |
+	blackfriday.AutoHeadingIDs |
+	blackfriday.Footnotes |
+	blackfriday.DefinitionLists
+
+// markdownPolicy is the UGC policy plus the classes of footnotes,
+// highlighted code, math and diagrams, and the SVG elements diagrams are
+// drawn with. Heading ids are already allowed by it.
+var markdownPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").
+		Matching(regexp.MustCompile(`^(footnote-ref|footnote-return)$`)).
+		OnElements("sup", "a")
+	p.AllowAttrs("class").
+		Matching(regexp.MustCompile(`^(footnotes|math-display|diagram)$`)).
+		OnElements("div")
+	p.AllowAttrs("class").
+		Matching(regexp.MustCompile(`^(chroma|mermaid)$`)).
+		OnElements("pre")
+	p.AllowAttrs("class").
+		Matching(regexp.MustCompile(
+			`^([a-z][a-z0-9]{0,4}|math-inline|math-display)$`,
+		)).
+		OnElements("span")
+
+	number := regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+	shapes := []string{
+		"svg", "g", "rect", "ellipse", "line", "path", "polygon", "text",
+	}
+	p.AllowElements(shapes...)
+	p.AllowAttrs("class").
+		Matching(regexp.MustCompile(`^diagram(-[a-z]+)*$`)).
+		OnElements(shapes...)
+	p.AllowAttrs("viewbox").
+		Matching(regexp.MustCompile(`^0 0 [0-9]+(\.[0-9]+)? [0-9]+(\.[0-9]+)?$`)).
+		OnElements("svg")
+	p.AllowAttrs("width", "height").Matching(number).OnElements("svg", "rect")
+	p.AllowAttrs("x", "y").Matching(number).OnElements("rect", "text")
+	p.AllowAttrs("x1", "y1", "x2", "y2").Matching(number).OnElements("line")
+	p.AllowAttrs("cx", "cy", "rx", "ry").Matching(number).OnElements("ellipse")
+	p.AllowAttrs("points").
+		Matching(regexp.MustCompile(`^[0-9., -]+$`)).
+		OnElements("polygon")
+	p.AllowAttrs("d").
+		Matching(regexp.MustCompile(`^[MQC0-9., -]+$`)).
+		OnElements("path")
+	p.AllowAttrs("text-anchor").
+		Matching(regexp.MustCompile(`^middle$`)).
+		OnElements("text")
+	return p
+}()
+
+// taskItemRegexp matches list items starting with [ ] or [x], in tight and
+// loose lists.
+var taskItemRegexp = regexp.MustCompile(`<li>(<p>)?\[([ xX])\] `)
+
+// TOCEntry is a heading of a document, for its table of contents.
+type TOCEntry struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// Markdown is a document body rendered to sanitized HTML.
+type Markdown struct {
+	HTML template.HTML
+	// TOC lists the headings the HTML links to by id.
+	TOC []TOCEntry
+	// HasMath and HasMermaid tell whether the page needs the scripts that
+	// typeset math and draw mermaid diagrams.
+	HasMath    bool
+	HasMermaid bool
+}
+
+// documentRenderer renders fenced code blocks of mermaid for the browser to
+// draw, of graphviz dot as SVG, of other known languages as highlighted HTML
+// and everything else as blackfriday does.
+type documentRenderer struct {
+	*blackfriday.HTMLRenderer
+	hasMermaid bool
+}
+
+func (r *documentRenderer) RenderNode(
+	w io.Writer,
+	node *blackfriday.Node,
+	entering bool,
+) blackfriday.WalkStatus {
+	if node.Type != blackfriday.CodeBlock {
+		return r.HTMLRenderer.RenderNode(w, node, entering)
+	}
+	lang := ""
+	if info := strings.Fields(string(node.Info)); len(info) > 0 {
+		lang = info[0]
+	}
+	switch lang {
+	case "mermaid":
+		r.hasMermaid = true
+		fmt.Fprintf(
+			w,
+			"<pre class=\"mermaid\">%s</pre>\n",
+			html.EscapeString(string(node.Literal)),
+		)
+		return blackfriday.GoToNext
+	case "dot", "graphviz":
+		// a graph that cannot be drawn is shown as code
+		svg, err := diagram.Render(string(node.Literal))
+		if err == nil {
+			fmt.Fprintf(w, "<div class=\"diagram\">%s</div>\n", svg)
+			return blackfriday.GoToNext
+		}
+	}
+	if highlightCode(w, node) {
+		return blackfriday.GoToNext
+	}
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
+
+// RenderMarkdown compiles a document body to sanitized HTML.
+func RenderMarkdown(ctx context.Context, body string) Markdown {
+	_, span := tracer.Start(ctx, "blackfriday.Render")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	body, math := extractMath(body)
+	flags := blackfriday.CommonHTMLFlags | blackfriday.FootnoteReturnLinks
+	renderer := &documentRenderer{
+		HTMLRenderer: blackfriday.NewHTMLRenderer(
+			blackfriday.HTMLRendererParameters{
+				Flags:                      flags,
+				FootnoteReturnLinkContents: "↩",
+			},
+		),
+	}
+	md := blackfriday.New(
+		blackfriday.WithExtensions(markdownExtensions),
+		blackfriday.WithRenderer(renderer),
+	)
+	root := md.Parse([]byte(body))
+	toc := headingEntries(root)
+	for i := range toc {
+		toc[i].Text = restoreMathText(toc[i].Text, math)
+	}
+
+	var buf bytes.Buffer
+	renderer.RenderHeader(&buf, root)
+	root.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		return renderer.RenderNode(&buf, node, entering)
+	})
+	renderer.RenderFooter(&buf, root)
+	span.End()
+
+	_, span = tracer.Start(ctx, "bluemonday.Sanitize")
+	safe := markdownPolicy.SanitizeBytes(restoreMath(buf.Bytes(), math))
+	safe = taskItemRegexp.ReplaceAllFunc(safe, func(m []byte) []byte {
+		sub := taskItemRegexp.FindSubmatch(m)
+		checked := ""
+		if !bytes.Equal(sub[2], []byte(" ")) {
+			checked = " checked"
+		}
+		return []byte(fmt.Sprintf(
+			`<li class="task-list-item">%s<input type="checkbox" disabled%s> `,
+			sub[1],
+			checked,
+		))
+	})
+	span.End()
+	return Markdown{
+		HTML:       template.HTML(safe),
+		TOC:        toc,
+		HasMath:    len(math) > 0,
+		HasMermaid: renderer.hasMermaid,
+	}
+}
+
+// MaxCachedDocuments bounds how many rendered documents MarkdownCache keeps.
+const MaxCachedDocuments = 1000
+
+type cachedMarkdown struct {
+	version  int64
+	markdown Markdown
+}
+
+// MarkdownCache keeps the rendered body of the latest version of each
+// document seen, so that a document is rendered once per edit rather than
+// once per view.
+type MarkdownCache struct {
+	mu      sync.Mutex
+	entries map[int64]cachedMarkdown
+}
+
+func NewMarkdownCache() *MarkdownCache {
+	return &MarkdownCache{
+		entries: map[int64]cachedMarkdown{},
+	}
+}
+
+// Render returns the rendered body of doc, from the cache if its version
+// was rendered already.
+func (c *MarkdownCache) Render(ctx context.Context, doc *Document) Markdown {
+	ctx, span := tracer.Start(ctx, "MarkdownCache.Render", trace.WithAttributes(
+		attribute.Int64("document.id", doc.ID),
+		attribute.Int64("document.version", doc.Version),
+	))
+	defer span.End()
+
+	c.mu.Lock()
+	entry, ok := c.entries[doc.ID]
+	c.mu.Unlock()
+	if ok && entry.version == doc.Version {
+		span.SetAttributes(attribute.Bool("markdown.cached", true))
+		return entry.markdown
+	}
+
+	span.SetAttributes(attribute.Bool("markdown.cached", false))
+	md := RenderMarkdown(ctx, doc.Body)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[doc.ID]; !ok && len(c.entries) >= MaxCachedDocuments {
+		// evict any one document, map order is random
+		for id := range c.entries {
+			delete(c.entries, id)
+			break
+		}
+	}
+	c.entries[doc.ID] = cachedMarkdown{version: doc.Version, markdown: md}
+	return md
+}
+
+// headingEntries makes the heading ids of a document unique, the same way
+// the renderer would, and returns them in order.
+func headingEntries(root *blackfriday.Node) []TOCEntry {
+	var toc []TOCEntry
+	used := map[string]bool{}
+	root.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if !entering || node.Type != blackfriday.Heading {
+			return blackfriday.GoToNext
+		}
+		if node.HeadingID == "" {
+			return blackfriday.SkipChildren
+		}
+		// math in a heading is left out of its id, keeping the words
+		// around it apart
+		base := strings.Trim(
+			mathIDRegexp.ReplaceAllString(node.HeadingID, "-"),
+			"-",
+		)
+		if base == "" {
+			base = "math"
+		}
+		id := base
+		for n := 1; used[id]; n++ {
+			id = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[id] = true
+		node.HeadingID = id
+		toc = append(toc, TOCEntry{
+			Level: node.Level,
+			ID:    id,
+			Text:  nodeText(node),
+		})
+		return blackfriday.SkipChildren
+	})
+	return toc
+}
+
+// nodeText returns the plain text of a node without its markup.
+func nodeText(node *blackfriday.Node) string {
+	var text strings.Builder
+	node.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if entering && (n.Type == blackfriday.Text || n.Type == blackfriday.Code) {
+			text.Write(n.Literal)
+		}
+		return blackfriday.GoToNext
+	})
+	return text.String()
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHeadingIDWithMath(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"# Math $a$ head", "math-head"},
+		{"# $a$ head", "head"},
+		{"# Math $a$", "math"},
+		{"# $a$", "math"},
+		{"# $a$ and $b$", "and"},
+	}
+	for _, tt := range tests {
+		md := RenderMarkdown(context.Background(), tt.body)
+		if len(md.TOC) != 1 || md.TOC[0].ID != tt.want {
+			t.Errorf("%q: toc = %+v, want id %q", tt.body, md.TOC, tt.want)
+		}
+	}
+}
+
+func TestDiagramSurvivesSanitizing(t *testing.T) {
+	body := "```dot\ndigraph { a -> b -> a; a -> a }\n```\n"
+	md := RenderMarkdown(context.Background(), body)
+	html := string(md.HTML)
+	for _, want := range []string{"<svg", "<path", " d=\"M ", "<polygon"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("rendered diagram has no %s:\n%s", want, html)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mathPlaceholder stands in for a math span while the markdown is rendered,
+// so that the TeX is not read as emphasis or escaped.
+const mathPlaceholder = "LAKEHOUSEMATH%dEND"
+
+var (
+	mathRegexp        = regexp.MustCompile(`LAKEHOUSEMATH(\d+)END`)
+	mathDisplayRegexp = regexp.MustCompile(`<p>LAKEHOUSEMATH(\d+)END</p>`)
+	// mathIDRegexp matches a placeholder in a heading id, with the dashes
+	// around it.
+	mathIDRegexp = regexp.MustCompile(`-*lakehousemath\d+end-*`)
+)
+
+type mathSpan struct {
+	tex     string
+	display bool
+}
+
+// extractMath replaces $inline$ and $$display$$ math outside of code with
+// placeholders and returns the math it replaced.
+func extractMath(body string) (string, []mathSpan) {
+	var out strings.Builder
+	var text strings.Builder
+	var spans []mathSpan
+	fence := ""
+	for _, line := range strings.SplitAfter(body, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if fence != "" {
+			out.WriteString(line)
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if len(line)-len(trimmed) < 4 &&
+			(strings.HasPrefix(trimmed, "```") ||
+				strings.HasPrefix(trimmed, "~~~")) {
+			out.WriteString(replaceMath(text.String(), &spans))
+			text.Reset()
+			out.WriteString(line)
+			fence = trimmed[:3]
+			continue
+		}
+		text.WriteString(line)
+	}
+	out.WriteString(replaceMath(text.String(), &spans))
+	return out.String(), spans
+}
+
+// replaceMath replaces the math in text outside of code spans. Display math
+// may span lines, inline math may not, and must not start or end with a
+// space or be followed by a digit, so that prices are left alone.
+func replaceMath(text string, spans *[]mathSpan) string {
+	var out strings.Builder
+	add := func(tex string, display bool) {
+		fmt.Fprintf(&out, mathPlaceholder, len(*spans))
+		*spans = append(*spans, mathSpan{tex: tex, display: display})
+	}
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '\\' && i+1 < len(text):
+			out.WriteString(text[i : i+2])
+			i += 2
+		case text[i] == '`':
+			n := 1
+			for i+n < len(text) && text[i+n] == '`' {
+				n++
+			}
+			end := closingBackticks(text, i+n, n)
+			if end < 0 {
+				out.WriteString(text[i : i+n])
+				i += n
+				continue
+			}
+			out.WriteString(text[i:end])
+			i = end
+		case strings.HasPrefix(text[i:], "$$"):
+			end := strings.Index(text[i+2:], "$$")
+			tex := ""
+			if end >= 0 {
+				tex = strings.TrimSpace(text[i+2 : i+2+end])
+			}
+			if tex == "" {
+				out.WriteString("$$")
+				i += 2
+				continue
+			}
+			add(tex, true)
+			i += 2 + end + 2
+		case text[i] == '$':
+			end := closingDollar(text, i+1)
+			if end < 0 {
+				out.WriteByte('$')
+				i++
+				continue
+			}
+			add(text[i+1:end], false)
+			i = end + 1
+		default:
+			out.WriteByte(text[i])
+			i++
+		}
+	}
+	return out.String()
+}
+
+// closingBackticks returns the end of the run of exactly n backticks that
+// closes a code span, or -1.
+func closingBackticks(text string, from int, n int) int {
+	for i := from; i < len(text); {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(text) && text[j] == '`' {
+			j++
+		}
+		if j-i == n {
+			return j
+		}
+		i = j
+	}
+	return -1
+}
+
+// closingDollar returns the index of the $ closing inline math that starts
+// at from, or -1.
+func closingDollar(text string, from int) int {
+	if from >= len(text) || strings.ContainsRune(" \t\n$", rune(text[from])) {
+		return -1
+	}
+	for j := from + 1; j < len(text) && text[j] != '\n'; j++ {
+		if text[j] == '\\' {
+			j++
+			continue
+		}
+		if text[j] != '$' {
+			continue
+		}
+		if text[j-1] == ' ' || text[j-1] == '\t' {
+			return -1
+		}
+		if j+1 < len(text) && text[j+1] >= '0' && text[j+1] <= '9' {
+			return -1
+		}
+		return j
+	}
+	return -1
+}
+
+// restoreMath replaces the placeholders in rendered HTML with markup that
+// KaTeX typesets: display math in a paragraph of its own becomes a block.
+func restoreMath(rendered []byte, spans []mathSpan) []byte {
+	span := func(m []byte) (mathSpan, bool) {
+		n, err := strconv.Atoi(string(mathRegexp.FindSubmatch(m)[1]))
+		if err != nil || n >= len(spans) {
+			return mathSpan{}, false
+		}
+		return spans[n], true
+	}
+	rendered = mathDisplayRegexp.ReplaceAllFunc(rendered, func(m []byte) []byte {
+		s, ok := span(m)
+		if !ok || !s.display {
+			return m
+		}
+		return []byte(`<div class="math-display">\[` +
+			html.EscapeString(s.tex) + `\]</div>`)
+	})
+	return mathRegexp.ReplaceAllFunc(rendered, func(m []byte) []byte {
+		s, ok := span(m)
+		if !ok {
+			return m
+		}
+		if s.display {
+			return []byte(`<span class="math-display">\[` +
+				html.EscapeString(s.tex) + `\]</span>`)
+		}
+		return []byte(`<span class="math-inline">\(` +
+			html.EscapeString(s.tex) + `\)</span>`)
+	})
+}
+
+// restoreMathText replaces the placeholders in plain text with the TeX.
+func restoreMathText(text string, spans []mathSpan) string {
+	return mathRegexp.ReplaceAllStringFunc(text, func(m string) string {
+		n, err := strconv.Atoi(mathRegexp.FindStringSubmatch(m)[1])
+		if err != nil || n >= len(spans) {
+			return m
+		}
+		if spans[n].display {
+			return "$$" + spans[n].tex + "$$"
+		}
+		return "$" + spans[n].tex + "$"
+	})
+}
@@ -0,0 +1,564 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	_ Store = (*SQLStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// MemoryStore is a Store that keeps everything in memory, so the API can be
+// tested without Postgres. It behaves like SQLStore for what the API does:
+// the same errors, versions and pages.
+type MemoryStore struct {
+	mu sync.Mutex
+	// lastID is the last id given out, shared by every table
+	lastID        int64
+	documents     map[int64]*Document
+	users         map[int64]*User
+	follows       map[[2]int64]bool
+	events        []*DocumentEvent
+	notifications []*Notification
+	auditEvents   []*AuditEvent
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		documents: map[int64]*Document{},
+		users:     map[int64]*User{},
+		follows:   map[[2]int64]bool{},
+	}
+}
+
+// nextID returns a new id; s.mu must be held.
+func (s *MemoryStore) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+func (s *MemoryStore) InsertDocument(
+	ctx context.Context,
+	d *Document,
+) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.ID = s.nextID()
+	d.Version = 1
+	saved := *d
+	s.documents[d.ID] = &saved
+	return d.ID, nil
+}
+
+func (s *MemoryStore) GetOneDocument(
+	ctx context.Context,
+	id int64,
+) (*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return getMemoryDocument(s.documents, id)
+}
+
+// getMemoryDocument returns a copy of a document that is not in the trash.
+func getMemoryDocument(docs map[int64]*Document, id int64) (*Document, error) {
+	doc, ok := docs[id]
+	if !ok || doc.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	found := *doc
+	return &found, nil
+}
+
+func (s *MemoryStore) GetPageDocument(
+	ctx context.Context,
+	q DocumentQuery,
+) ([]*Document, string, error) {
+	if q.Sort == "" {
+		q.Sort = "title"
+	}
+	column, desc, err := parseDocumentSort(q.Sort)
+	if err != nil {
+		return nil, "", err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	// less orders documents by the sort column, then by id
+	less := func(a, b *Document) bool {
+		switch column {
+		case "created_at":
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+		case "updated_at":
+			if !a.UpdatedAt.Equal(b.UpdatedAt) {
+				return a.UpdatedAt.Before(b.UpdatedAt)
+			}
+		default:
+			if a.Title != b.Title {
+				return a.Title < b.Title
+			}
+		}
+		return a.ID < b.ID
+	}
+	if desc {
+		asc := less
+		less = func(a, b *Document) bool { return asc(b, a) }
+	}
+
+	var after *Document
+	if q.Cursor != "" {
+		value, id, err := decodeDocumentCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &Document{ID: id}
+		switch v := value.(type) {
+		case string:
+			after.Title = v
+		case time.Time:
+			after.CreatedAt, after.UpdatedAt = v, v
+		}
+	}
+
+	s.mu.Lock()
+	var docs []*Document
+	for _, doc := range s.documents {
+		if doc.DeletedAt != nil || (after != nil && !less(after, doc)) {
+			continue
+		}
+		found := *doc
+		docs = append(docs, &found)
+	}
+	s.mu.Unlock()
+	sort.Slice(docs, func(i, j int) bool { return less(docs[i], docs[j]) })
+
+	var next string
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = encodeDocumentCursor(q.Sort, docs[limit-1])
+	}
+	return docs, next, nil
+}
+
+func (s *MemoryStore) UpdateDocumentContent(
+	ctx context.Context,
+	id int64,
+	title *string,
+	body *string,
+	isTemplate *bool,
+	version int64,
+) (*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return updateMemoryDocument(
+		s.documents,
+		id,
+		title,
+		body,
+		isTemplate,
+		version,
+	)
+}
+
+// updateMemoryDocument is UpdateDocumentContent on docs.
+func updateMemoryDocument(
+	docs map[int64]*Document,
+	id int64,
+	title *string,
+	body *string,
+	isTemplate *bool,
+	version int64,
+) (*Document, error) {
+	doc, err := getMemoryDocument(docs, id)
+	if err != nil {
+		return nil, err
+	}
+	if version != doc.Version {
+		return nil, ErrVersionConflict
+	}
+	changed := (title != nil && *title != doc.Title) ||
+		(body != nil && *body != doc.Body)
+	if title != nil {
+		doc.Title = *title
+	}
+	if body != nil {
+		doc.Body = *body
+	}
+	if isTemplate != nil {
+		doc.IsTemplate = *isTemplate
+	}
+	if changed {
+		doc.Version++
+		doc.UpdatedAt = time.Now()
+	}
+	saved := *doc
+	docs[id] = &saved
+	return doc, nil
+}
+
+func (s *MemoryStore) TrashDocument(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return trashMemoryDocument(s.documents, id)
+}
+
+// trashMemoryDocument is TrashDocument on docs.
+func trashMemoryDocument(docs map[int64]*Document, id int64) error {
+	doc, err := getMemoryDocument(docs, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	doc.DeletedAt = &now
+	docs[id] = doc
+	return nil
+}
+
+func (s *MemoryStore) BeginDocumentTx(
+	ctx context.Context,
+) (DocumentTx, error) {
+	return &memoryDocumentTx{
+		store:   s,
+		changed: map[int64]*Document{},
+	}, nil
+}
+
+// memoryDocumentTx keeps the documents a transaction changed apart from
+// the store until it is committed.
+type memoryDocumentTx struct {
+	store   *MemoryStore
+	changed map[int64]*Document
+	done    bool
+}
+
+// documents returns the documents of the store with the changes of the
+// transaction applied; the store's mu must be held. The documents are
+// shared with the store, so they are replaced rather than modified.
+func (t *memoryDocumentTx) documents() map[int64]*Document {
+	docs := make(map[int64]*Document, len(t.store.documents))
+	for id, doc := range t.store.documents {
+		docs[id] = doc
+	}
+	for id, doc := range t.changed {
+		docs[id] = doc
+	}
+	return docs
+}
+
+// apply runs fn on the documents of the transaction and keeps the ones it
+// changed.
+func (t *memoryDocumentTx) apply(
+	fn func(docs map[int64]*Document) error,
+) error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.store.mu.Lock()
+	defer t.store.mu.Unlock()
+	docs := t.documents()
+	before := make(map[int64]*Document, len(docs))
+	for id, doc := range docs {
+		before[id] = doc
+	}
+	err := fn(docs)
+	if err != nil {
+		return err
+	}
+	for id, doc := range docs {
+		if before[id] != doc {
+			t.changed[id] = doc
+		}
+	}
+	return nil
+}
+
+func (t *memoryDocumentTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.store.mu.Lock()
+	defer t.store.mu.Unlock()
+	for id, doc := range t.changed {
+		t.store.documents[id] = doc
+	}
+	return nil
+}
+
+func (t *memoryDocumentTx) Rollback() error {
+	t.done = true
+	return nil
+}
+
+func (t *memoryDocumentTx) InSavepoint(
+	ctx context.Context,
+	fn func() error,
+) error {
+	savepoint := make(map[int64]*Document, len(t.changed))
+	for id, doc := range t.changed {
+		savepoint[id] = doc
+	}
+	err := fn()
+	if err != nil {
+		t.changed = savepoint
+	}
+	return err
+}
+
+func (t *memoryDocumentTx) InsertDocument(
+	ctx context.Context,
+	d *Document,
+) (int64, error) {
+	err := t.apply(func(docs map[int64]*Document) error {
+		d.ID = t.store.nextID()
+		d.Version = 1
+		saved := *d
+		docs[d.ID] = &saved
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return d.ID, nil
+}
+
+func (t *memoryDocumentTx) GetOneDocument(
+	ctx context.Context,
+	id int64,
+) (*Document, error) {
+	var doc *Document
+	err := t.apply(func(docs map[int64]*Document) error {
+		var err error
+		doc, err = getMemoryDocument(docs, id)
+		return err
+	})
+	return doc, err
+}
+
+func (t *memoryDocumentTx) UpdateDocumentContent(
+	ctx context.Context,
+	id int64,
+	title *string,
+	body *string,
+	isTemplate *bool,
+	version int64,
+) (*Document, error) {
+	var doc *Document
+	err := t.apply(func(docs map[int64]*Document) error {
+		var err error
+		doc, err = updateMemoryDocument(
+			docs,
+			id,
+			title,
+			body,
+			isTemplate,
+			version,
+		)
+		return err
+	})
+	return doc, err
+}
+
+func (t *memoryDocumentTx) TrashDocument(ctx context.Context, id int64) error {
+	return t.apply(func(docs map[int64]*Document) error {
+		return trashMemoryDocument(docs, id)
+	})
+}
+
+func (s *MemoryStore) InsertDocumentFollow(
+	ctx context.Context,
+	userID int64,
+	documentID int64,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.follows[[2]int64{userID, documentID}] = true
+	return nil
+}
+
+func (s *MemoryStore) GetDocumentFollowerIDs(
+	ctx context.Context,
+	documentID int64,
+) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int64
+	for follow := range s.follows {
+		if follow[1] == documentID {
+			ids = append(ids, follow[0])
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (s *MemoryStore) InsertDocumentEvent(
+	ctx context.Context,
+	e *DocumentEvent,
+) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *e
+	saved.ID = s.nextID()
+	s.events = append(s.events, &saved)
+	return saved.ID, nil
+}
+
+func (s *MemoryStore) InsertUser(ctx context.Context, u *User) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Username == u.Username {
+			return 0, &pq.Error{
+				Code:    "23505",
+				Message: "duplicate key value violates unique constraint",
+			}
+		}
+	}
+	saved := *u
+	saved.ID = s.nextID()
+	if saved.DigestFrequency == "" {
+		saved.DigestFrequency = DigestOff
+	}
+	s.users[saved.ID] = &saved
+	return saved.ID, nil
+}
+
+func (s *MemoryStore) GetOneUser(ctx context.Context, id int64) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *user
+	return &found, nil
+}
+
+func (s *MemoryStore) GetOneUserByUsername(
+	ctx context.Context,
+	username string,
+) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Username == username {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *MemoryStore) IsUsernameTaken(
+	ctx context.Context,
+	username string,
+	userID int64,
+) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Username == username && user.ID != userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdateUser sets the username or email of a user.
+func (s *MemoryStore) UpdateUser(
+	ctx context.Context,
+	id int64,
+	field string,
+	value string,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return nil
+	}
+	updated := *user
+	switch field {
+	case "username":
+		for _, other := range s.users {
+			if other.Username == value && other.ID != id {
+				return &pq.Error{
+					Code:    "23505",
+					Message: "duplicate key value violates unique constraint",
+				}
+			}
+		}
+		updated.Username = value
+	case "email":
+		updated.Email = value
+	default:
+		return fmt.Errorf("cannot update user field %q", field)
+	}
+	s.users[id] = &updated
+	return nil
+}
+
+func (s *MemoryStore) InsertNotification(
+	ctx context.Context,
+	n *Notification,
+) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *n
+	saved.ID = s.nextID()
+	s.notifications = append(s.notifications, &saved)
+	return saved.ID, nil
+}
+
+// GetAllNotification returns the last 100 notifications of a user about
+// documents that are not in the trash, newest first.
+func (s *MemoryStore) GetAllNotification(
+	ctx context.Context,
+	userID int64,
+) ([]*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var notifications []*Notification
+	for i := len(s.notifications) - 1; i >= 0; i-- {
+		n := *s.notifications[i]
+		actor, ok := s.users[n.ActorID]
+		doc, docOK := s.documents[n.DocumentID]
+		if n.UserID != userID || !ok || !docOK || doc.DeletedAt != nil {
+			continue
+		}
+		n.ActorUsername = actor.Username
+		n.DocumentTitle = doc.Title
+		notifications = append(notifications, &n)
+		if len(notifications) == 100 {
+			break
+		}
+	}
+	return notifications, nil
+}
+
+func (s *MemoryStore) InsertAuditEvent(
+	ctx context.Context,
+	e *AuditEvent,
+) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *e
+	saved.ID = s.nextID()
+	s.auditEvents = append(s.auditEvents, &saved)
+	return saved.ID, nil
+}
@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// MetricsTimeout bounds the queries and requests made on every scrape.
+const MetricsTimeout = 5 * time.Second
+
+// Metrics collects the prometheus metrics of the server.
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewMetrics registers the metrics of HTTP requests, the database pool, the
+// rows of the store, the websocket server at collabStatsURL if set, and the
+// Go runtime.
+func NewMetrics(
+	db *sql.DB,
+	store *SQLStore,
+	collabStatsURL string,
+	logger *zap.Logger,
+) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lakehouse_http_requests_total",
+				Help: "HTTP requests served, by route pattern.",
+			},
+			[]string{"method", "route", "status"},
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "lakehouse_http_request_duration_seconds",
+				Help:    "Time taken to serve HTTP requests, by route pattern.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"method", "route"},
+		),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "lakehouse"),
+		newStoreCollector(store, logger),
+	)
+	if collabStatsURL != "" {
+		m.registry.MustRegister(newCollabCollector(collabStatsURL, logger))
+	}
+	return m
+}
+
+// Middleware counts and times requests by their chi route pattern rather
+// than their path, so that /docs/1 and /docs/2 are the same series.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+		if route == "" {
+			// not found, without a pattern; keep paths out of the labels
+			route = "unmatched"
+		}
+		m.requests.WithLabelValues(
+			r.Method,
+			route,
+			strconv.Itoa(status),
+		).Inc()
+		m.duration.WithLabelValues(r.Method, route).Observe(
+			time.Since(start).Seconds(),
+		)
+	})
+}
+
+// Handler serves the metrics, to requests with the bearer token if token is
+// not empty.
+func (m *Metrics) Handler(token string) http.Handler {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// storeCollector counts rows of the database on every scrape.
+type storeCollector struct {
+	store     *SQLStore
+	logger    *zap.Logger
+	sessions  *prometheus.Desc
+	users     *prometheus.Desc
+	documents *prometheus.Desc
+}
+
+func newStoreCollector(store *SQLStore, logger *zap.Logger) *storeCollector {
+	return &storeCollector{
+		store:  store,
+		logger: logger,
+		sessions: prometheus.NewDesc(
+			"lakehouse_sessions",
+			"Active sessions.",
+			nil,
+			nil,
+		),
+		users: prometheus.NewDesc(
+			"lakehouse_users",
+			"Users signed up.",
+			nil,
+			nil,
+		),
+		documents: prometheus.NewDesc(
+			"lakehouse_documents",
+			"Documents, by state: active, template or trashed.",
+			[]string{"state"},
+			nil,
+		),
+	}
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sessions
+	ch <- c.users
+	ch <- c.documents
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), MetricsTimeout)
+	defer cancel()
+	counts, err := c.store.GetCounts(ctx)
+	if err != nil {
+		// the other metrics are still worth serving
+		c.logger.With(zap.Error(err)).Warn("failed to count rows for metrics")
+		return
+	}
+	gauge := prometheus.GaugeValue
+	ch <- prometheus.MustNewConstMetric(
+		c.sessions,
+		gauge,
+		float64(counts.Sessions),
+	)
+	ch <- prometheus.MustNewConstMetric(c.users, gauge, float64(counts.Users))
+	ch <- prometheus.MustNewConstMetric(
+		c.documents,
+		gauge,
+		float64(counts.Documents),
+		"active",
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.documents,
+		gauge,
+		float64(counts.TemplateDocuments),
+		"template",
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.documents,
+		gauge,
+		float64(counts.TrashedDocuments),
+		"trashed",
+	)
+}
+
+// collabStats is the response of the stats endpoint of the websocket server.
+type collabStats struct {
+	Connections int `json:"connections"`
+	Documents   int `json:"documents"`
+}
+
+// collabCollector asks the websocket server for its connections on every
+// scrape.
+type collabCollector struct {
+	url         string
+	client      *http.Client
+	logger      *zap.Logger
+	up          *prometheus.Desc
+	connections *prometheus.Desc
+	documents   *prometheus.Desc
+}
+
+func newCollabCollector(url string, logger *zap.Logger) *collabCollector {
+	return &collabCollector{
+		url:    url,
+		client: &http.Client{Timeout: MetricsTimeout},
+		logger: logger,
+		up: prometheus.NewDesc(
+			"lakehouse_collab_up",
+			"Whether the websocket server answered for its stats.",
+			nil,
+			nil,
+		),
+		connections: prometheus.NewDesc(
+			"lakehouse_collab_connections",
+			"Open connections to the websocket server.",
+			nil,
+			nil,
+		),
+		documents: prometheus.NewDesc(
+			"lakehouse_collab_documents",
+			"Documents open on the websocket server.",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (c *collabCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.connections
+	ch <- c.documents
+}
+
+func (c *collabCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.fetch()
+	if err != nil {
+		c.logger.With(
+			zap.Error(err),
+			zap.String("url", c.url),
+		).Warn("failed to get websocket server stats")
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(
+		c.connections,
+		prometheus.GaugeValue,
+		float64(stats.Connections),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.documents,
+		prometheus.GaugeValue,
+		float64(stats.Documents),
+	)
+}
+
+func (c *collabCollector) fetch() (*collabStats, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var stats collabStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -9,14 +9,32 @@ type User struct {
 	PasswordHash string    `db:"password_hash"`
 	CreatedAt    time.Time `db:"created_at"`
 	UpdatedAt    time.Time `db:"updated_at"`
+
+	DigestFrequency string     `db:"digest_frequency"`
+	DigestSentAt    *time.Time `db:"digest_sent_at"`
+
+	IsAdmin bool `db:"is_admin"`
+	// DisabledAt is when an admin disabled the user, who cannot log in
+	// until enabled again.
+	DisabledAt *time.Time `db:"disabled_at"`
+	// PasswordResetRequired makes the user choose a new password before
+	// doing anything else.
+	PasswordResetRequired bool `db:"password_reset_required"`
 }
 
 type Document struct {
-	ID        int64     `db:"id"`
-	Title     string    `db:"title"`
-	Body      string    `db:"body"`
-	CreatedAt time.Time `db:"created_at"`
-	UpdatedAt time.Time `db:"updated_at"`
+	ID        int64      `db:"id"`
+	Title     string     `db:"title"`
+	Body      string     `db:"body"`
+	Version   int64      `db:"version"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
+
+	IsTemplate bool `db:"is_template"`
+	// OwnerID is the user who created the document, or who an admin gave
+	// it to.
+	OwnerID *int64 `db:"owner_id"`
 }
 
 type Session struct {
@@ -24,3 +42,48 @@ type Session struct {
 	UserID    int64  `db:"user_id"`
 	TokenHash string `db:"token_hash"`
 }
+
+type Notification struct {
+	ID            int64      `db:"id"`
+	UserID        int64      `db:"user_id"`
+	ActorID       int64      `db:"actor_id"`
+	DocumentID    int64      `db:"document_id"`
+	Kind          string     `db:"kind"`
+	ReadAt        *time.Time `db:"read_at"`
+	CreatedAt     time.Time  `db:"created_at"`
+	ActorUsername string     `db:"actor_username"`
+	DocumentTitle string     `db:"document_title"`
+}
+
+type DocumentEvent struct {
+	ID            int64     `db:"id"`
+	DocumentID    int64     `db:"document_id"`
+	ActorID       int64     `db:"actor_id"`
+	Kind          string    `db:"kind"`
+	CreatedAt     time.Time `db:"created_at"`
+	ActorUsername string    `db:"actor_username"`
+	DocumentTitle string    `db:"document_title"`
+}
+
+type LoginAttempt struct {
+	ID        int64     `db:"id"`
+	Username  string    `db:"username"`
+	IP        string    `db:"ip"`
+	Succeeded bool      `db:"succeeded"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type AuditEvent struct {
+	ID            int64  `db:"id"`
+	ActorID       *int64 `db:"actor_id"`
+	ActorUsername string `db:"actor_username"`
+	Kind          string `db:"kind"`
+	TargetType    string `db:"target_type"`
+	TargetID      *int64 `db:"target_id"`
+	IP            string `db:"ip"`
+	UserAgent     string `db:"user_agent"`
+	// Before and After summarize the target as JSON objects.
+	Before    *string   `db:"before"`
+	After     *string   `db:"after"`
+	CreatedAt time.Time `db:"created_at"`
+}
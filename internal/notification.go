@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Notifications are about documents only: there are no comments yet, so no
+// comment replies or mentions in comments either.
+const (
+	NotificationMention         = "mention"
+	NotificationDocumentChanged = "document_changed"
+)
+
+// mentionRegexp matches @username when it is not part of a word or an email
+// address.
+var mentionRegexp = regexp.MustCompile(`(?:^|[^\w@.])@([\w][\w.-]*)`)
+
+// ParseMentions returns the unique usernames mentioned in body, in order of
+// first appearance.
+func ParseMentions(body string) []string {
+	var usernames []string
+	seen := map[string]bool{}
+	for _, m := range mentionRegexp.FindAllStringSubmatch(body, -1) {
+		username := strings.TrimRight(m[1], ".-")
+		if username == "" || seen[username] {
+			continue
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// recordDocumentSaved logs the change for email digests and notifies users
+// newly mentioned in a document body and, unless the document was just
+// created, its followers.
+func recordDocumentSaved(
+	ctx context.Context,
+	store Store,
+	actorID int64,
+	documentID int64,
+	created bool,
+	oldBody string,
+	newBody string,
+) error {
+	now := time.Now()
+	kind := DocumentEventEdited
+	if created {
+		kind = DocumentEventCreated
+	}
+	_, err := store.InsertDocumentEvent(ctx, &DocumentEvent{
+		DocumentID: documentID,
+		ActorID:    actorID,
+		Kind:       kind,
+		CreatedAt:  now,
+	})
+	if err != nil {
+		return err
+	}
+
+	if actorID == 0 {
+		return nil
+	}
+	notified := map[int64]bool{actorID: true}
+
+	// mentions that were not in the previous version of the body
+	previous := map[string]bool{}
+	for _, username := range ParseMentions(oldBody) {
+		previous[username] = true
+	}
+	for _, username := range ParseMentions(newBody) {
+		if previous[username] {
+			continue
+		}
+		user, err := store.GetOneUserByUsername(ctx, username)
+		if errors.Is(err, sql.ErrNoRows) {
+			// not a user, just an @ in the text
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if notified[user.ID] {
+			continue
+		}
+		notified[user.ID] = true
+		_, err = store.InsertNotification(ctx, &Notification{
+			UserID:     user.ID,
+			ActorID:    actorID,
+			DocumentID: documentID,
+			Kind:       NotificationMention,
+			CreatedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// followers, unless this is a new document
+	if created {
+		return nil
+	}
+	followerIDs, err := store.GetDocumentFollowerIDs(ctx, documentID)
+	if err != nil {
+		return err
+	}
+	for _, userID := range followerIDs {
+		if notified[userID] {
+			continue
+		}
+		notified[userID] = true
+		_, err = store.InsertNotification(ctx, &Notification{
+			UserID:     userID,
+			ActorID:    actorID,
+			DocumentID: documentID,
+			Kind:       NotificationDocumentChanged,
+			CreatedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
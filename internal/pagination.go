@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 100
+)
+
+var (
+	ErrInvalidLimit  = errors.New("invalid limit")
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+	ErrInvalidFields = errors.New("invalid fields")
+)
+
+// documentSortColumns are the columns documents can be sorted by.
+var documentSortColumns = map[string]bool{
+	"title":      true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// documentFieldColumns are the fields that can be selected from documents.
+var documentFieldColumns = []string{
+	"id",
+	"title",
+	"body",
+	"version",
+	"created_at",
+	"updated_at",
+	"is_template",
+}
+
+// DocumentQuery describes one page of a document listing.
+type DocumentQuery struct {
+	// Limit is the page size, DefaultPageLimit if 0.
+	Limit int
+	// Cursor is the opaque position returned with the previous page.
+	Cursor string
+	// Sort is a column name, prefixed with "-" for descending order.
+	Sort string
+	// Fields are the columns to select, all of them if empty.
+	Fields []string
+}
+
+// documentCursor is the position after the last document of a page. It is
+// only valid for the sort it was created with.
+type documentCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"i"`
+}
+
+// parseDocumentSort splits a sort into its column and direction.
+func parseDocumentSort(sort string) (string, bool, error) {
+	if sort == "" {
+		sort = "title"
+	}
+	column := strings.TrimPrefix(sort, "-")
+	if !documentSortColumns[column] {
+		return "", false, ErrInvalidSort
+	}
+	return column, strings.HasPrefix(sort, "-"), nil
+}
+
+// parseDocumentFields validates the comma separated fields of a query.
+func parseDocumentFields(fields string) ([]string, error) {
+	if fields == "" {
+		return nil, nil
+	}
+	var result []string
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if !containsString(documentFieldColumns, f) {
+			return nil, ErrInvalidFields
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+func encodeDocumentCursor(sort string, doc *Document) string {
+	c := documentCursor{
+		Sort: sort,
+		ID:   doc.ID,
+	}
+	column, _, _ := parseDocumentSort(sort)
+	switch column {
+	case "title":
+		c.Value = doc.Title
+	case "created_at":
+		c.Value = doc.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		c.Value = doc.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeDocumentCursor returns the sort value and id a cursor points after.
+func decodeDocumentCursor(
+	cursor string,
+	sort string,
+) (interface{}, int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	var c documentCursor
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.Sort != sort {
+		return nil, 0, ErrInvalidCursor
+	}
+	column, _, err := parseDocumentSort(sort)
+	if err != nil {
+		return nil, 0, err
+	}
+	if column == "title" {
+		return c.Value, c.ID, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, c.Value)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	return t, c.ID, nil
+}
+
+// parseDocumentQuery reads limit, cursor, sort and fields from the query
+// string of a request.
+func parseDocumentQuery(r *http.Request) (DocumentQuery, error) {
+	var q DocumentQuery
+	values := r.URL.Query()
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxPageLimit {
+			return q, ErrInvalidLimit
+		}
+		q.Limit = limit
+	}
+	q.Cursor = values.Get("cursor")
+	q.Sort = values.Get("sort")
+	if q.Sort == "" {
+		q.Sort = "title"
+	}
+	_, _, err := parseDocumentSort(q.Sort)
+	if err != nil {
+		return q, err
+	}
+	q.Fields, err = parseDocumentFields(values.Get("fields"))
+	if err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// nextPageURL returns the url of a request with its cursor replaced.
+func nextPageURL(u *url.URL, cursor string) string {
+	values := u.Query()
+	values.Set("cursor", cursor)
+	next := url.URL{
+		Path:     u.Path,
+		RawQuery: values.Encode(),
+	}
+	return next.String()
+}
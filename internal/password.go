@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordPath is where users change their password.
+const passwordPath = "/settings/password"
+
+// RequirePasswordReset is a middleware that sends users whose password an
+// admin reset to choose a new one before anything else. API requests are
+// refused until then.
+func (page *Page) RequirePasswordReset(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required, _ := r.Context().Value(KeyPasswordReset).(bool)
+		if !required ||
+			r.URL.Path == passwordPath ||
+			r.URL.Path == "/logout" ||
+			strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isAPIRequest(r) {
+			writeAPIError(
+				w,
+				http.StatusForbidden,
+				CodeForbidden,
+				"password reset required, choose a new password at "+
+					passwordPath,
+			)
+			return
+		}
+		http.Redirect(w, r, passwordPath, http.StatusFound)
+	})
+}
+
+func (page *Page) RenderPassword(w http.ResponseWriter, r *http.Request) {
+	if userIDFromContext(r.Context()) == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	page.renderPassword(w, r, http.StatusOK, nil)
+}
+
+// renderPassword renders the password form, with the errors of the
+// submitted one if any.
+func (page *Page) renderPassword(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	v ValidationErrors,
+) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, err := page.templates.HTML("password.html")
+	if err != nil {
+		page.internalError(w, r, err, "cannot compile password template")
+		return
+	}
+	required, _ := r.Context().Value(KeyPasswordReset).(bool)
+	w.WriteHeader(status)
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"ResetRequired":   required,
+		"Errors":          v.ByField(),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SavePassword changes the password of the user, and logs them out of every
+// other session.
+func (page *Page) SavePassword(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	user, err := page.store.GetOneUser(r.Context(), userID)
+	if err != nil {
+		page.internalError(w, r, err, "failed to get user")
+		return
+	}
+
+	// validate data; after a reset the current password is the temporary
+	// one an admin was given
+	password := r.FormValue("password1")
+	v := ValidatePassword(password, r.FormValue("password2"))
+	err = bcrypt.CompareHashAndPassword(
+		[]byte(user.PasswordHash),
+		[]byte(r.FormValue("current_password")),
+	)
+	if err != nil && user.PasswordResetRequired {
+		v.add("current_password", "wrong temporary password")
+	} else if err != nil {
+		v.add("current_password", "wrong password")
+	} else if bcrypt.CompareHashAndPassword(
+		[]byte(user.PasswordHash),
+		[]byte(password),
+	) == nil {
+		v.add("password1", "new password must be different")
+	}
+	if len(v) > 0 {
+		page.renderPassword(w, r, http.StatusBadRequest, v)
+		return
+	}
+
+	hashedBytes, err := bcrypt.GenerateFromPassword(
+		[]byte(password),
+		bcrypt.DefaultCost,
+	)
+	if err != nil {
+		page.internalError(w, r, err, "failed to hash password")
+		return
+	}
+	err = page.store.UpdateUserPassword(r.Context(), userID, string(hashedBytes))
+	if err != nil {
+		page.internalError(w, r, err, "failed to update password")
+		return
+	}
+	revoked, err := page.store.DeleteAllUserSession(
+		r.Context(),
+		userID,
+		SessionToken(r, page.cookie.Name),
+	)
+	if err != nil {
+		page.internalError(w, r, err, "failed to revoke sessions")
+		return
+	}
+	e := auditUser(AuditUserUpdated, userID, nil, nil)
+	e.After = auditSummary(map[string]interface{}{
+		"password_changed": true,
+		"revoked_sessions": revoked,
+	})
+	recordAudit(r.Context(), page.store, page.logger, e)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+// errorMessages explain error pages to users.
+var errorMessages = map[int]string{
+	http.StatusBadRequest:          "The request could not be understood.",
+	http.StatusForbidden:           "You are not allowed to do that.",
+	http.StatusNotFound:            "There is nothing here.",
+	http.StatusMethodNotAllowed:    "That cannot be done here.",
+	http.StatusInternalServerError: "Something went wrong on our side.",
+}
+
+// renderError responds with an error page.
+func (page *Page) renderError(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+) {
+	message, ok := errorMessages[status]
+	if !ok {
+		message = "Something went wrong."
+	}
+	page.renderErrorMessage(w, r, status, message)
+}
+
+// renderErrorMessage responds with an error page explaining message.
+func (page *Page) renderErrorMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	message string,
+) {
+	t, err := page.templates.HTML("error.html")
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("cannot compile error template")
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err = t.Execute(w, map[string]interface{}{
+		"IsAuthenticated": r.Context().Value(KeyIsAuthenticated),
+		"Username":        r.Context().Value(KeyUsername),
+		"UnreadCount":     r.Context().Value(KeyUnreadCount),
+		"CSRFToken":       csrfTokenFromContext(r.Context()),
+		"Status":          status,
+		"Title":           strings.ToLower(http.StatusText(status)),
+		"Message":         message,
+	})
+	if err != nil {
+		page.log(r).With(
+			zap.Error(err),
+		).Error("failed to render error page")
+	}
+}
+
+// internalError logs err and responds with a 500 page that does not leak it.
+func (page *Page) internalError(
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+	message string,
+) {
+	page.log(r).With(
+		zap.Error(err),
+	).Error(message)
+	page.renderError(w, r, http.StatusInternalServerError)
+}
+
+func (page *Page) NotFound(w http.ResponseWriter, r *http.Request) {
+	page.renderError(w, r, http.StatusNotFound)
+}
+
+func (page *Page) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	page.renderError(w, r, http.StatusMethodNotAllowed)
+}
+
+// isAPIRequest reports whether r is for the API or GraphQL, which respond
+// with JSON rather than pages.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/graphql"
+}
+
+// Recoverer is a middleware that turns a panic into a 500, logged with its
+// stack. API requests get a JSON error and pages an error page.
+func (page *Page) Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// the server aborts the response on this one on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			page.log(r).With(
+				zap.String("panic", fmt.Sprint(v)),
+				zap.Stack("stack"),
+			).Error("recovered from panic")
+
+			// too late for an error response if one has started
+			ww, ok := w.(middleware.WrapResponseWriter)
+			if ok && ww.Status() != 0 {
+				return
+			}
+			if isAPIRequest(r) {
+				writeAPIError(
+					w,
+					http.StatusInternalServerError,
+					CodeInternal,
+					"something went wrong",
+				)
+				return
+			}
+			page.renderError(w, r, http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
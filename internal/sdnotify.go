@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SdReady    = "READY=1"
+	SdStopping = "STOPPING=1"
+	SdWatchdog = "WATCHDOG=1"
+)
+
+// SdNotify tells systemd about the state of the server when it runs as a
+// Type=notify service, and does nothing otherwise.
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// a leading @ is a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: socket,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// SdWatchdogInterval returns how often systemd expects to hear from the
+// server, or 0 if its watchdog is off.
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunSdWatchdog notifies the systemd watchdog twice every interval until ctx
+// is done.
+func RunSdWatchdog(
+	ctx context.Context,
+	interval time.Duration,
+	logger *zap.Logger,
+) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := SdNotify(SdWatchdog)
+			if err != nil {
+				logger.With(
+					zap.Error(err),
+				).Warn("failed to notify systemd watchdog")
+			}
+		}
+	}
+}
@@ -2,33 +2,122 @@ package internal
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
 )
 
+// ErrVersionConflict is returned when a document was changed since the
+// version an update was based on.
+var ErrVersionConflict = errors.New("document version conflict")
+
+// ErrNotOwner is returned when a user changes a document of someone else
+// that only its owner may change.
+var ErrNotOwner = errors.New("document has another owner")
+
+// Store is what the API needs of the database. SQLStore is the store of
+// the server, MemoryStore keeps everything in memory for tests.
+type Store interface {
+	InsertDocument(ctx context.Context, d *Document) (int64, error)
+	GetOneDocument(ctx context.Context, id int64) (*Document, error)
+	GetPageDocument(
+		ctx context.Context,
+		q DocumentQuery,
+	) ([]*Document, string, error)
+	UpdateDocumentContent(
+		ctx context.Context,
+		id int64,
+		title *string,
+		body *string,
+		isTemplate *bool,
+		version int64,
+	) (*Document, error)
+	TrashDocument(ctx context.Context, id int64) error
+	BeginDocumentTx(ctx context.Context) (DocumentTx, error)
+
+	InsertDocumentFollow(ctx context.Context, userID, documentID int64) error
+	GetDocumentFollowerIDs(
+		ctx context.Context,
+		documentID int64,
+	) ([]int64, error)
+	InsertDocumentEvent(ctx context.Context, e *DocumentEvent) (int64, error)
+
+	InsertUser(ctx context.Context, u *User) (int64, error)
+	GetOneUser(ctx context.Context, id int64) (*User, error)
+	GetOneUserByUsername(ctx context.Context, username string) (*User, error)
+	IsUsernameTaken(
+		ctx context.Context,
+		username string,
+		userID int64,
+	) (bool, error)
+	UpdateUser(ctx context.Context, id int64, field, value string) error
+
+	InsertNotification(ctx context.Context, n *Notification) (int64, error)
+	GetAllNotification(
+		ctx context.Context,
+		userID int64,
+	) ([]*Notification, error)
+
+	InsertAuditEvent(ctx context.Context, e *AuditEvent) (int64, error)
+}
+
+// DocumentTx changes documents in a transaction, which nothing else sees
+// until it is committed.
+type DocumentTx interface {
+	Commit() error
+	// Rollback discards the transaction. After Commit it does nothing.
+	Rollback() error
+	// InSavepoint runs fn so that if it fails only its changes are rolled
+	// back and the transaction can go on.
+	InSavepoint(ctx context.Context, fn func() error) error
+
+	InsertDocument(ctx context.Context, d *Document) (int64, error)
+	GetOneDocument(ctx context.Context, id int64) (*Document, error)
+	UpdateDocumentContent(
+		ctx context.Context,
+		id int64,
+		title *string,
+		body *string,
+		isTemplate *bool,
+		version int64,
+	) (*Document, error)
+	TrashDocument(ctx context.Context, id int64) error
+}
+
 type SQLStore struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	logger *zap.Logger
 }
 
-func NewSQLStore(db *sqlx.DB) *SQLStore {
+func NewSQLStore(db *sqlx.DB, logger *zap.Logger) *SQLStore {
 	return &SQLStore{
-		db: db,
+		db:     db,
+		logger: logger,
 	}
 }
 
 func (s *SQLStore) InsertUser(ctx context.Context, d *User) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertUser")
+	defer span.End()
 	var id int64
-	rows, err := s.db.NamedQuery(`
+	rows, err := s.db.NamedQueryContext(ctx, `
 		INSERT INTO users (
 			username,
 			email,
+			password_hash,
 			created_at,
 			updated_at
 		) VALUES (
 			:username,
 			:email,
+			:password_hash,
 			:created_at,
 			:updated_at
 		) RETURNING id`, d)
@@ -38,7 +127,7 @@ func (s *SQLStore) InsertUser(ctx context.Context, d *User) (int64, error) {
 	if rows.Next() {
 		err = rows.Scan(&id)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 	}
 	return id, nil
@@ -50,9 +139,11 @@ func (s *SQLStore) InsertUserPage(
 	email string,
 	passwordHash string,
 ) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertUserPage")
+	defer span.End()
 	var id int64
 	timenow := time.Now()
-	row := s.db.QueryRow(`
+	row := s.db.QueryRowContext(ctx, `
 		INSERT INTO users (
 			email,
 			username,
@@ -85,8 +176,10 @@ func (s *SQLStore) UpdateUser(
 	field string,
 	value string,
 ) error {
+	ctx, span := startStoreSpan(ctx, "UpdateUser")
+	defer span.End()
 	sql := fmt.Sprintf("UPDATE users SET %s=:value WHERE id=:id", field)
-	_, err := s.db.NamedExec(sql, map[string]interface{}{
+	_, err := s.db.NamedExecContext(ctx, sql, map[string]interface{}{
 		"field": field,
 		"value": value,
 		"id":    id,
@@ -98,6 +191,8 @@ func (s *SQLStore) UpdateUser(
 }
 
 func (s *SQLStore) GetOneUser(ctx context.Context, id int64) (*User, error) {
+	ctx, span := startStoreSpan(ctx, "GetOneUser")
+	defer span.End()
 	var users []*User
 	err := s.db.SelectContext(
 		ctx,
@@ -108,6 +203,9 @@ func (s *SQLStore) GetOneUser(ctx context.Context, id int64) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(users) == 0 {
+		return nil, sql.ErrNoRows
+	}
 	return users[0], nil
 }
 
@@ -115,6 +213,8 @@ func (s *SQLStore) GetOneUserByUsername(
 	ctx context.Context,
 	username string,
 ) (*User, error) {
+	ctx, span := startStoreSpan(ctx, "GetOneUserByUsername")
+	defer span.End()
 	var users []*User
 	err := s.db.SelectContext(
 		ctx,
@@ -123,41 +223,188 @@ func (s *SQLStore) GetOneUserByUsername(
 		username,
 	)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if len(users) == 0 {
-		return nil, fmt.Errorf("no user exists with this username")
+		return nil, sql.ErrNoRows
 	}
 	return users[0], nil
 }
 
+// IsUsernameTaken reports whether a user other than userID has a username.
+func (s *SQLStore) IsUsernameTaken(
+	ctx context.Context,
+	username string,
+	userID int64,
+) (bool, error) {
+	ctx, span := startStoreSpan(ctx, "IsUsernameTaken")
+	defer span.End()
+	var count int
+	err := s.db.GetContext(
+		ctx,
+		&count,
+		`SELECT count(*) FROM users WHERE username=$1 AND id!=$2`,
+		username,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// BeginTx starts a transaction for the Tx variants of the store methods.
+func (s *SQLStore) BeginTx(ctx context.Context) (*sqlx.Tx, error) {
+	ctx, span := startStoreSpan(ctx, "BeginTx")
+	defer span.End()
+	return s.db.BeginTxx(ctx, nil)
+}
+
+// BeginDocumentTx starts a transaction over documents.
+func (s *SQLStore) BeginDocumentTx(ctx context.Context) (DocumentTx, error) {
+	tx, err := s.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlDocumentTx{store: s, tx: tx}, nil
+}
+
+// sqlDocumentTx is a DocumentTx of the Tx variants of the store methods.
+type sqlDocumentTx struct {
+	store *SQLStore
+	tx    *sqlx.Tx
+}
+
+func (t *sqlDocumentTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqlDocumentTx) Rollback() error {
+	err := t.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
+
+func (t *sqlDocumentTx) InSavepoint(
+	ctx context.Context,
+	fn func() error,
+) error {
+	return InSavepoint(ctx, t.tx, fn)
+}
+
+func (t *sqlDocumentTx) InsertDocument(
+	ctx context.Context,
+	d *Document,
+) (int64, error) {
+	return t.store.InsertDocumentTx(ctx, t.tx, d)
+}
+
+func (t *sqlDocumentTx) GetOneDocument(
+	ctx context.Context,
+	id int64,
+) (*Document, error) {
+	return t.store.GetOneDocumentTx(ctx, t.tx, id)
+}
+
+func (t *sqlDocumentTx) UpdateDocumentContent(
+	ctx context.Context,
+	id int64,
+	title *string,
+	body *string,
+	isTemplate *bool,
+	version int64,
+) (*Document, error) {
+	return t.store.UpdateDocumentContentTx(
+		ctx,
+		t.tx,
+		id,
+		title,
+		body,
+		isTemplate,
+		version,
+	)
+}
+
+func (t *sqlDocumentTx) TrashDocument(ctx context.Context, id int64) error {
+	return t.store.TrashDocumentTx(ctx, t.tx, id)
+}
+
+// InSavepoint runs fn in a savepoint of tx. If fn fails only its changes are
+// rolled back and the transaction can go on.
+func InSavepoint(ctx context.Context, tx *sqlx.Tx, fn func() error) error {
+	_, err := tx.ExecContext(ctx, "SAVEPOINT op")
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		_, rollbackErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT op")
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT op")
+	return err
+}
+
 func (s *SQLStore) InsertDocument(
 	ctx context.Context,
 	d *Document,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertDocument")
+	defer span.End()
+	return insertDocument(ctx, s.db, d)
+}
+
+// InsertDocumentTx is InsertDocument in a transaction.
+func (s *SQLStore) InsertDocumentTx(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	d *Document,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertDocumentTx")
+	defer span.End()
+	return insertDocument(ctx, tx, d)
+}
+
+// insertDocument returns the id of the new document d, and sets its version
+// to the first one.
+func insertDocument(
+	ctx context.Context,
+	q sqlx.ExtContext,
+	d *Document,
 ) (int64, error) {
 	var id int64
-	rows, err := s.db.NamedQuery(`
+	rows, err := sqlx.NamedQueryContext(ctx, q, `
 		INSERT INTO documents (
 			title,
 			body,
 			created_at,
-			updated_at
+			updated_at,
+			is_template,
+			owner_id
 		) VALUES (
 			:title,
 			:body,
 			:created_at,
-			:updated_at
-		) RETURNING id`, d)
+			:updated_at,
+			:is_template,
+			:owner_id
+		) RETURNING id, version`, d)
 	if err != nil {
 		return 0, err
 	}
+	defer rows.Close()
 	if rows.Next() {
-		err = rows.Scan(&id)
+		err = rows.Scan(&id, &d.Version)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 	}
-	return id, nil
+	return id, rows.Err()
 }
 
 func (s *SQLStore) UpdateDocument(
@@ -166,14 +413,17 @@ func (s *SQLStore) UpdateDocument(
 	field string,
 	value string,
 ) error {
+	ctx, span := startStoreSpan(ctx, "UpdateDocument")
+	defer span.End()
 	sql := fmt.Sprintf(`
 		UPDATE documents
 		SET
 			%s=:value,
+			version=version+1,
 			updated_at=now()
-		WHERE id=:id
+		WHERE id=:id AND deleted_at IS NULL
 	`, field)
-	_, err := s.db.NamedExec(sql, map[string]interface{}{
+	_, err := s.db.NamedExecContext(ctx, sql, map[string]interface{}{
 		"field": field,
 		"value": value,
 		"id":    id,
@@ -184,33 +434,223 @@ func (s *SQLStore) UpdateDocument(
 	return nil
 }
 
-func (s *SQLStore) GetAllDocument(ctx context.Context) ([]*Document, error) {
+// UpdateDocumentContent writes the title, body and template flag of a
+// document in a single transaction, leaving nil fields unchanged. Only a
+// change of the title or body makes a new version. If the document is no
+// longer at version, it returns ErrVersionConflict.
+func (s *SQLStore) UpdateDocumentContent(
+	ctx context.Context,
+	id int64,
+	title *string,
+	body *string,
+	isTemplate *bool,
+	version int64,
+) (*Document, error) {
+	ctx, span := startStoreSpan(ctx, "UpdateDocumentContent")
+	defer span.End()
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	doc, err := s.UpdateDocumentContentTx(
+		ctx,
+		tx,
+		id,
+		title,
+		body,
+		isTemplate,
+		version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// UpdateDocumentContentTx is UpdateDocumentContent in a transaction.
+func (s *SQLStore) UpdateDocumentContentTx(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	id int64,
+	title *string,
+	body *string,
+	isTemplate *bool,
+	version int64,
+) (*Document, error) {
+	ctx, span := startStoreSpan(ctx, "UpdateDocumentContentTx")
+	defer span.End()
+	var current Document
+	err := tx.GetContext(
+		ctx,
+		&current,
+		`SELECT * FROM documents
+		WHERE id=$1 AND deleted_at IS NULL
+		FOR UPDATE`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if version != current.Version {
+		return nil, ErrVersionConflict
+	}
+	changed := (title != nil && *title != current.Title) ||
+		(body != nil && *body != current.Body)
+
+	var doc Document
+	err = tx.GetContext(
+		ctx,
+		&doc,
+		`UPDATE documents
+		SET
+			title=COALESCE($1, title),
+			body=COALESCE($2, body),
+			is_template=COALESCE($3, is_template),
+			version=CASE WHEN $4 THEN version+1 ELSE version END,
+			updated_at=CASE WHEN $4 THEN now() ELSE updated_at END
+		WHERE id=$5
+		RETURNING *`,
+		title,
+		body,
+		isTemplate,
+		changed,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// GetPageDocument returns one page of documents and the cursor of the next
+// page, which is empty on the last page.
+func (s *SQLStore) GetPageDocument(
+	ctx context.Context,
+	q DocumentQuery,
+) ([]*Document, string, error) {
+	ctx, span := startStoreSpan(ctx, "GetPageDocument")
+	defer span.End()
+	if q.Sort == "" {
+		q.Sort = "title"
+	}
+	column, desc, err := parseDocumentSort(q.Sort)
+	if err != nil {
+		return nil, "", err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	// id and the sort column are always needed for the cursor
+	columns := "*"
+	if len(q.Fields) > 0 {
+		list := []string{"id"}
+		if column != "id" {
+			list = append(list, column)
+		}
+		for _, f := range q.Fields {
+			if !containsString(list, f) {
+				list = append(list, f)
+			}
+		}
+		columns = strings.Join(list, ", ")
+	}
+
+	op, order := ">", "ASC"
+	if desc {
+		op, order = "<", "DESC"
+	}
+	where := "deleted_at IS NULL"
+	var args []interface{}
+	if q.Cursor != "" {
+		value, id, err := decodeDocumentCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+		where += fmt.Sprintf(" AND (%s, id) %s ($1, $2)", column, op)
+		args = append(args, value, id)
+	}
+
 	var docs []*Document
-	err := s.db.SelectContext(
+	err = s.db.SelectContext(
 		ctx,
 		&docs,
-		`SELECT * FROM documents ORDER BY title ASC`,
+		fmt.Sprintf(
+			`SELECT %s FROM documents
+			WHERE %s
+			ORDER BY %s %s, id %s
+			LIMIT %d`,
+			columns,
+			where,
+			column,
+			order,
+			order,
+			limit+1,
+		),
+		args...,
 	)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return docs, nil
+
+	var next string
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = encodeDocumentCursor(q.Sort, docs[limit-1])
+	}
+	return docs, next, nil
 }
 
 func (s *SQLStore) GetOneDocument(
 	ctx context.Context,
 	id int64,
+) (*Document, error) {
+	ctx, span := startStoreSpan(ctx, "GetOneDocument")
+	defer span.End()
+	return getOneDocument(ctx, s.db, id)
+}
+
+// GetOneDocumentTx is GetOneDocument in a transaction.
+func (s *SQLStore) GetOneDocumentTx(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	id int64,
+) (*Document, error) {
+	ctx, span := startStoreSpan(ctx, "GetOneDocumentTx")
+	defer span.End()
+	return getOneDocument(ctx, tx, id)
+}
+
+func getOneDocument(
+	ctx context.Context,
+	q sqlx.QueryerContext,
+	id int64,
 ) (*Document, error) {
 	var docs []*Document
-	err := s.db.SelectContext(
+	err := sqlx.SelectContext(
 		ctx,
+		q,
 		&docs,
-		`SELECT * FROM documents WHERE id=$1`,
+		`SELECT * FROM documents WHERE id=$1 AND deleted_at IS NULL`,
 		id,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if len(docs) == 0 {
+		return nil, sql.ErrNoRows
+	}
 	return docs[0], nil
 }
 
@@ -218,8 +658,10 @@ func (s *SQLStore) InsertSession(
 	ctx context.Context,
 	d *Session,
 ) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertSession")
+	defer span.End()
 	var id int64
-	rows, err := s.db.NamedQuery(`
+	rows, err := s.db.NamedQueryContext(ctx, `
 		INSERT INTO sessions (
 			user_id,
 			token_hash
@@ -233,7 +675,7 @@ func (s *SQLStore) InsertSession(
 	if rows.Next() {
 		err = rows.Scan(&id)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 	}
 	return id, nil
@@ -243,6 +685,8 @@ func (s *SQLStore) GetOneSession(ctx context.Context, tokenHash string) (
 	*Session,
 	error,
 ) {
+	ctx, span := startStoreSpan(ctx, "GetOneSession")
+	defer span.End()
 	var sessions []*Session
 	err := s.db.SelectContext(
 		ctx,
@@ -254,45 +698,1356 @@ func (s *SQLStore) GetOneSession(ctx context.Context, tokenHash string) (
 		return nil, err
 	}
 	if len(sessions) == 0 {
-		return nil, fmt.Errorf("no user exists with this username")
+		return nil, sql.ErrNoRows
 	}
 	return sessions[0], nil
 }
 
-func (s *SQLStore) GetUsernameSession(
+func (s *SQLStore) GetUserSession(
 	ctx context.Context,
 	tokenHash string,
-) string {
-	type UserSession struct {
-		Username string
-	}
-	var userSessions []*UserSession
+) (*User, error) {
+	ctx, span := startStoreSpan(ctx, "GetUserSession")
+	defer span.End()
+	var users []*User
 	err := s.db.SelectContext(
 		ctx,
-		&userSessions,
-		`SELECT users.username
+		&users,
+		`SELECT users.*
 		FROM sessions JOIN users ON sessions.user_id = users.id
-		WHERE token_hash=$1`,
+		WHERE token_hash=$1 AND users.disabled_at IS NULL`,
 		tokenHash,
 	)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	if len(userSessions) == 0 {
-		return ""
+	if len(users) == 0 {
+		return nil, sql.ErrNoRows
 	}
-	return userSessions[0].Username
+	return users[0], nil
 }
 
 func (s *SQLStore) DeleteSession(ctx context.Context, tokenHash string) error {
-	_, err := s.db.Exec(`
+	ctx, span := startStoreSpan(ctx, "DeleteSession")
+	defer span.End()
+	_, err := s.db.ExecContext(ctx, `
 		DELETE FROM sessions
 		WHERE token_hash = $1`,
 		tokenHash,
 	)
 	if err != nil {
-		fmt.Println(err)
+		RequestLogger(ctx, s.logger).With(
+			zap.Error(err),
+		).Error("failed to delete session")
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStore) InsertDocumentFollow(
+	ctx context.Context,
+	userID int64,
+	documentID int64,
+) error {
+	ctx, span := startStoreSpan(ctx, "InsertDocumentFollow")
+	defer span.End()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO document_follows (
+			user_id,
+			document_id
+		) VALUES (
+			$1,
+			$2
+		) ON CONFLICT DO NOTHING`,
+		userID,
+		documentID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteDocumentFollow(
+	ctx context.Context,
+	userID int64,
+	documentID int64,
+) error {
+	ctx, span := startStoreSpan(ctx, "DeleteDocumentFollow")
+	defer span.End()
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM document_follows
+		WHERE user_id=$1 AND document_id=$2`,
+		userID,
+		documentID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStore) IsFollowingDocument(
+	ctx context.Context,
+	userID int64,
+	documentID int64,
+) (bool, error) {
+	ctx, span := startStoreSpan(ctx, "IsFollowingDocument")
+	defer span.End()
+	var count int
+	err := s.db.GetContext(
+		ctx,
+		&count,
+		`SELECT count(*) FROM document_follows
+		WHERE user_id=$1 AND document_id=$2`,
+		userID,
+		documentID,
+	)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *SQLStore) GetDocumentFollowerIDs(
+	ctx context.Context,
+	documentID int64,
+) ([]int64, error) {
+	ctx, span := startStoreSpan(ctx, "GetDocumentFollowerIDs")
+	defer span.End()
+	var ids []int64
+	err := s.db.SelectContext(
+		ctx,
+		&ids,
+		`SELECT user_id FROM document_follows WHERE document_id=$1`,
+		documentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *SQLStore) InsertNotification(
+	ctx context.Context,
+	n *Notification,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertNotification")
+	defer span.End()
+	var id int64
+	row := s.db.QueryRowContext(ctx, `
+		INSERT INTO notifications (
+			user_id,
+			actor_id,
+			document_id,
+			kind,
+			created_at
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5
+		) RETURNING id`,
+		n.UserID,
+		n.ActorID,
+		n.DocumentID,
+		n.Kind,
+		n.CreatedAt,
+	)
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *SQLStore) GetAllNotification(
+	ctx context.Context,
+	userID int64,
+) ([]*Notification, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllNotification")
+	defer span.End()
+	var notifications []*Notification
+	err := s.db.SelectContext(
+		ctx,
+		&notifications,
+		`SELECT
+			notifications.*,
+			users.username AS actor_username,
+			documents.title AS document_title
+		FROM notifications
+		JOIN users ON notifications.actor_id = users.id
+		JOIN documents ON notifications.document_id = documents.id
+		WHERE notifications.user_id=$1 AND documents.deleted_at IS NULL
+		ORDER BY notifications.created_at DESC
+		LIMIT 100`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (s *SQLStore) CountUnreadNotification(
+	ctx context.Context,
+	userID int64,
+) (int, error) {
+	ctx, span := startStoreSpan(ctx, "CountUnreadNotification")
+	defer span.End()
+	var count int
+	err := s.db.GetContext(
+		ctx,
+		&count,
+		`SELECT count(*) FROM notifications
+		WHERE user_id=$1 AND read_at IS NULL`,
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *SQLStore) MarkAllNotificationRead(
+	ctx context.Context,
+	userID int64,
+) error {
+	ctx, span := startStoreSpan(ctx, "MarkAllNotificationRead")
+	defer span.End()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE notifications
+		SET read_at=now()
+		WHERE user_id=$1 AND read_at IS NULL`,
+		userID,
+	)
+	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func (s *SQLStore) InsertDocumentEvent(
+	ctx context.Context,
+	e *DocumentEvent,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertDocumentEvent")
+	defer span.End()
+	var id int64
+	actorID := sql.NullInt64{Int64: e.ActorID, Valid: e.ActorID != 0}
+	row := s.db.QueryRowContext(ctx, `
+		INSERT INTO document_events (
+			document_id,
+			actor_id,
+			kind,
+			created_at
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4
+		) RETURNING id`,
+		e.DocumentID,
+		actorID,
+		e.Kind,
+		e.CreatedAt,
+	)
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetDigestEvents returns the events a user's digest covers since a time:
+// changes to documents they follow and new documents, except their own.
+func (s *SQLStore) GetDigestEvents(
+	ctx context.Context,
+	userID int64,
+	since time.Time,
+) ([]*DocumentEvent, error) {
+	ctx, span := startStoreSpan(ctx, "GetDigestEvents")
+	defer span.End()
+	var events []*DocumentEvent
+	err := s.db.SelectContext(
+		ctx,
+		&events,
+		`SELECT
+			document_events.id,
+			document_events.document_id,
+			COALESCE(document_events.actor_id, 0) AS actor_id,
+			document_events.kind,
+			document_events.created_at,
+			COALESCE(users.username, '') AS actor_username,
+			documents.title AS document_title
+		FROM document_events
+		JOIN documents ON document_events.document_id = documents.id
+		LEFT JOIN users ON document_events.actor_id = users.id
+		WHERE document_events.created_at > $2
+		AND documents.deleted_at IS NULL
+		AND (
+			document_events.actor_id IS NULL
+			OR document_events.actor_id != $1
+		)
+		AND (
+			document_events.kind = 'created'
+			OR document_events.document_id IN (
+				SELECT document_id FROM document_follows WHERE user_id=$1
+			)
+		)
+		ORDER BY document_events.created_at ASC`,
+		userID,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *SQLStore) GetAllUserWithDigest(ctx context.Context) ([]*User, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllUserWithDigest")
+	defer span.End()
+	var users []*User
+	err := s.db.SelectContext(
+		ctx,
+		&users,
+		`SELECT * FROM users
+		WHERE digest_frequency != 'off' AND disabled_at IS NULL`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *SQLStore) UpdateUserDigestSentAt(
+	ctx context.Context,
+	id int64,
+	sentAt time.Time,
+) error {
+	ctx, span := startStoreSpan(ctx, "UpdateUserDigestSentAt")
+	defer span.End()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET digest_sent_at=$1
+		WHERE id=$2`,
+		sentAt,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetDocumentTemplate marks a document as a template for new documents, or
+// unmarks it.
+func (s *SQLStore) SetDocumentTemplate(
+	ctx context.Context,
+	id int64,
+	isTemplate bool,
+) error {
+	ctx, span := startStoreSpan(ctx, "SetDocumentTemplate")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE documents
+		SET is_template=$1
+		WHERE id=$2 AND deleted_at IS NULL`,
+		isTemplate,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func (s *SQLStore) GetAllTemplateDocument(
+	ctx context.Context,
+) ([]*Document, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllTemplateDocument")
+	defer span.End()
+	var docs []*Document
+	err := s.db.SelectContext(
+		ctx,
+		&docs,
+		`SELECT * FROM documents
+		WHERE is_template AND deleted_at IS NULL
+		ORDER BY title ASC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// TrashDocument marks a document as deleted. It stays in the trash until it
+// is restored or purged.
+func (s *SQLStore) TrashDocument(ctx context.Context, id int64) error {
+	ctx, span := startStoreSpan(ctx, "TrashDocument")
+	defer span.End()
+	return trashDocument(ctx, s.db, id)
+}
+
+// TrashDocumentTx is TrashDocument in a transaction.
+func (s *SQLStore) TrashDocumentTx(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	id int64,
+) error {
+	ctx, span := startStoreSpan(ctx, "TrashDocumentTx")
+	defer span.End()
+	return trashDocument(ctx, tx, id)
+}
+
+func trashDocument(ctx context.Context, e sqlx.ExecerContext, id int64) error {
+	res, err := e.ExecContext(ctx, `
+		UPDATE documents
+		SET deleted_at=now()
+		WHERE id=$1 AND deleted_at IS NULL`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// RestoreDocument takes a document out of the trash. If owner is not nil the
+// document has to be theirs, or ErrNotOwner is returned.
+func (s *SQLStore) RestoreDocument(
+	ctx context.Context,
+	id int64,
+	owner *int64,
+) error {
+	ctx, span := startStoreSpan(ctx, "RestoreDocument")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE documents
+		SET deleted_at=NULL
+		WHERE id=$1 AND deleted_at IS NOT NULL
+		AND ($2::bigint IS NULL OR owner_id=$2)`,
+		id,
+		owner,
+	)
+	if err != nil {
+		return err
+	}
+	err = expectAffected(res)
+	if errors.Is(err, sql.ErrNoRows) && owner != nil {
+		return s.trashedDocumentMissing(ctx, id)
+	}
+	return err
+}
+
+// GetAllTrashedDocument returns the documents in the trash, newest first. If
+// owner is not nil only the documents they own are returned.
+func (s *SQLStore) GetAllTrashedDocument(
+	ctx context.Context,
+	owner *int64,
+) ([]*Document, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllTrashedDocument")
+	defer span.End()
+	var docs []*Document
+	err := s.db.SelectContext(
+		ctx,
+		&docs,
+		`SELECT * FROM documents
+		WHERE deleted_at IS NOT NULL
+		AND ($1::bigint IS NULL OR owner_id=$1)
+		ORDER BY deleted_at DESC`,
+		owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// PurgeDocument permanently deletes a trashed document along with its
+// follows, notifications and events. If owner is not nil the document has
+// to be theirs, or ErrNotOwner is returned.
+func (s *SQLStore) PurgeDocument(
+	ctx context.Context,
+	id int64,
+	owner *int64,
+) error {
+	ctx, span := startStoreSpan(ctx, "PurgeDocument")
+	defer span.End()
+	n, err := s.purgeDocuments(
+		ctx,
+		`SELECT id FROM documents
+		WHERE id=$1 AND deleted_at IS NOT NULL
+		AND ($2::bigint IS NULL OR owner_id=$2)`,
+		id,
+		owner,
+	)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	if owner == nil {
+		return sql.ErrNoRows
+	}
+	return s.trashedDocumentMissing(ctx, id)
+}
+
+// trashedDocumentMissing tells why a trashed document was not found for an
+// owner: ErrNotOwner if someone else owns it, sql.ErrNoRows if there is none.
+func (s *SQLStore) trashedDocumentMissing(ctx context.Context, id int64) error {
+	var exists bool
+	err := s.db.GetContext(
+		ctx,
+		&exists,
+		`SELECT EXISTS(
+			SELECT 1 FROM documents WHERE id=$1 AND deleted_at IS NOT NULL
+		)`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrNotOwner
+	}
+	return sql.ErrNoRows
+}
+
+// PurgeTrashedDocumentBefore permanently deletes documents trashed before a
+// time and returns how many were deleted.
+func (s *SQLStore) PurgeTrashedDocumentBefore(
+	ctx context.Context,
+	before time.Time,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "PurgeTrashedDocumentBefore")
+	defer span.End()
+	return s.purgeDocuments(
+		ctx,
+		`SELECT id FROM documents WHERE deleted_at < $1`,
+		before,
+	)
+}
+
+func (s *SQLStore) purgeDocuments(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "purgeDocuments")
+	defer span.End()
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var ids []int64
+	err = tx.SelectContext(ctx, &ids, query+" FOR UPDATE", args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	for _, table := range []string{
+		"document_follows",
+		"notifications",
+		"document_events",
+	} {
+		_, err = tx.ExecContext(
+			ctx,
+			"DELETE FROM "+table+" WHERE document_id = ANY($1)",
+			pq.Array(ids),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM documents WHERE id = ANY($1)",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+// expectAffected returns sql.ErrNoRows if an update matched no rows.
+func expectAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetAllUserByID returns the users with the given ids, in no particular
+// order. Missing ids are left out.
+func (s *SQLStore) GetAllUserByID(
+	ctx context.Context,
+	ids []int64,
+) ([]*User, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllUserByID")
+	defer span.End()
+	var users []*User
+	err := s.db.SelectContext(
+		ctx,
+		&users,
+		`SELECT * FROM users WHERE id = ANY($1)`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetDocumentAuthors returns the users who created the given documents,
+// keyed by document id. Documents created anonymously are left out.
+func (s *SQLStore) GetDocumentAuthors(
+	ctx context.Context,
+	documentIDs []int64,
+) (map[int64]*User, error) {
+	ctx, span := startStoreSpan(ctx, "GetDocumentAuthors")
+	defer span.End()
+	var rows []struct {
+		DocumentID int64 `db:"document_id"`
+		User
+	}
+	err := s.db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT document_events.document_id, users.*
+		FROM document_events
+		JOIN users ON document_events.actor_id = users.id
+		WHERE document_events.kind = 'created'
+		AND document_events.document_id = ANY($1)`,
+		pq.Array(documentIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	authors := map[int64]*User{}
+	for i := range rows {
+		authors[rows[i].DocumentID] = &rows[i].User
+	}
+	return authors, nil
+}
+
+// GetDocumentBacklinks returns the documents whose body links to each of the
+// given documents with a /docs/{id} url, keyed by the linked document id.
+func (s *SQLStore) GetDocumentBacklinks(
+	ctx context.Context,
+	documentIDs []int64,
+) (map[int64][]*Document, error) {
+	ctx, span := startStoreSpan(ctx, "GetDocumentBacklinks")
+	defer span.End()
+	var rows []struct {
+		TargetID int64 `db:"target_id"`
+		Document
+	}
+	err := s.db.SelectContext(
+		ctx,
+		&rows,
+		`SELECT targets.id AS target_id, documents.*
+		FROM unnest($1::int[]) AS targets(id)
+		JOIN documents ON documents.id != targets.id
+		AND documents.deleted_at IS NULL
+		AND documents.body ~ ('/docs/' || targets.id || '([^0-9]|$)')
+		ORDER BY documents.updated_at DESC`,
+		pq.Array(documentIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	backlinks := map[int64][]*Document{}
+	for i := range rows {
+		backlinks[rows[i].TargetID] = append(
+			backlinks[rows[i].TargetID],
+			&rows[i].Document,
+		)
+	}
+	return backlinks, nil
+}
+
+// GetRecentDocumentEvents returns up to limit of the latest events of each of
+// the given documents, newest first.
+func (s *SQLStore) GetRecentDocumentEvents(
+	ctx context.Context,
+	documentIDs []int64,
+	limit int,
+) ([]*DocumentEvent, error) {
+	ctx, span := startStoreSpan(ctx, "GetRecentDocumentEvents")
+	defer span.End()
+	var events []*DocumentEvent
+	err := s.db.SelectContext(
+		ctx,
+		&events,
+		`SELECT
+			recent.id,
+			recent.document_id,
+			COALESCE(recent.actor_id, 0) AS actor_id,
+			recent.kind,
+			recent.created_at,
+			COALESCE(users.username, '') AS actor_username,
+			documents.title AS document_title
+		FROM (
+			SELECT
+				document_events.*,
+				row_number() OVER (
+					PARTITION BY document_id
+					ORDER BY created_at DESC, id DESC
+				) AS n
+			FROM document_events
+			WHERE document_id = ANY($1)
+		) AS recent
+		JOIN documents ON recent.document_id = documents.id
+		LEFT JOIN users ON recent.actor_id = users.id
+		WHERE recent.n <= $2
+		ORDER BY recent.created_at DESC, recent.id DESC`,
+		pq.Array(documentIDs),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// isUniqueViolation reports whether err is postgres refusing a duplicate
+// value of a unique column.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// Ping checks that the database is reachable.
+func (s *SQLStore) Ping(ctx context.Context) error {
+	ctx, span := startStoreSpan(ctx, "Ping")
+	defer span.End()
+	return s.db.PingContext(ctx)
+}
+
+// GetMissingColumn returns the columns, as table.column, of want that the
+// database schema does not have.
+func (s *SQLStore) GetMissingColumn(
+	ctx context.Context,
+	want map[string][]string,
+) ([]string, error) {
+	ctx, span := startStoreSpan(ctx, "GetMissingColumn")
+	defer span.End()
+	var columns []struct {
+		Table  string `db:"table_name"`
+		Column string `db:"column_name"`
+	}
+	err := s.db.SelectContext(
+		ctx,
+		&columns,
+		`SELECT table_name, column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema()`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for _, c := range columns {
+		have[c.Table+"."+c.Column] = true
+	}
+	var missing []string
+	for table, cols := range want {
+		for _, col := range cols {
+			if !have[table+"."+col] {
+				missing = append(missing, table+"."+col)
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// StoreCounts are the numbers of rows reported as metrics.
+type StoreCounts struct {
+	Sessions          int `db:"sessions"`
+	Users             int `db:"users"`
+	Documents         int `db:"documents"`
+	TemplateDocuments int `db:"template_documents"`
+	TrashedDocuments  int `db:"trashed_documents"`
+}
+
+// GetCounts counts sessions, users and documents in one query.
+func (s *SQLStore) GetCounts(ctx context.Context) (*StoreCounts, error) {
+	ctx, span := startStoreSpan(ctx, "GetCounts")
+	defer span.End()
+	var counts StoreCounts
+	err := s.db.GetContext(
+		ctx,
+		&counts,
+		`SELECT
+			(SELECT count(*) FROM sessions) AS sessions,
+			(SELECT count(*) FROM users) AS users,
+			count(*) FILTER (
+				WHERE deleted_at IS NULL AND NOT is_template
+			) AS documents,
+			count(*) FILTER (
+				WHERE deleted_at IS NULL AND is_template
+			) AS template_documents,
+			count(*) FILTER (
+				WHERE deleted_at IS NOT NULL
+			) AS trashed_documents
+		FROM documents`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
+
+func (s *SQLStore) InsertLoginAttempt(
+	ctx context.Context,
+	a *LoginAttempt,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertLoginAttempt")
+	defer span.End()
+	var id int64
+	err := s.db.GetContext(
+		ctx,
+		&id,
+		`INSERT INTO login_attempts (username, ip, succeeded, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		a.Username,
+		a.IP,
+		a.Succeeded,
+		a.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// TryLockLogin takes the advisory locks of logging in as username and from
+// ip, in a transaction that holds them until it ends. If another attempt
+// holds either, it returns false and no transaction.
+func (s *SQLStore) TryLockLogin(
+	ctx context.Context,
+	username string,
+	ip string,
+) (*sqlx.Tx, bool, error) {
+	ctx, span := startStoreSpan(ctx, "TryLockLogin")
+	defer span.End()
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	var locked bool
+	err = tx.GetContext(
+		ctx,
+		&locked,
+		`SELECT pg_try_advisory_xact_lock(hashtext('login:user:' || $1))
+		AND pg_try_advisory_xact_lock(hashtext('login:ip:' || $2))`,
+		username,
+		ip,
+	)
+	if err != nil || !locked {
+		tx.Rollback() //nolint:errcheck
+		return nil, false, err
+	}
+	return tx, true, nil
+}
+
+// LoginFailures counts failed logins and has the time of the latest.
+type LoginFailures struct {
+	Count  int        `db:"count"`
+	LastAt *time.Time `db:"last_at"`
+}
+
+// GetLoginFailuresByUsername counts the failed logins as username since
+// the later of since and its last successful login.
+func (s *SQLStore) GetLoginFailuresByUsername(
+	ctx context.Context,
+	username string,
+	since time.Time,
+) (*LoginFailures, error) {
+	ctx, span := startStoreSpan(ctx, "GetLoginFailuresByUsername")
+	defer span.End()
+	var failures LoginFailures
+	err := s.db.GetContext(
+		ctx,
+		&failures,
+		`SELECT count(*) AS count, max(created_at) AS last_at
+		FROM login_attempts
+		WHERE username = $1 AND NOT succeeded AND created_at > greatest(
+			$2,
+			(
+				SELECT max(created_at) FROM login_attempts
+				WHERE username = $1 AND succeeded
+			)
+		)`,
+		username,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &failures, nil
+}
+
+// GetLoginFailuresByIP counts the failed logins from ip since since.
+func (s *SQLStore) GetLoginFailuresByIP(
+	ctx context.Context,
+	ip string,
+	since time.Time,
+) (*LoginFailures, error) {
+	ctx, span := startStoreSpan(ctx, "GetLoginFailuresByIP")
+	defer span.End()
+	var failures LoginFailures
+	err := s.db.GetContext(
+		ctx,
+		&failures,
+		`SELECT count(*) AS count, max(created_at) AS last_at
+		FROM login_attempts
+		WHERE ip = $1 AND NOT succeeded AND created_at > $2`,
+		ip,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &failures, nil
+}
+
+func (s *SQLStore) InsertAuditEvent(
+	ctx context.Context,
+	e *AuditEvent,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "InsertAuditEvent")
+	defer span.End()
+	var id int64
+	rows, err := s.db.NamedQueryContext(ctx, `
+		INSERT INTO audit_events (
+			actor_id,
+			actor_username,
+			kind,
+			target_type,
+			target_id,
+			ip,
+			user_agent,
+			before,
+			after,
+			created_at
+		) VALUES (
+			:actor_id,
+			:actor_username,
+			:kind,
+			:target_type,
+			:target_id,
+			:ip,
+			:user_agent,
+			:before,
+			:after,
+			:created_at
+		) RETURNING id`, e)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, rows.Err()
+}
+
+// AuditQuery filters the audit log. Zero fields do not filter.
+type AuditQuery struct {
+	Kind          string
+	ActorUsername string
+	TargetType    string
+	TargetID      int64
+	IP            string
+	From          time.Time
+	To            time.Time
+	// BeforeID pages back through events older than the event with it.
+	BeforeID int64
+	Limit    int
+}
+
+// where returns the conditions of q and their arguments.
+func (q AuditQuery) where() (string, []interface{}) {
+	conds := []string{"true"}
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if q.Kind != "" {
+		add("kind = $%d", q.Kind)
+	}
+	if q.ActorUsername != "" {
+		add("actor_username = $%d", q.ActorUsername)
+	}
+	if q.TargetType != "" {
+		add("target_type = $%d", q.TargetType)
+	}
+	if q.TargetID != 0 {
+		add("target_id = $%d", q.TargetID)
+	}
+	if q.IP != "" {
+		add("ip = $%d", q.IP)
+	}
+	if !q.From.IsZero() {
+		add("created_at >= $%d", q.From)
+	}
+	if !q.To.IsZero() {
+		add("created_at < $%d", q.To)
+	}
+	if q.BeforeID != 0 {
+		add("id < $%d", q.BeforeID)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// GetAllAuditEvent returns the events matching q, newest first.
+func (s *SQLStore) GetAllAuditEvent(
+	ctx context.Context,
+	q AuditQuery,
+) ([]*AuditEvent, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllAuditEvent")
+	defer span.End()
+	var events []*AuditEvent
+	err := s.EachAuditEvent(ctx, q, func(e *AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// EachAuditEvent calls fn with every event matching q, newest first,
+// without holding them all in memory.
+func (s *SQLStore) EachAuditEvent(
+	ctx context.Context,
+	q AuditQuery,
+	fn func(*AuditEvent) error,
+) error {
+	ctx, span := startStoreSpan(ctx, "EachAuditEvent")
+	defer span.End()
+	where, args := q.where()
+	query := fmt.Sprintf(
+		`SELECT * FROM audit_events WHERE %s ORDER BY id DESC`,
+		where,
+	)
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	rows, err := s.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEvent
+		err = rows.StructScan(&e)
+		if err != nil {
+			return err
+		}
+		err = fn(&e)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// AdminUser is a user as the admin area lists them, with their sessions and
+// the documents they own.
+type AdminUser struct {
+	User
+	Sessions  int `db:"sessions"`
+	Documents int `db:"documents"`
+}
+
+// adminUserSelect selects users as AdminUser.
+const adminUserSelect = `SELECT users.*,
+	(SELECT count(*) FROM sessions WHERE sessions.user_id = users.id)
+		AS sessions,
+	(SELECT count(*) FROM documents
+		WHERE documents.owner_id = users.id AND deleted_at IS NULL)
+		AS documents
+	FROM users`
+
+// UserQuery filters and pages the users of the admin area.
+type UserQuery struct {
+	// Search matches part of the username or email.
+	Search string
+	// After pages on to the users after this username.
+	After string
+	Limit int
+}
+
+// GetAllAdminUser returns the users matching q, by username.
+func (s *SQLStore) GetAllAdminUser(
+	ctx context.Context,
+	q UserQuery,
+) ([]*AdminUser, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllAdminUser")
+	defer span.End()
+	pattern := "%" + likeEscaper.Replace(q.Search) + "%"
+	var users []*AdminUser
+	err := s.db.SelectContext(
+		ctx,
+		&users,
+		adminUserSelect+`
+		WHERE (username ILIKE $1 OR email ILIKE $1) AND username > $2
+		ORDER BY username
+		LIMIT $3`,
+		pattern,
+		q.After,
+		q.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *SQLStore) GetOneAdminUser(
+	ctx context.Context,
+	id int64,
+) (*AdminUser, error) {
+	ctx, span := startStoreSpan(ctx, "GetOneAdminUser")
+	defer span.End()
+	var user AdminUser
+	err := s.db.GetContext(ctx, &user, adminUserSelect+` WHERE id=$1`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetUserDisabled disables a user since disabledAt, or enables them again
+// if it is nil.
+func (s *SQLStore) SetUserDisabled(
+	ctx context.Context,
+	id int64,
+	disabledAt *time.Time,
+) error {
+	ctx, span := startStoreSpan(ctx, "SetUserDisabled")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET disabled_at=$1
+		WHERE id=$2`,
+		disabledAt,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func (s *SQLStore) SetUserAdmin(
+	ctx context.Context,
+	id int64,
+	isAdmin bool,
+) error {
+	ctx, span := startStoreSpan(ctx, "SetUserAdmin")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET is_admin=$1
+		WHERE id=$2`,
+		isAdmin,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// RequireUserPasswordReset replaces the password of a user with a temporary
+// one, which they have to change the next time they log in.
+func (s *SQLStore) RequireUserPasswordReset(
+	ctx context.Context,
+	id int64,
+	passwordHash string,
+) error {
+	ctx, span := startStoreSpan(ctx, "RequireUserPasswordReset")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET password_hash=$1, password_reset_required=true, updated_at=$2
+		WHERE id=$3`,
+		passwordHash,
+		time.Now(),
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// UpdateUserPassword sets the password hash of a user, which satisfies a
+// required password reset.
+func (s *SQLStore) UpdateUserPassword(
+	ctx context.Context,
+	id int64,
+	passwordHash string,
+) error {
+	ctx, span := startStoreSpan(ctx, "UpdateUserPassword")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET password_hash=$1, password_reset_required=false, updated_at=$2
+		WHERE id=$3`,
+		passwordHash,
+		time.Now(),
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// DeleteAllUserSession logs a user out everywhere, except for the session
+// with keepTokenHash if it is not empty. It returns how many sessions it
+// deleted.
+func (s *SQLStore) DeleteAllUserSession(
+	ctx context.Context,
+	userID int64,
+	keepTokenHash string,
+) (int64, error) {
+	ctx, span := startStoreSpan(ctx, "DeleteAllUserSession")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE user_id=$1 AND token_hash!=$2`,
+		userID,
+		keepTokenHash,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetAllDocumentByOwner returns the documents a user owns, by title.
+func (s *SQLStore) GetAllDocumentByOwner(
+	ctx context.Context,
+	ownerID int64,
+) ([]*Document, error) {
+	ctx, span := startStoreSpan(ctx, "GetAllDocumentByOwner")
+	defer span.End()
+	var docs []*Document
+	err := s.db.SelectContext(
+		ctx,
+		&docs,
+		`SELECT * FROM documents
+		WHERE owner_id=$1 AND deleted_at IS NULL
+		ORDER BY title, id`,
+		ownerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// SetDocumentOwner gives a document to another user.
+func (s *SQLStore) SetDocumentOwner(
+	ctx context.Context,
+	id int64,
+	ownerID int64,
+) error {
+	ctx, span := startStoreSpan(ctx, "SetDocumentOwner")
+	defer span.End()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE documents
+		SET owner_id=$1
+		WHERE id=$2 AND deleted_at IS NULL`,
+		ownerID,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+// AdminStats are the users and storage of the admin area, beside the counts
+// of GetCounts.
+type AdminStats struct {
+	Admins             int   `db:"admins"`
+	DisabledUsers      int   `db:"disabled_users"`
+	OwnerlessDocuments int   `db:"ownerless_documents"`
+	DocumentBytes      int64 `db:"document_bytes"`
+	DatabaseBytes      int64 `db:"database_bytes"`
+	Tables             []*TableSize
+}
+
+// TableSize is the size on disk of a table, with its indexes.
+type TableSize struct {
+	Name  string `db:"name"`
+	Bytes int64  `db:"bytes"`
+}
+
+func (s *SQLStore) GetAdminStats(ctx context.Context) (*AdminStats, error) {
+	ctx, span := startStoreSpan(ctx, "GetAdminStats")
+	defer span.End()
+	var stats AdminStats
+	err := s.db.GetContext(
+		ctx,
+		&stats,
+		`SELECT
+			(SELECT count(*) FROM users WHERE is_admin) AS admins,
+			(SELECT count(*) FROM users WHERE disabled_at IS NOT NULL)
+				AS disabled_users,
+			(SELECT count(*) FROM documents WHERE owner_id IS NULL)
+				AS ownerless_documents,
+			(SELECT coalesce(sum(octet_length(body)), 0) FROM documents)
+				AS document_bytes,
+			pg_database_size(current_database()) AS database_bytes`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.SelectContext(
+		ctx,
+		&stats.Tables,
+		`SELECT relname AS name, pg_total_relation_size(relid) AS bytes
+		FROM pg_catalog.pg_statio_user_tables
+		ORDER BY bytes DESC, name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// TemplateFS returns the templates built into the binary.
+func TemplateFS() fs.FS {
+	sub, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Templates holds the parsed page and email templates. Pages are named by
+// their file and parsed together with layout.html, emails by their path
+// under email/ and parsed on their own.
+type Templates struct {
+	fsys   fs.FS
+	reload bool
+	// integrity is the subresource integrity of static files by their path
+	// under /static/, see LoadAssetIntegrity
+	integrity map[string]string
+	html      map[string]*template.Template
+	text      map[string]*texttemplate.Template
+}
+
+// NewTemplates parses all templates in fsys. With reload, which is meant for
+// development, templates are parsed again from fsys every time they are
+// used so that changes show without a restart. Pages link to static files
+// with the integrity given for them, if any.
+func NewTemplates(
+	fsys fs.FS,
+	reload bool,
+	integrity map[string]string,
+) (*Templates, error) {
+	t := &Templates{
+		fsys:      fsys,
+		reload:    reload,
+		integrity: integrity,
+		html:      map[string]*template.Template{},
+		text:      map[string]*texttemplate.Template{},
+	}
+	pages, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	emails, err := fs.Glob(fsys, "email/*.html")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(pages, emails...) {
+		if name == "layout.html" {
+			continue
+		}
+		t.html[name], err = t.parseHTML(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	texts, err := fs.Glob(fsys, "email/*.txt")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range texts {
+		t.text[name], err = texttemplate.ParseFS(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Templates) parseHTML(name string) (*template.Template, error) {
+	if strings.HasPrefix(name, "email/") {
+		return template.ParseFS(t.fsys, name)
+	}
+	return template.New("layout.html").
+		Funcs(template.FuncMap{"integrity": t.assetIntegrity}).
+		ParseFS(t.fsys, "layout.html", name)
+}
+
+// assetIntegrity returns the integrity of a static file by its path under
+// /static/, or an empty string if it is not known.
+func (t *Templates) assetIntegrity(path string) string {
+	return t.integrity[path]
+}
+
+// HTML returns a page or an HTML email template.
+func (t *Templates) HTML(name string) (*template.Template, error) {
+	if t.reload {
+		return t.parseHTML(name)
+	}
+	tmpl, ok := t.html[name]
+	if !ok {
+		return nil, fmt.Errorf("template %s not found", name)
+	}
+	return tmpl, nil
+}
+
+// Text returns a plain text email template.
+func (t *Templates) Text(name string) (*texttemplate.Template, error) {
+	if t.reload {
+		return texttemplate.ParseFS(t.fsys, name)
+	}
+	tmpl, ok := t.text[name]
+	if !ok {
+		return nil, fmt.Errorf("template %s not found", name)
+	}
+	return tmpl, nil
+}
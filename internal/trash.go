@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RunTrashPurge permanently deletes documents that have been in the trash for
+// longer than retention, checking every interval until ctx is done.
+func RunTrashPurge(
+	ctx context.Context,
+	store *SQLStore,
+	retention time.Duration,
+	interval time.Duration,
+	logger *zap.Logger,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := store.PurgeTrashedDocumentBefore(ctx, time.Now().Add(-retention))
+		if err != nil {
+			logger.With(
+				zap.Error(err),
+			).Error("failed to purge trash")
+		} else if n > 0 {
+			logger.With(
+				zap.Int64("documents", n),
+			).Info("purged trash")
+			// done by no one, so the event has no actor or target id
+			recordAudit(ctx, store, logger, &AuditEvent{
+				Kind:       AuditDocumentPurged,
+				TargetType: AuditTargetDocument,
+				After: auditSummary(map[string]interface{}{
+					"documents": n,
+					"retention": retention.String(),
+				}),
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"net/mail"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	// MaxTitleLength matches documents.title VARCHAR(300).
+	MaxTitleLength = 300
+	// MaxEmailLength matches users.email VARCHAR(300).
+	MaxEmailLength    = 300
+	MaxUsernameLength = 64
+	MinPasswordLength = 8
+)
+
+// usernameRegexp allows letters, digits, underscores, dots and dashes, not
+// starting or ending with a dot or a dash, so that usernames can be
+// @mentioned.
+var usernameRegexp = regexp.MustCompile(
+	`^[A-Za-z0-9_](?:[A-Za-z0-9_.-]*[A-Za-z0-9_])?$`,
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors are the problems found with the fields of a request.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	if len(v) == 0 {
+		return "validation failed"
+	}
+	return v[0].Field + ": " + v[0].Message
+}
+
+func (v *ValidationErrors) add(field string, message string) {
+	*v = append(*v, FieldError{Field: field, Message: message})
+}
+
+// ByField returns the first message for each field, for templates.
+func (v ValidationErrors) ByField() map[string]string {
+	m := map[string]string{}
+	for _, e := range v {
+		if _, ok := m[e.Field]; !ok {
+			m[e.Field] = e.Message
+		}
+	}
+	return m
+}
+
+func validateTitle(v *ValidationErrors, title string) {
+	if title == "" {
+		v.add("title", "title is required")
+	} else if utf8.RuneCountInString(title) > MaxTitleLength {
+		v.add("title", "title must be at most 300 characters")
+	}
+}
+
+func validateBody(v *ValidationErrors, body string) {
+	if body == "" {
+		v.add("body", "body is required")
+	}
+}
+
+// ValidateDocument checks the title and body of a new or edited document.
+func ValidateDocument(title string, body string) ValidationErrors {
+	var v ValidationErrors
+	validateTitle(&v, title)
+	validateBody(&v, body)
+	return v
+}
+
+func validateEmail(v *ValidationErrors, email string) {
+	if email == "" {
+		v.add("email", "email is required")
+		return
+	}
+	if len(email) > MaxEmailLength {
+		v.add("email", "email must be at most 300 characters")
+		return
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		v.add("email", "email is not a valid address")
+	}
+}
+
+func validateUsername(
+	ctx context.Context,
+	store Store,
+	v *ValidationErrors,
+	username string,
+	userID int64,
+) error {
+	if username == "" {
+		v.add("username", "username is required")
+		return nil
+	}
+	if len(username) > MaxUsernameLength {
+		v.add("username", "username must be at most 64 characters")
+		return nil
+	}
+	if !usernameRegexp.MatchString(username) {
+		v.add(
+			"username",
+			"username can only have letters, digits, _, . and -",
+		)
+		return nil
+	}
+	taken, err := store.IsUsernameTaken(ctx, username, userID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		v.add("username", "username is already taken")
+	}
+	return nil
+}
+
+// ValidateUser checks the username and email of a new user, or of an
+// existing user with userID when only some fields change. Nil fields are not
+// checked.
+func ValidateUser(
+	ctx context.Context,
+	store Store,
+	userID int64,
+	username *string,
+	email *string,
+) (ValidationErrors, error) {
+	var v ValidationErrors
+	if username != nil {
+		err := validateUsername(ctx, store, &v, *username, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if email != nil {
+		validateEmail(&v, *email)
+	}
+	return v, nil
+}
+
+// ValidatePassword checks a new password and its confirmation.
+func ValidatePassword(password string, confirmation string) ValidationErrors {
+	var v ValidationErrors
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		v.add("password1", "password must be at least 8 characters")
+	} else if password != confirmation {
+		v.add("password2", "passwords do not match")
+	}
+	return v
+}
@@ -0,0 +1,436 @@
+// Package client is a typed client for the lakehouse HTTP API, as described
+// by /api/v1/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Document struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	IsTemplate bool `json:"is_template"`
+}
+
+type User struct {
+	ID              int64     `json:"id"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email"`
+	DigestFrequency string    `json:"digest_frequency"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type Notification struct {
+	ID            int64      `json:"id"`
+	Kind          string     `json:"kind"`
+	DocumentID    int64      `json:"document_id"`
+	DocumentTitle string     `json:"document_title"`
+	ActorID       int64      `json:"actor_id"`
+	ActorUsername string     `json:"actor_username"`
+	ReadAt        *time.Time `json:"read_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is returned for every response with a 4xx or 5xx status.
+type Error struct {
+	StatusCode int
+	Code       string       `json:"code"`
+	Message    string       `json:"message"`
+	Details    []FieldError `json:"details"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("lakehouse: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// ConflictError is returned when a document update is based on a version
+// that is no longer current.
+type ConflictError struct {
+	Err     *Error
+	Current *Document
+}
+
+func (e *ConflictError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned when an all_or_nothing batch is rolled back. The
+// result of the operation that failed has its error, the others have
+// status 424.
+type BatchError struct {
+	Err     *Error
+	Results []*BatchResult
+}
+
+func (e *BatchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ListOptions selects a page of documents. Zero values use the server
+// defaults.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string
+	Fields []string
+}
+
+// DocumentPage is one page of documents. NextCursor is empty on the last
+// page.
+type DocumentPage struct {
+	Documents  []*Document
+	NextCursor string
+}
+
+// DocumentUpdate changes the fields that are not nil. Version is the
+// version the update is based on and is required; the update fails with a
+// *ConflictError when the document has changed since.
+type DocumentUpdate struct {
+	Title      *string `json:"title,omitempty"`
+	Body       *string `json:"body,omitempty"`
+	Version    int64   `json:"version,omitempty"`
+	IsTemplate *bool   `json:"is_template,omitempty"`
+}
+
+// UserUpdate changes the fields that are not nil.
+type UserUpdate struct {
+	Username *string `json:"username,omitempty"`
+	Email    *string `json:"email,omitempty"`
+}
+
+const (
+	BatchAllOrNothing = "all_or_nothing"
+	BatchBestEffort   = "best_effort"
+)
+
+// BatchOperation creates, updates or deletes a document. Op is "create",
+// "update" or "delete"; ID is needed to update and delete.
+type BatchOperation struct {
+	Op      string  `json:"op"`
+	ID      int64   `json:"id,omitempty"`
+	Title   *string `json:"title,omitempty"`
+	Body    *string `json:"body,omitempty"`
+	Version int64   `json:"version,omitempty"`
+}
+
+// BatchResult is the outcome of one operation. Error is nil if it
+// succeeded.
+type BatchResult struct {
+	Status   int       `json:"status"`
+	Document *Document `json:"document"`
+	Error    *Error    `json:"error"`
+}
+
+type Client struct {
+	// BaseURL is the address of the server, like https://lakehousedocs.com.
+	BaseURL string
+	// SessionToken is the value of the session cookie, sent as a bearer
+	// token, for endpoints that need a logged in user.
+	SessionToken string
+	// HTTPClient is used for requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (c *Client) CreateDocument(
+	ctx context.Context,
+	title string,
+	body string,
+) (*Document, error) {
+	var doc Document
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/docs", map[string]string{
+		"title": title,
+		"body":  body,
+	}, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// CreateDocumentFromTemplate creates a document from a template. Empty
+// title and body default to the template's, and placeholders like {{date}}
+// are expanded.
+func (c *Client) CreateDocumentFromTemplate(
+	ctx context.Context,
+	templateID int64,
+	title string,
+	body string,
+) (*Document, error) {
+	path := "/api/v1/docs?template=" + strconv.FormatInt(templateID, 10)
+	var doc Document
+	_, err := c.do(ctx, http.MethodPost, path, map[string]string{
+		"title": title,
+		"body":  body,
+	}, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (c *Client) ListDocuments(
+	ctx context.Context,
+	opts ListOptions,
+) (*DocumentPage, error) {
+	query := url.Values{}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if len(opts.Fields) > 0 {
+		query.Set("fields", strings.Join(opts.Fields, ","))
+	}
+	path := "/api/v1/docs"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var page DocumentPage
+	res, err := c.do(ctx, http.MethodGet, path, nil, &page.Documents)
+	if err != nil {
+		return nil, err
+	}
+	page.NextCursor = nextCursor(res.Header.Get("Link"))
+	return &page, nil
+}
+
+func (c *Client) GetDocument(ctx context.Context, id int64) (*Document, error) {
+	var doc Document
+	_, err := c.do(ctx, http.MethodGet, documentPath(id), nil, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (c *Client) UpdateDocument(
+	ctx context.Context,
+	id int64,
+	update DocumentUpdate,
+) (*Document, error) {
+	var doc Document
+	_, err := c.do(ctx, http.MethodPatch, documentPath(id), update, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (c *Client) DeleteDocument(ctx context.Context, id int64) error {
+	_, err := c.do(ctx, http.MethodDelete, documentPath(id), nil, nil)
+	return err
+}
+
+// BatchDocuments runs operations in a single transaction. With mode
+// BatchAllOrNothing any failure rolls back the batch and returns a
+// *BatchError; with BatchBestEffort failed operations only have an error in
+// their result.
+func (c *Client) BatchDocuments(
+	ctx context.Context,
+	mode string,
+	operations []BatchOperation,
+) ([]*BatchResult, error) {
+	var res struct {
+		Results []*BatchResult `json:"results"`
+	}
+	in := map[string]interface{}{
+		"mode":       mode,
+		"operations": operations,
+	}
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/docs/batch", in, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Results, nil
+}
+
+func (c *Client) CreateUser(
+	ctx context.Context,
+	username string,
+	email string,
+) (*User, error) {
+	var user User
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/users", map[string]string{
+		"username": username,
+		"email":    email,
+	}, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) GetUser(ctx context.Context, id int64) (*User, error) {
+	var user User
+	_, err := c.do(ctx, http.MethodGet, userPath(id), nil, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) UpdateUser(
+	ctx context.Context,
+	id int64,
+	update UserUpdate,
+) (*User, error) {
+	var user User
+	_, err := c.do(ctx, http.MethodPatch, userPath(id), update, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) ListNotifications(
+	ctx context.Context,
+) ([]*Notification, error) {
+	var notifications []*Notification
+	_, err := c.do(
+		ctx,
+		http.MethodGet,
+		"/api/v1/notifications",
+		nil,
+		&notifications,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func documentPath(id int64) string {
+	return "/api/v1/docs/" + strconv.FormatInt(id, 10)
+}
+
+func userPath(id int64) string {
+	return "/api/v1/users/" + strconv.FormatInt(id, 10)
+}
+
+// do sends a request with an optional JSON body and decodes a successful
+// JSON response into out, if not nil.
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	in interface{},
+	out interface{},
+) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.SessionToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.SessionToken)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return res, decodeError(res)
+	}
+	if out != nil && res.StatusCode != http.StatusNoContent {
+		err = json.NewDecoder(res.Body).Decode(out)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// decodeError reads the error body of a response, falling back to the
+// status text if it is not JSON.
+func decodeError(res *http.Response) error {
+	var body struct {
+		Error   Error          `json:"error"`
+		Current *Document      `json:"current"`
+		Results []*BatchResult `json:"results"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&body)
+	if err != nil || body.Error.Code == "" {
+		body.Error.Message = http.StatusText(res.StatusCode)
+	}
+	body.Error.StatusCode = res.StatusCode
+	if res.StatusCode == http.StatusConflict && body.Current != nil {
+		return &ConflictError{Err: &body.Error, Current: body.Current}
+	}
+	if len(body.Results) > 0 {
+		return &BatchError{Err: &body.Error, Results: body.Results}
+	}
+	return &body.Error
+}
+
+var nextLinkRegexp = regexp.MustCompile(`<([^>]*)>;\s*rel="next"`)
+
+// nextCursor returns the cursor of the next page from a Link header.
+func nextCursor(link string) string {
+	m := nextLinkRegexp.FindStringSubmatch(link)
+	if m == nil {
+		return ""
+	}
+	u, err := url.Parse(m[1])
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("cursor")
+}
@@ -0,0 +1,342 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~sirodoht/lakehouse/internal"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// newTestClient returns a client of a test server running the API router
+// of the server. With LAKEHOUSE_TEST_DATABASE_URL set its store is on a
+// schema of its own in that database, otherwise it is in memory.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	var store internal.Store
+	if dsn := os.Getenv("LAKEHOUSE_TEST_DATABASE_URL"); dsn != "" {
+		store = newSQLStore(t, dsn)
+	} else {
+		store = internal.NewMemoryStore()
+	}
+	api := internal.NewHandlerAPI(store, zap.NewNop())
+	r := chi.NewRouter()
+	r.Route("/api/v1", api.Routes)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	c := New(srv.URL)
+	c.HTTPClient = srv.Client()
+	return c
+}
+
+// newSQLStore returns a store on a new schema that is dropped after the
+// test.
+func newSQLStore(t *testing.T, dsn string) *internal.SQLStore {
+	t.Helper()
+	admin, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	schema := fmt.Sprintf("lakehouse_test_%d", time.Now().UnixNano())
+	admin.MustExec("CREATE SCHEMA " + schema)
+	t.Cleanup(func() {
+		admin.MustExec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	db, err := sqlx.Connect("postgres", dsn+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ddl, err := os.ReadFile("../../postgresql/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MustExec(string(ddl))
+	return internal.NewSQLStore(db, zap.NewNop())
+}
+
+func TestCreateAndGetDocument(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	created, err := c.CreateDocument(ctx, "groceries", "milk")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if created.ID == 0 || created.Title != "groceries" ||
+		created.Body != "milk" || created.Version != 1 {
+		t.Fatalf("created = %+v", created)
+	}
+
+	got, err := c.GetDocument(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.ID != created.ID || got.Title != "groceries" ||
+		got.Version != created.Version {
+		t.Fatalf("got = %+v, want %+v", got, created)
+	}
+}
+
+func TestCreateDocumentValidationError(t *testing.T) {
+	c := newTestClient(t)
+
+	_, err := c.CreateDocument(context.Background(), "", "milk")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusUnprocessableEntity ||
+		apiErr.Code != "validation_failed" {
+		t.Fatalf("err = %+v", apiErr)
+	}
+	if len(apiErr.Details) != 1 || apiErr.Details[0].Field != "title" {
+		t.Fatalf("details = %+v", apiErr.Details)
+	}
+}
+
+func TestGetDocumentNotFound(t *testing.T) {
+	c := newTestClient(t)
+
+	_, err := c.GetDocument(context.Background(), 999999)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound ||
+		apiErr.Code != "not_found" {
+		t.Fatalf("err = %+v", apiErr)
+	}
+}
+
+func TestListDocumentsWithCursor(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	for _, title := range []string{"c", "a", "b"} {
+		_, err := c.CreateDocument(ctx, title, "body")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	var titles []string
+	opts := ListOptions{Limit: 2, Sort: "title"}
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatal("cursor does not end")
+		}
+		page, err := c.ListDocuments(ctx, opts)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		for _, doc := range page.Documents {
+			titles = append(titles, doc.Title)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if strings.Join(titles, ",") != "a,b,c" {
+		t.Fatalf("titles = %v, want a,b,c", titles)
+	}
+}
+
+func TestUpdateDocumentConflict(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	doc, err := c.CreateDocument(ctx, "draft", "one")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	body := "two"
+	updated, err := c.UpdateDocument(ctx, doc.ID, DocumentUpdate{
+		Body:    &body,
+		Version: doc.Version,
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if updated.Body != "two" || updated.Version != doc.Version+1 {
+		t.Fatalf("updated = %+v", updated)
+	}
+
+	stale := "three"
+	_, err = c.UpdateDocument(ctx, doc.ID, DocumentUpdate{
+		Body:    &stale,
+		Version: doc.Version,
+	})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("err = %v, want *ConflictError", err)
+	}
+	if conflict.Current == nil || conflict.Current.Body != "two" ||
+		conflict.Current.Version != updated.Version {
+		t.Fatalf("current = %+v", conflict.Current)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != "conflict" {
+		t.Fatalf("err = %v, want conflict *Error", err)
+	}
+}
+
+func TestUpdateDocumentWithoutVersion(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	doc, err := c.CreateDocument(ctx, "draft", "one")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	body := "two"
+	_, err = c.UpdateDocument(ctx, doc.ID, DocumentUpdate{Body: &body})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) ||
+		apiErr.StatusCode != http.StatusPreconditionRequired ||
+		apiErr.Code != "precondition_required" {
+		t.Fatalf("err = %v, want precondition_required", err)
+	}
+	got, err := c.GetDocument(ctx, doc.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Body != "one" {
+		t.Fatalf("body = %q, unconditional update was applied", got.Body)
+	}
+}
+
+func TestDeleteDocumentLoggedOut(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	doc, err := c.CreateDocument(ctx, "keep", "me")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	err = c.DeleteDocument(ctx, doc.ID)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) ||
+		apiErr.StatusCode != http.StatusUnauthorized ||
+		apiErr.Code != "unauthorized" {
+		t.Fatalf("err = %v, want unauthorized", err)
+	}
+	if _, err := c.GetDocument(ctx, doc.ID); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+}
+
+func TestBatchDocumentsRolledBack(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	title, body := "new", "body"
+	_, err := c.BatchDocuments(ctx, BatchAllOrNothing, []BatchOperation{
+		{Op: "create", Title: &title, Body: &body},
+		{Op: "update", ID: 999999, Body: &body, Version: 1},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("err = %v, want *BatchError", err)
+	}
+	if batchErr.Err.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d", batchErr.Err.StatusCode)
+	}
+	if len(batchErr.Results) != 2 {
+		t.Fatalf("results = %+v", batchErr.Results)
+	}
+	first, failed := batchErr.Results[0], batchErr.Results[1]
+	if first.Status != http.StatusFailedDependency ||
+		first.Error == nil || first.Error.Code != "not_applied" {
+		t.Fatalf("first = %+v", first)
+	}
+	if failed.Status != http.StatusNotFound ||
+		failed.Error == nil || failed.Error.Code != "not_found" {
+		t.Fatalf("failed = %+v", failed)
+	}
+
+	page, err := c.ListDocuments(ctx, ListOptions{})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(page.Documents) != 0 {
+		t.Fatalf("rolled back batch created %+v", page.Documents)
+	}
+}
+
+func TestBatchDocumentsBestEffort(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	title, body := "new", "body"
+	results, err := c.BatchDocuments(ctx, BatchBestEffort, []BatchOperation{
+		{Op: "create", Title: &title, Body: &body},
+		{Op: "update", ID: 999999, Body: &body, Version: 1},
+	})
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results = %+v", results)
+	}
+	if results[0].Status != http.StatusCreated ||
+		results[0].Document == nil || results[0].Document.Title != "new" {
+		t.Fatalf("created = %+v", results[0])
+	}
+	if results[1].Status != http.StatusNotFound || results[1].Error == nil {
+		t.Fatalf("failed = %+v", results[1])
+	}
+}
+
+func TestDecodeErrorWithoutJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "upstream is down", http.StatusBadGateway)
+		},
+	))
+	defer srv.Close()
+
+	_, err := New(srv.URL).GetDocument(context.Background(), 1)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusBadGateway ||
+		apiErr.Message != "Bad Gateway" {
+		t.Fatalf("err = %+v", apiErr)
+	}
+}
+
+func TestNextCursor(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"", ""},
+		{`</api/v1/docs?cursor=abc&limit=2>; rel="next"`, "abc"},
+		{`</api/v1/docs?limit=2>; rel="prev"`, ""},
+	}
+	for _, tt := range tests {
+		if got := nextCursor(tt.link); got != tt.want {
+			t.Errorf("nextCursor(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
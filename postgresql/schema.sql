@@ -1,22 +1,115 @@
-CREATE TABLE documents (
+-- This file can be applied again to an existing database to upgrade it:
+-- tables and columns that are missing are added, the rest is left alone.
+
+CREATE TABLE IF NOT EXISTS documents (
     id serial PRIMARY KEY,
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL,
     title VARCHAR(300) NOT NULL,
-    body TEXT
+    body TEXT,
+    version INT NOT NULL DEFAULT 1,
+    deleted_at TIMESTAMP,
+    is_template BOOLEAN NOT NULL DEFAULT false,
+    owner_id INT
 );
 
-CREATE TABLE users (
+CREATE TABLE IF NOT EXISTS users (
     id serial PRIMARY KEY,
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL,
-    username VARCHAR(300) NOT NULL,
+    username VARCHAR(300) UNIQUE NOT NULL,
     email VARCHAR(300) NOT NULL,
-    password_hash VARCHAR(300) NOT NULL
+    password_hash VARCHAR(300) NOT NULL,
+    digest_frequency VARCHAR(16) NOT NULL DEFAULT 'off',
+    digest_sent_at TIMESTAMP,
+    is_admin BOOLEAN NOT NULL DEFAULT false,
+    disabled_at TIMESTAMP,
+    password_reset_required BOOLEAN NOT NULL DEFAULT false
 );
 
-CREATE TABLE sessions (
+CREATE TABLE IF NOT EXISTS sessions (
   id SERIAL PRIMARY KEY,
   user_id INT,
   token_hash TEXT UNIQUE NOT NULL
 );
+
+-- columns added after the tables were first created
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+ALTER TABLE documents
+  ADD COLUMN IF NOT EXISTS is_template BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS owner_id INT;
+CREATE INDEX IF NOT EXISTS documents_owner_id_idx ON documents (owner_id);
+
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS digest_frequency VARCHAR(16) NOT NULL DEFAULT 'off';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS digest_sent_at TIMESTAMP;
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+  password_reset_required BOOLEAN NOT NULL DEFAULT false;
+-- fails if two users already share a username; rename one of them first
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (username);
+
+CREATE TABLE IF NOT EXISTS document_follows (
+  user_id INT NOT NULL,
+  document_id INT NOT NULL,
+  PRIMARY KEY (user_id, document_id)
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL,
+  actor_id INT NOT NULL,
+  document_id INT NOT NULL,
+  kind VARCHAR(32) NOT NULL,
+  read_at TIMESTAMP,
+  created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, read_at);
+
+CREATE TABLE IF NOT EXISTS document_events (
+  id SERIAL PRIMARY KEY,
+  document_id INT NOT NULL,
+  actor_id INT,
+  kind VARCHAR(32) NOT NULL,
+  created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS document_events_created_at_idx ON document_events (created_at);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+  id SERIAL PRIMARY KEY,
+  username VARCHAR(300) NOT NULL,
+  ip VARCHAR(64) NOT NULL,
+  succeeded BOOLEAN NOT NULL,
+  created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON login_attempts (username, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+  id SERIAL PRIMARY KEY,
+  actor_id INT,
+  actor_username VARCHAR(300) NOT NULL,
+  kind VARCHAR(64) NOT NULL,
+  target_type VARCHAR(32) NOT NULL,
+  target_id INT,
+  ip VARCHAR(64) NOT NULL,
+  user_agent TEXT NOT NULL,
+  before JSONB,
+  after JSONB,
+  created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at);
+
+-- audit events are never changed or deleted
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+  FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
@@ -8,6 +8,22 @@ const server = Server.configure({
     console.log("🔮");
   },
 
+  // /stats reports connections for the metrics of the web server
+  async onRequest({ request, response, instance }) {
+    if (request.url !== "/stats") {
+      return;
+    }
+    response.writeHead(200, { "Content-Type": "application/json" });
+    response.end(
+      JSON.stringify({
+        connections: instance.getConnectionsCount(),
+        documents: instance.getDocumentsCount(),
+      })
+    );
+    // rejecting with nothing stops hocuspocus from responding itself
+    throw null;
+  },
+
   extensions: [
     new SQLite({
       database: "../db.sqlite",